@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// buildCmd represents the build command
+var buildCmd = &cobra.Command{
+	Use:   "build [flags] [go build flags] [packages]",
+	Short: "go build with instrumentation",
+	Long: `Build runs go build with -toolexec set to this moriarty binary, so that the
+packages of the main module are instrumented as they are compiled. All
+arguments after moriarty's own flags are passed to go build:
+
+  moriarty build -o app ./cmd/app
+  MORIARTY_MODE=online MORIARTY_SEED=7 ./app`,
+	DisableFlagParsing: true,
+	SilenceUsage:       true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGo(cmd, "build", args)
+	},
+}
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run [flags] [go run flags] <package> [args...]",
+	Short: "go run with instrumentation",
+	Long: `Run runs go run with -toolexec set to this moriarty binary and the program
+scheduled as the flags say. All arguments after moriarty's own flags are
+passed to go run:
+
+  moriarty run --mode online --seed 7 . -addr :8080
+
+Flags that are not set leave the MORIARTY_* environment variables as they
+are.`,
+	DisableFlagParsing: true,
+	SilenceUsage:       true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGo(cmd, "run", args)
+	},
+}
+
+// testCmd represents the test command
+var testCmd = &cobra.Command{
+	Use:   "test [flags] [go test flags] [packages] [test binary flags]",
+	Short: "go test with instrumentation",
+	Long: `Test runs go test with -toolexec set to this moriarty binary and the test
+binaries scheduled as the flags say. All arguments after moriarty's own
+flags are passed to go test:
+
+  moriarty test --mode pct --seed 3 -run TestTransfer ./bank
+
+Flags that are not set leave the MORIARTY_* environment variables as they
+are.`,
+	DisableFlagParsing: true,
+	SilenceUsage:       true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGo(cmd, "test", args)
+	},
+}
+
+// runGo runs the go subcommand with -toolexec pointing at this binary. The
+// leading arguments that are moriarty flags of cmd are parsed, the others
+// are passed on.
+func runGo(cmd *cobra.Command, sub string, args []string) error {
+	own, rest := splitFlags(cmd.Flags(), args)
+	if err := cmd.Flags().Parse(own); err != nil {
+		return err
+	}
+	if help, _ := cmd.Flags().GetBool("help"); help {
+		return cmd.Help()
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	// go splits -toolexec like a shell would, honoring quotes
+	toolexec := exePath + " toolexec"
+	if strings.ContainsAny(exePath, " \t") {
+		toolexec = "'" + exePath + "' toolexec"
+	}
+
+	goArgs := append([]string{sub, "-toolexec", toolexec}, rest...)
+	command := exec.Command("go", goArgs...)
+	command.Stdin = os.Stdin
+	command.Stdout = cmd.OutOrStdout()
+	command.Stderr = cmd.ErrOrStderr()
+	command.Env = append(os.Environ(), moriartyEnv(cmd.Flags())...)
+	if err := command.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// splitFlags splits args into the leading arguments that are flags of fs,
+// with their values, and the rest. Flags of fs are only recognized in their
+// --name and -x forms, so that go's own -name flags are passed on; "--" ends
+// them explicitly.
+func splitFlags(fs *pflag.FlagSet, args []string) (own, rest []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return own, args[i+1:]
+		}
+		var f *pflag.Flag
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name, _, _ := strings.Cut(arg[2:], "=")
+			f = fs.Lookup(name)
+		case len(arg) == 2 && arg[0] == '-':
+			f = fs.ShorthandLookup(arg[1:])
+		}
+		if f == nil {
+			return own, args[i:]
+		}
+		own = append(own, arg)
+		if !strings.Contains(arg, "=") && f.NoOptDefVal == "" && i+1 < len(args) {
+			i++
+			own = append(own, args[i])
+		}
+	}
+	return own, nil
+}
+
+// moriartyEnv returns the MORIARTY_* variables for the scheduling flags set
+// in fs.
+func moriartyEnv(fs *pflag.FlagSet) []string {
+	var env []string
+	set := func(flag, name, value string) {
+		if f := fs.Lookup(flag); f != nil && f.Changed {
+			env = append(env, name+"="+value)
+		}
+	}
+	set("mode", "MORIARTY_MODE", goMode)
+	set("seed", "MORIARTY_SEED", strconv.FormatInt(goSeed, 10))
+	set("trace", "MORIARTY_TRACE", goTrace)
+	set("record", "MORIARTY_RECORD", goRecord)
+	set("detect", "MORIARTY_DETECT", strconv.FormatBool(goDetect))
+	return env
+}
+
+var goMode string
+var goSeed int64
+var goTrace string
+var goRecord string
+var goDetect bool
+
+func init() {
+	rootCmd.AddCommand(buildCmd, runCmd, testCmd)
+
+	for _, c := range []*cobra.Command{runCmd, testCmd} {
+		c.Flags().StringVarP(&goMode, "mode", "m", "record",
+			"MORIARTY_MODE: record, replay, random, online, pct or explore")
+		c.Flags().Int64Var(&goSeed, "seed", 0,
+			"MORIARTY_SEED: seed of the random, online and pct modes")
+		c.Flags().StringVarP(&goTrace, "trace", "T", "moriarty.trace",
+			"MORIARTY_TRACE: trace recorded, replayed or reordered")
+		c.Flags().StringVar(&goRecord, "record", "",
+			"MORIARTY_RECORD: trace the random, online, pct and explore modes record their run to")
+		c.Flags().BoolVar(&goDetect, "detect", true,
+			"MORIARTY_DETECT: run the race detector")
+	}
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+	"github.com/spf13/cobra"
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check [flags] <binary> [args...]",
+	Short: "explore the schedules of an instrumented program",
+	Long: `Check runs an instrumented binary repeatedly, each time under another
+schedule, until a run fails or every schedule that may behave differently
+was explored. Dynamic partial-order reduction skips schedules that only
+reorder independent events.
+
+With --bound, check instead runs every schedule that needs at most
+--max-bound preemptions, or delays, of a baseline schedule that keeps running
+a goroutine until it stops. Schedules are tried by increasing bound, so the
+failing schedule found is one of the simplest. MORIARTY_BOUND and
+MORIARTY_MAX_BOUND set the defaults of both flags.
+
+A run fails if it exits with a non-zero status, panics, reports a data race
+or runs longer than --timeout. The schedule of the first failing run is
+saved as a trace that replays it:
+
+  MORIARTY_MODE=replay MORIARTY_TRACE=<output> <binary> [args...]`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := runtime.ParseTraceFormat(checkFormat)
+		if err != nil {
+			return err
+		}
+		bound, maxBound, err := checkBounds(cmd)
+		if err != nil {
+			return err
+		}
+		runner := &explore.Command{Path: args[0], Args: args[1:], Timeout: checkTimeout}
+		if !checkDetect {
+			runner.Env = append(runner.Env, "MORIARTY_DETECT=0")
+		}
+		out := cmd.OutOrStdout()
+		opts := explore.Options{MaxSchedules: checkMaxSchedules}
+		if checkVerbose {
+			opts.Progress = func(n int, r *explore.Run) {
+				status := "passed"
+				if r.Failure != nil {
+					status = "failed: " + r.Failure.String()
+				}
+				fmt.Fprintf(out, "schedule %d: %d steps, %s\n", n, len(r.Steps), status)
+			}
+		}
+
+		var res *explore.Result
+		var within string
+		if bound == 0 {
+			res, err = explore.DPOR(cmd.Context(), runner, opts)
+		} else {
+			res, err = explore.Bounded(cmd.Context(), runner, bound, maxBound, opts)
+			within = fmt.Sprintf(" within %d %s", res.Bound, plural(res.Bound, bound.String()))
+		}
+		if err != nil {
+			return err
+		}
+		if res.Deviated > 0 {
+			fmt.Fprintf(out, "%d runs could not follow their schedule, the program may not be deterministic\n", res.Deviated)
+		}
+		if res.Failure == nil {
+			status := "complete"
+			if !res.Complete {
+				status = "stopped at --max-schedules"
+			}
+			fmt.Fprintf(out, "explored %d schedules%s, none failed (%s)\n", res.Schedules, within, status)
+			return nil
+		}
+
+		os.Stderr.Write(res.Failure.Output)
+		if err := res.Failure.SaveTrace(checkOutput, runtime.TraceOptions{Format: format}); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "schedule %d%s failed: %v\n", res.Schedules, within, res.Failure.Failure)
+		fmt.Fprintf(out, "saved the failing schedule to %s, replay it with:\n  MORIARTY_MODE=replay MORIARTY_TRACE=%s %s\n",
+			checkOutput, checkOutput, strings.Join(args, " "))
+		return fmt.Errorf("found a failing schedule")
+	},
+}
+
+// checkBounds returns the bound of the exploration, 0 for DPOR, and its
+// maximum, from the flags or the environment.
+func checkBounds(cmd *cobra.Command) (explore.Bound, int, error) {
+	name, maxBound := checkBound, checkMaxBound
+	if v, ok := os.LookupEnv("MORIARTY_BOUND"); ok && !cmd.Flags().Changed("bound") {
+		name = v
+	}
+	if v, ok := os.LookupEnv("MORIARTY_MAX_BOUND"); ok && !cmd.Flags().Changed("max-bound") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid MORIARTY_MAX_BOUND: %w", err)
+		}
+		maxBound = n
+	}
+	if maxBound < 0 {
+		return 0, 0, fmt.Errorf("invalid maximum bound %d", maxBound)
+	}
+	if name == "" {
+		return 0, maxBound, nil
+	}
+	bound, err := explore.ParseBound(name)
+	return bound, maxBound, err
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return noun
+	}
+	return noun + "s"
+}
+
+var checkMaxSchedules int
+var checkBound string
+var checkMaxBound int
+var checkTimeout time.Duration
+var checkOutput string
+var checkFormat string
+var checkDetect bool
+var checkVerbose bool
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	checkCmd.Flags().SetInterspersed(false)
+	checkCmd.Flags().IntVarP(&checkMaxSchedules, "max-schedules", "n", 0,
+		"stop after this many schedules, 0 for no limit")
+	checkCmd.Flags().StringVar(&checkBound, "bound", "",
+		"explore by increasing number of preemptions or delays instead of DPOR: preemption or delay")
+	checkCmd.Flags().IntVarP(&checkMaxBound, "max-bound", "k", 2,
+		"largest number of preemptions or delays a schedule may need")
+	checkCmd.Flags().DurationVarP(&checkTimeout, "timeout", "t", 30*time.Second,
+		"time limit of a single run")
+	checkCmd.Flags().StringVarP(&checkOutput, "output", "o", "moriarty.trace",
+		"trace the failing schedule is saved to")
+	checkCmd.Flags().StringVarP(&checkFormat, "format", "F", "json",
+		"format of the saved trace: json or binary")
+	checkCmd.Flags().BoolVar(&checkDetect, "detect", true,
+		"treat data races reported by the detector as failures")
+	checkCmd.Flags().BoolVarP(&checkVerbose, "verbose", "v", false,
+		"print the outcome of every schedule")
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+	"github.com/spf13/cobra"
+)
+
+// exploreCmd represents the explore command
+var exploreCmd = &cobra.Command{
+	Use:   "explore [flags] <binary> [args...]",
+	Short: "run an instrumented program under many seeds",
+	Long: `Explore runs an instrumented binary again and again, each time with the
+next seed, cycling through the scheduling modes given by --mode, until
+--runs runs completed, --duration passed or it is interrupted. With -j,
+several runs proceed at a time.
+
+A run fails if it exits with a non-zero status, panics, reports a data race
+or runs longer than --timeout. Failures are grouped by their cause: the exit
+status, the panic message or the locations of the racing accesses. For each
+distinct failure, the recorded schedule of its first run and the run's
+standard error are kept in --output, named after the mode and seed, and the
+schedule replays the failure:
+
+  MORIARTY_MODE=replay MORIARTY_TRACE=<trace> <binary> [args...]`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		runs := exploreRuns
+		if exploreDuration > 0 && !cmd.Flags().Changed("runs") {
+			runs = 0
+		}
+		if err := os.MkdirAll(exploreOutput, 0755); err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+		if exploreDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, exploreDuration)
+			defer cancel()
+		}
+
+		runner := &explore.Command{Path: args[0], Args: args[1:], Timeout: exploreTimeout}
+		if !exploreDetect {
+			runner.Env = append(runner.Env, "MORIARTY_DETECT=0")
+		}
+		out := cmd.OutOrStdout()
+		opts := explore.SweepOptions{
+			Modes:     exploreModes,
+			FirstSeed: exploreSeed,
+			Runs:      runs,
+			Jobs:      exploreJobs,
+			Dir:       exploreOutput,
+		}
+		if exploreVerbose {
+			opts.Progress = func(s *explore.Sample) {
+				status := "passed"
+				if s.Failure != nil {
+					status = "failed: " + s.Failure.String()
+				}
+				fmt.Fprintf(out, "%s seed %d: %s\n", s.Mode, s.Seed, status)
+			}
+		}
+
+		start := time.Now()
+		res, err := explore.Sweep(ctx, runner, opts)
+		if err != nil {
+			return err
+		}
+		status := "complete"
+		if !res.Complete {
+			status = "stopped"
+		}
+		fmt.Fprintf(out, "runs:      %d in %v (%s)\n", res.Runs, time.Since(start).Round(time.Millisecond), status)
+		fmt.Fprintf(out, "failures:  %d\n", res.Failures)
+		fmt.Fprintf(out, "distinct:  %d\n", len(res.Groups))
+		if len(res.Groups) == 0 {
+			os.Remove(exploreOutput) // only if empty
+			return nil
+		}
+
+		fmt.Fprintln(out)
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SIGNATURE\tRUNS\tFIRST\tTRACE")
+		for _, g := range res.Groups {
+			log := strings.TrimSuffix(g.First.Trace, ".trace") + ".log"
+			if err := os.WriteFile(log, g.First.Output, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s seed %d\t%s\n", g.Signature, g.Count, g.First.Mode, g.First.Seed, g.First.Trace)
+		}
+		w.Flush()
+		fmt.Fprintf(out, "\nreplay a failure with:\n  MORIARTY_MODE=replay MORIARTY_TRACE=<trace> %s\n", strings.Join(args, " "))
+		return fmt.Errorf("found %d distinct %s", len(res.Groups), plural(len(res.Groups), "failure"))
+	},
+}
+
+var exploreRuns int
+var exploreDuration time.Duration
+var exploreJobs int
+var exploreModes []string
+var exploreSeed int64
+var exploreTimeout time.Duration
+var exploreOutput string
+var exploreDetect bool
+var exploreVerbose bool
+
+func init() {
+	rootCmd.AddCommand(exploreCmd)
+
+	exploreCmd.Flags().SetInterspersed(false)
+	exploreCmd.Flags().IntVarP(&exploreRuns, "runs", "n", 100,
+		"number of runs, 0 for no limit; unlimited by default with --duration")
+	exploreCmd.Flags().DurationVarP(&exploreDuration, "duration", "d", 0,
+		"time budget of the whole exploration, 0 for none")
+	exploreCmd.Flags().IntVarP(&exploreJobs, "jobs", "j", 1,
+		"number of runs at a time")
+	exploreCmd.Flags().StringSliceVarP(&exploreModes, "mode", "m", []string{"online", "pct"},
+		"scheduling modes the runs cycle through: online, pct, or random with MORIARTY_TRACE set")
+	exploreCmd.Flags().Int64Var(&exploreSeed, "seed", 1,
+		"seed of the first run in each mode")
+	exploreCmd.Flags().DurationVarP(&exploreTimeout, "timeout", "t", 30*time.Second,
+		"time limit of a single run")
+	exploreCmd.Flags().StringVarP(&exploreOutput, "output", "o", "moriarty-failures",
+		"directory the schedules of failing runs are kept in")
+	exploreCmd.Flags().BoolVar(&exploreDetect, "detect", true,
+		"treat data races reported by the detector as failures")
+	exploreCmd.Flags().BoolVarP(&exploreVerbose, "verbose", "v", false,
+		"print the outcome of every run")
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+	"github.com/spf13/cobra"
+)
+
+// minimizeCmd represents the minimize command
+var minimizeCmd = &cobra.Command{
+	Use:   "minimize [flags] <binary> [args...]",
+	Short: "reduce the context switches of a failing trace",
+	Long: `Minimize replays a failing trace of an instrumented binary over and over,
+each time with fewer context switches, and keeps the changes under which the
+replay still fails. Runs of a goroutine's events are moved next to its
+previous or next run so that they merge, the way delta debugging removes
+parts of a failing input, while each goroutine's events keep their order.
+
+By default a replay fails like the original if it fails the same way, with
+the same exit status, panic message, or a data race. --oracle relaxes this
+to any failure of a kind, and --match additionally requires the program's
+standard error to match a regular expression.
+
+The smallest failing trace found is saved to --output, which replays it:
+
+  MORIARTY_MODE=replay MORIARTY_TRACE=<output> <binary> [args...]`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := runtime.ParseTraceFormat(minimizeFormat)
+		if err != nil {
+			return err
+		}
+		oracle, err := minimizeOracle()
+		if err != nil {
+			return err
+		}
+		header, err := runtime.ReadTraceHeader(minimizeTrace)
+		if err != nil {
+			return err
+		}
+		trace, err := runtime.LoadTrace(minimizeTrace)
+		if err != nil {
+			return err
+		}
+		output := minimizeOutput
+		if output == "" {
+			output = minimizeTrace + ".min"
+		}
+
+		runner := &explore.Command{Path: args[0], Args: args[1:], Timeout: minimizeTimeout,
+			Env: []string{"MORIARTY_WATCHDOG=" + minimizeWatchdog.String()}}
+		if !minimizeDetect {
+			runner.Env = append(runner.Env, "MORIARTY_DETECT=0")
+		}
+		out := cmd.OutOrStdout()
+		opts := explore.MinimizeOptions{MaxRuns: minimizeMaxRuns}
+		if minimizeVerbose {
+			opts.Progress = func(n, switches int) {
+				fmt.Fprintf(out, "replay %d: %d context switches\n", n, switches)
+			}
+		}
+
+		res, err := explore.Minimize(cmd.Context(), runner, header, trace, oracle, opts)
+		if errors.Is(err, explore.ErrNotReproduced) {
+			return fmt.Errorf("replaying %s does not fail as expected", minimizeTrace)
+		}
+		if err != nil {
+			return err
+		}
+		if err := runtime.SaveTraceWith(output, res.Trace, runtime.TraceOptions{Header: header, Format: format}); err != nil {
+			return err
+		}
+		status := "complete"
+		if !res.Complete {
+			status = "stopped at --max-runs"
+		}
+		fmt.Fprintf(out, "reduced %d context switches to %d in %d replays (%s), still failing: %v\n",
+			res.Original, res.Switches, res.Runs, status, res.Failure)
+		fmt.Fprintf(out, "saved the minimized trace to %s, replay it with:\n  MORIARTY_MODE=replay MORIARTY_TRACE=%s %s\n",
+			output, output, strings.Join(args, " "))
+		return nil
+	},
+}
+
+// minimizeOracle returns the oracle set by --oracle and --match, nil for a
+// failure like the original one.
+func minimizeOracle() (explore.Oracle, error) {
+	var match *regexp.Regexp
+	if minimizeMatch != "" {
+		var err error
+		if match, err = regexp.Compile(minimizeMatch); err != nil {
+			return nil, fmt.Errorf("invalid --match: %w", err)
+		}
+	}
+	var kind func(f *explore.Failure) bool
+	switch minimizeOracleKind {
+	case "same":
+		if match == nil {
+			return nil, nil
+		}
+		// Minimize asks the oracle about the original trace first.
+		var first *explore.Failure
+		kind = func(f *explore.Failure) bool {
+			if first == nil {
+				first = f
+			}
+			return f.Kind == first.Kind && f.Reason == first.Reason
+		}
+	case "any":
+		kind = func(f *explore.Failure) bool { return true }
+	default:
+		want, ok := map[string]explore.FailureKind{
+			"exit": explore.FailExit, "panic": explore.FailPanic,
+			"race": explore.FailRace, "timeout": explore.FailTimeout,
+		}[minimizeOracleKind]
+		if !ok {
+			return nil, fmt.Errorf("unknown oracle %q, expected same, exit, panic, race, timeout or any", minimizeOracleKind)
+		}
+		kind = func(f *explore.Failure) bool { return f.Kind == want }
+	}
+	return func(f *explore.Failure, output []byte) bool {
+		return kind(f) && (match == nil || match.Match(output))
+	}, nil
+}
+
+var minimizeTrace string
+var minimizeOutput string
+var minimizeFormat string
+var minimizeOracleKind string
+var minimizeMatch string
+var minimizeMaxRuns int
+var minimizeTimeout time.Duration
+var minimizeWatchdog time.Duration
+var minimizeDetect bool
+var minimizeVerbose bool
+
+func init() {
+	rootCmd.AddCommand(minimizeCmd)
+
+	minimizeCmd.Flags().SetInterspersed(false)
+	minimizeCmd.Flags().StringVarP(&minimizeTrace, "trace", "T", "moriarty.trace",
+		"failing trace to minimize")
+	minimizeCmd.Flags().StringVarP(&minimizeOutput, "output", "o", "",
+		"trace the minimized schedule is saved to, the input trace with .min appended by default")
+	minimizeCmd.Flags().StringVarP(&minimizeFormat, "format", "F", "json",
+		"format of the saved trace: json or binary")
+	minimizeCmd.Flags().StringVar(&minimizeOracleKind, "oracle", "same",
+		"failures that count as reproducing: same, exit, panic, race, timeout or any")
+	minimizeCmd.Flags().StringVar(&minimizeMatch, "match", "",
+		"regular expression the standard error of a reproducing run must match")
+	minimizeCmd.Flags().IntVarP(&minimizeMaxRuns, "max-runs", "n", 0,
+		"stop after this many replays, 0 for no limit")
+	minimizeCmd.Flags().DurationVarP(&minimizeTimeout, "timeout", "t", 30*time.Second,
+		"time limit of a single replay")
+	minimizeCmd.Flags().DurationVar(&minimizeWatchdog, "watchdog", time.Second,
+		"end replays that make no progress for this long, as their trace cannot be followed")
+	minimizeCmd.Flags().BoolVar(&minimizeDetect, "detect", true,
+		"run the race detector during replays")
+	minimizeCmd.Flags().BoolVarP(&minimizeVerbose, "verbose", "v", false,
+		"print the context switches of every replay")
+}
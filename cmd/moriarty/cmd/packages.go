@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/amirkhaki/moriarty"
+)
+
+// moriartyPackages lists the packages instrumented code may import, in
+// dependency order, with their source directories in moriarty.Sources
+var moriartyPackages = []struct {
+	path string
+	dir  string
+}{
+	{"github.com/amirkhaki/moriarty/pkg/goid", "pkg/goid"},
+	{"github.com/amirkhaki/moriarty/pkg/runtime", "pkg/runtime"},
+	{"github.com/amirkhaki/moriarty/pkg/shim/sync", "pkg/shim/sync"},
+}
+
+// isMoriartyPackage reports whether pkgPath is one of moriartyPackages
+func isMoriartyPackage(pkgPath string) bool {
+	for _, pkg := range moriartyPackages {
+		if pkg.path == pkgPath {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyImportCfg adds our runtime and shim packages to the importcfg file
+func modifyImportCfg(originalPath, tempDir string) (string, error) {
+	return addMoriartyPackages(originalPath, tempDir, "importcfg")
+}
+
+// modifyLinkImportCfg adds our runtime and shim packages to the link importcfg file
+func modifyLinkImportCfg(originalPath, tempDir string) (string, error) {
+	return addMoriartyPackages(originalPath, tempDir, "importcfg.link")
+}
+
+// addMoriartyPackages writes a copy of the importcfg at originalPath to
+// tempDir with entries for the moriarty packages and the standard packages
+// they depend on added
+func addMoriartyPackages(originalPath, tempDir, name string) (string, error) {
+	// Read original importcfg
+	content, err := os.ReadFile(originalPath)
+	if err != nil {
+		return "", err
+	}
+	entries, err := moriartyArchives()
+	if err != nil {
+		return "", err
+	}
+
+	// Moriarty packages the go command built because the program imports
+	// them are replaced by ours, so that all packages use the same build
+	var newContent strings.Builder
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if pkgPath, ok := packageFilePath(line); ok {
+			if isMoriartyPackage(pkgPath) {
+				continue
+			}
+			present[pkgPath] = true
+		}
+		newContent.WriteString(line + "\n")
+	}
+
+	// The importcfg only lists what the program's package needs, while the
+	// link needs every package, so the missing standard packages are added
+	for _, entry := range entries {
+		if pkgPath, _, _ := strings.Cut(entry, "="); !present[pkgPath] {
+			newContent.WriteString("packagefile " + entry + "\n")
+		}
+	}
+
+	// Write modified importcfg
+	newPath := filepath.Join(tempDir, name)
+	if err := os.WriteFile(newPath, []byte(newContent.String()), 0644); err != nil {
+		return "", err
+	}
+
+	return newPath, nil
+}
+
+// packageFilePath returns the package path of a packagefile line of an
+// importcfg
+func packageFilePath(line string) (string, bool) {
+	rest, ok := strings.CutPrefix(line, "packagefile ")
+	if !ok {
+		return "", false
+	}
+	pkgPath, _, ok := strings.Cut(rest, "=")
+	return pkgPath, ok
+}
+
+// moriartyArchives returns the importcfg entries, as path=archive pairs, of
+// the moriarty packages compiled from the embedded sources and of the
+// standard packages they depend on. The archives are cached per Go version
+// and configuration in the user cache directory, and compiled on first use.
+func moriartyArchives() ([]string, error) {
+	out, err := exec.Command("go", "env", "GOVERSION", "GOTOOLDIR", "GOOS", "GOARCH", "GOEXPERIMENT", "GOFLAGS", "CGO_ENABLED").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run go env: %w", err)
+	}
+	env := strings.Split(string(out), "\n")
+	goVersion, toolDir := env[0], env[1]
+
+	// The cache key covers the go environment and the sources
+	h := sha256.New()
+	h.Write(out)
+	err = fs.WalkDir(moriarty.Sources, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(name, "_test.go") {
+			return err
+		}
+		src, err := moriarty.Sources.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(src))
+		h.Write(src)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the cache directory: %w", err)
+	}
+	dir := filepath.Join(cacheDir, "moriarty", goVersion, hex.EncodeToString(h.Sum(nil))[:16])
+
+	if entries, err := loadArchives(dir); err == nil {
+		return entries, nil
+	}
+	if err := buildArchives(dir, filepath.Join(toolDir, "compile")); err != nil {
+		return nil, err
+	}
+	return loadArchives(dir)
+}
+
+// loadArchives reads the importcfg entries of the archives cached in dir,
+// failing if any archive is missing, as the go build cache may have been
+// cleaned since
+func loadArchives(dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "importcfg"))
+	if err != nil {
+		return nil, err
+	}
+	entries := strings.Fields(string(content))
+	for _, entry := range entries {
+		_, archive, _ := strings.Cut(entry, "=")
+		if _, err := os.Stat(archive); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// buildArchives compiles the moriarty packages into dir, along with an
+// importcfg listing them and the standard packages they depend on. The
+// archives are built in a temporary directory that is renamed to dir, so
+// that concurrent builds do not see partial results.
+func buildArchives(dir, compilePath string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tempDir, err := os.MkdirTemp(filepath.Dir(dir), "build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	entries, err := stdPackages()
+	if err != nil {
+		return err
+	}
+	// Each package is compiled against the entries added before it
+	for _, pkg := range moriartyPackages {
+		name := strings.ReplaceAll(pkg.dir, "/", "_") + ".a"
+		importcfg := "packagefile " + strings.Join(entries, "\npackagefile ") + "\n"
+		if err := compileMoriartyPackage(compilePath, tempDir, pkg.path, pkg.dir, filepath.Join(tempDir, name), importcfg); err != nil {
+			return err
+		}
+		entries = append(entries, pkg.path+"="+filepath.Join(tempDir, name))
+	}
+
+	// The importcfg names the archives where they end up
+	var cfg strings.Builder
+	for _, entry := range entries {
+		cfg.WriteString(strings.Replace(entry, "="+tempDir, "="+dir, 1) + "\n")
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "importcfg"), []byte(cfg.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(tempDir, "src")); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempDir, dir); err != nil {
+		// Another build got there first, or an earlier one was left
+		// incomplete by a cleaned go build cache
+		if _, loadErr := loadArchives(dir); loadErr == nil {
+			return nil
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		return os.Rename(tempDir, dir)
+	}
+	return nil
+}
+
+// stdPackages returns the standard packages the moriarty packages depend on
+// as path=archive pairs, with the archives built by the go command
+func stdPackages() ([]string, error) {
+	var imports []string
+	for _, pkg := range moriartyPackages {
+		files, err := packageSources(pkg.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range files {
+			src, err := moriarty.Sources.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			f, err := parser.ParseFile(token.NewFileSet(), name, src, parser.ImportsOnly)
+			if err != nil {
+				return nil, err
+			}
+			for _, spec := range f.Imports {
+				imp, _ := strconv.Unquote(spec.Path.Value)
+				if !isMoriartyPackage(imp) && !slices.Contains(imports, imp) {
+					imports = append(imports, imp)
+				}
+			}
+		}
+	}
+
+	args := []string{"list", "-export", "-deps", "-f", "{{if .Export}}{{.ImportPath}}={{.Export}}{{end}}"}
+	out, err := exec.Command("go", append(args, imports...)...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to list standard packages: %w\nOutput: %s", err, exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("failed to list standard packages: %w", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// packageSources returns the names in moriarty.Sources of the non-test
+// sources in dir
+func packageSources(dir string) ([]string, error) {
+	files, err := fs.Glob(moriarty.Sources, path.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(files, func(name string) bool {
+		return strings.HasSuffix(name, "_test.go")
+	}), nil
+}
+
+// compileMoriartyPackage compiles the embedded sources in dir to archivePath,
+// writing them below tempDir for the compiler
+func compileMoriartyPackage(compilePath, tempDir, pkgPath, dir, archivePath, importcfg string) error {
+	files, err := packageSources(dir)
+	if err != nil {
+		return err
+	}
+	srcDir := filepath.Join(tempDir, "src")
+	var srcs []string
+	for _, name := range files {
+		src, err := moriarty.Sources.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		srcPath := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(srcPath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(srcPath, src, 0644); err != nil {
+			return err
+		}
+		srcs = append(srcs, srcPath)
+	}
+
+	cfgPath := filepath.Join(srcDir, filepath.Base(archivePath)+".importcfg")
+	if err := os.WriteFile(cfgPath, []byte(importcfg), 0644); err != nil {
+		return err
+	}
+
+	// File names in stacks read as in the module, not the temporary directory
+	trimpath := srcDir + "=>github.com/amirkhaki/moriarty"
+	args := append([]string{"-o", archivePath, "-p", pkgPath, "-importcfg", cfgPath, "-trimpath", trimpath}, srcs...)
+	cmd := exec.Command(compilePath, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to compile %s: %w\nOutput: %s", pkgPath, err, string(output))
+	}
+	return nil
+}
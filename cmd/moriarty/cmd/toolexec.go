@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"go/importer"
 	"go/printer"
@@ -32,6 +34,12 @@ func handleToolExec(cmd *cobra.Command, args []string) {
 	tool := args[0]
 	args = args[1:]
 
+	// The go command identifies tools by their version for caching
+	if len(args) == 1 && args[0] == "-V=full" {
+		handleVersionCommand(tool)
+		return
+	}
+
 	// Handle link command separately
 	if strings.HasSuffix(tool, "link") {
 		handleLinkCommand(tool, args)
@@ -70,7 +78,11 @@ func handleToolExec(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	var pkgPath string
 	for i, arg := range args {
+		if arg == "-p" && i+1 < len(args) {
+			pkgPath = args[i+1]
+		}
 		if strings.HasSuffix(arg, ".go") && !strings.HasPrefix(arg, "-") {
 			// Skip files in GOROOT
 			if goroot != "" && strings.HasPrefix(filepath.Clean(arg), filepath.Clean(goroot)) {
@@ -83,6 +95,12 @@ func handleToolExec(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	// Moriarty's own packages must not be instrumented, as the instrumentation
+	// calls into them
+	if isMoriartyPackage(pkgPath) {
+		goFiles = nil
+	}
+
 	// If no .go files, just pass through
 	if len(goFiles) == 0 {
 		cmd := exec.Command(tool, args...)
@@ -198,140 +216,36 @@ func createImporterFromCfg(importcfgPath string) (types.Importer, error) {
 	}
 
 	// Create an importer using the package map
-	// Use ForCompiler with gcexportdata for .a files
-	defaultImporter := importer.Default()
+	// Use ForCompiler with gcexportdata for .a files. A single importer
+	// is shared by all imports, so that packages they have in common are
+	// the same types.Package
+	gcImporter := importer.ForCompiler(token.NewFileSet(), "gc", func(p string) (io.ReadCloser, error) {
+		return os.Open(packageMap[p])
+	})
 	return &importCfgImporter{
 		packageMap:      packageMap,
-		defaultImporter: defaultImporter,
+		gcImporter:      gcImporter,
+		defaultImporter: importer.Default(),
 	}, nil
 }
 
 // importCfgImporter implements types.Importer using an importcfg package map
 type importCfgImporter struct {
 	packageMap      map[string]string
+	gcImporter      types.Importer
 	defaultImporter types.Importer
 }
 
 func (imp *importCfgImporter) Import(path string) (*types.Package, error) {
 	// Try to find package in our map
-	if archivePath, ok := imp.packageMap[path]; ok {
-		// Use ForCompiler to read .a files
-		gcImporter := importer.ForCompiler(token.NewFileSet(), "gc", func(p string) (io.ReadCloser, error) {
-			return os.Open(archivePath)
-		})
-		return gcImporter.Import(path)
+	if _, ok := imp.packageMap[path]; ok {
+		return imp.gcImporter.Import(path)
 	}
 
 	// Fall back to default importer
 	return imp.defaultImporter.Import(path)
 }
 
-// modifyImportCfg adds our runtime package to the importcfg file
-func modifyImportCfg(originalPath, tempDir string) (string, error) {
-	// Read original importcfg
-	content, err := os.ReadFile(originalPath)
-	if err != nil {
-		return "", err
-	}
-
-	// Compile the runtime package directly
-	runtimePkgPath := "github.com/amirkhaki/moriarty/pkg/runtime"
-	archivePath := filepath.Join(tempDir, "runtime.a")
-
-	// Find moriarty project root (where this binary is from)
-	// Assume it's in bin/ subdirectory
-	exePath, err := os.Executable()
-	if err != nil {
-		return "", fmt.Errorf("failed to get executable path: %w", err)
-	}
-	projectRoot := filepath.Dir(filepath.Dir(exePath))
-	runtimeSrcDir := filepath.Join(projectRoot, "pkg", "runtime")
-
-	// Get go tool compile path
-	compileCmd := exec.Command("go", "env", "GOTOOLDIR")
-	toolDir, err := compileCmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get GOTOOLDIR: %w", err)
-	}
-	compilePath := filepath.Join(strings.TrimSpace(string(toolDir)), "compile")
-
-	// Compile runtime.go to archive
-	runtimeSrc := filepath.Join(runtimeSrcDir, "runtime.go")
-	cmd := exec.Command(compilePath, "-o", archivePath, "-p", runtimePkgPath, runtimeSrc)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("failed to compile runtime package: %w\nOutput: %s", err, string(output))
-	}
-
-	// Create new importcfg with our package added
-	newContent := string(content)
-	runtimeEntry := fmt.Sprintf("packagefile %s=%s\n", runtimePkgPath, archivePath)
-
-	// Add it at the end
-	newContent = newContent + runtimeEntry
-
-	// Write modified importcfg
-	newPath := filepath.Join(tempDir, "importcfg")
-	if err := os.WriteFile(newPath, []byte(newContent), 0644); err != nil {
-		return "", err
-	}
-
-	return newPath, nil
-}
-
-// modifyLinkImportCfg adds our runtime package to the link importcfg file
-func modifyLinkImportCfg(originalPath, tempDir string) (string, error) {
-	// Read original importcfg
-	content, err := os.ReadFile(originalPath)
-	if err != nil {
-		return "", err
-	}
-
-	// Find the runtime.a file we compiled earlier
-	runtimePkgPath := "github.com/amirkhaki/moriarty/pkg/runtime"
-	archivePath := filepath.Join(tempDir, "runtime.a")
-
-	// Check if it exists (it should have been created during compile step)
-	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
-		// Compile it now if it doesn't exist
-		exePath, err := os.Executable()
-		if err != nil {
-			return "", fmt.Errorf("failed to get executable path: %w", err)
-		}
-		projectRoot := filepath.Dir(filepath.Dir(exePath))
-		runtimeSrcDir := filepath.Join(projectRoot, "pkg", "runtime")
-
-		// Get go tool compile path
-		compileCmd := exec.Command("go", "env", "GOTOOLDIR")
-		toolDir, err := compileCmd.Output()
-		if err != nil {
-			return "", fmt.Errorf("failed to get GOTOOLDIR: %w", err)
-		}
-		compilePath := filepath.Join(strings.TrimSpace(string(toolDir)), "compile")
-
-		// Compile runtime.go to archive
-		runtimeSrc := filepath.Join(runtimeSrcDir, "runtime.go")
-		cmd := exec.Command(compilePath, "-o", archivePath, "-p", runtimePkgPath, runtimeSrc)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return "", fmt.Errorf("failed to compile runtime package: %w\nOutput: %s", err, string(output))
-		}
-	}
-
-	// Create new importcfg with our package added
-	newContent := string(content)
-	runtimeEntry := fmt.Sprintf("packagefile %s=%s\n", runtimePkgPath, archivePath)
-
-	// Add it at the end
-	newContent = newContent + runtimeEntry
-
-	// Write modified importcfg
-	newPath := filepath.Join(tempDir, "importcfg.link")
-	if err := os.WriteFile(newPath, []byte(newContent), 0644); err != nil {
-		return "", err
-	}
-
-	return newPath, nil
-}
-
 // instrumentFilesToDir instruments multiple files together and writes them to the target directory
 // Returns the instrumented file paths and whether any instrumentation was added
 func instrumentFilesToDir(goFiles []string, targetDir string, customImporter types.Importer) ([]string, bool, error) {
@@ -372,6 +286,41 @@ func init() {
 	rootCmd.AddCommand(toolexecCmd)
 }
 
+// handleVersionCommand prints the version of tool with a hash of this binary
+// added, so that the go command caches instrumented packages apart from
+// others and rebuilds them when moriarty changes
+func handleVersionCommand(tool string) {
+	out, err := exec.Command(tool, "-V=full").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Stderr.Write(exitErr.Stderr)
+			os.Exit(exitErr.ExitCode())
+		}
+		os.Exit(1)
+	}
+	exePath, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: failed to get executable path: %v\n", err)
+		os.Exit(1)
+	}
+	exe, err := os.ReadFile(exePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: failed to read executable: %v\n", err)
+		os.Exit(1)
+	}
+	sum := sha256.Sum256(exe)
+	id := "moriarty=" + hex.EncodeToString(sum[:8])
+
+	// Development toolchains are identified by a trailing buildID field
+	fields := strings.Fields(string(out))
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "buildID=") {
+		fields = append(fields[:n-1], id, fields[n-1])
+	} else {
+		fields = append(fields, id)
+	}
+	fmt.Println(strings.Join(fields, " "))
+}
+
 // handleLinkCommand intercepts link commands and adds our runtime package to importcfg
 func handleLinkCommand(tool string, args []string) {
 	// Find importcfg in arguments
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+	"github.com/spf13/cobra"
+)
+
+// traceCmd groups the commands working on trace files
+var traceCmd = &cobra.Command{
+	Use:   "trace",
+	Short: "work with recorded traces",
+}
+
+// traceConvertCmd represents the trace convert command
+var traceConvertCmd = &cobra.Command{
+	Use:   "convert <input> <output>",
+	Short: "convert a trace to another format",
+	Long: `Convert reads a trace in any format, which is detected from its
+content, and writes it to output in the format given by --format.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := runtime.ParseTraceFormat(traceFormat)
+		if err != nil {
+			return err
+		}
+		return runtime.ConvertTrace(args[0], args[1], runtime.TraceOptions{
+			Format:   format,
+			Compress: traceCompress,
+		})
+	},
+}
+
+// traceInfoCmd represents the trace info command
+var traceInfoCmd = &cobra.Command{
+	Use:   "info <trace>",
+	Short: "show the format and header of a trace",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := runtime.OpenTrace(args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "format:   %v\n", r.Format())
+		h := r.Header()
+		if h == nil {
+			fmt.Fprintln(out, "header:   none")
+			return nil
+		}
+		fmt.Fprintf(out, "version:  %d\n", h.Version)
+		fmt.Fprintf(out, "program:  %s\n", h.Program)
+		fmt.Fprintf(out, "moriarty: %s\n", h.Moriarty)
+		fmt.Fprintf(out, "mode:     %s\n", h.Mode)
+		fmt.Fprintf(out, "seed:     %d\n", h.Seed)
+		fmt.Fprintf(out, "args:     %q\n", h.Args)
+		fmt.Fprintf(out, "recorded: %s\n", h.Time.Format(time.RFC3339))
+		if h.PCT != nil {
+			fmt.Fprintf(out, "pct:      depth %d, %d steps, change points %v\n",
+				h.PCT.Depth, h.PCT.Steps, h.PCT.ChangePoints)
+		}
+		return nil
+	},
+}
+
+var traceFormat string
+var traceCompress bool
+
+func init() {
+	rootCmd.AddCommand(traceCmd)
+	traceCmd.AddCommand(traceConvertCmd)
+	traceCmd.AddCommand(traceInfoCmd)
+
+	traceConvertCmd.Flags().StringVarP(&traceFormat, "format", "F", "binary",
+		"format of the output trace: json or binary")
+	traceConvertCmd.Flags().BoolVarP(&traceCompress, "compress", "z", false,
+		"gzip the output trace")
+}
@@ -0,0 +1,12 @@
+// Package moriarty embeds the sources of the packages instrumented code
+// imports, so that the moriarty command can compile them for the programs it
+// builds wherever it is installed.
+package moriarty
+
+import "embed"
+
+// Sources holds the goid, runtime and sync shim packages, under their
+// directories relative to the module root.
+//
+//go:embed pkg/goid/*.go pkg/runtime/*.go pkg/shim/sync/*.go
+var Sources embed.FS
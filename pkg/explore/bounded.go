@@ -0,0 +1,154 @@
+package explore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// Bound measures how far a schedule strays from the baseline schedule of
+// explore mode, which keeps running a goroutine while it is enabled and then
+// continues with the enabled goroutine with the lowest ID.
+type Bound uint8
+
+const (
+	// BoundPreemptions counts the steps at which the goroutine that ran last
+	// is still enabled but another one proceeds (Musuvathi and Qadeer, PLDI
+	// 2007).
+	BoundPreemptions Bound = iota + 1
+	// BoundDelays counts how many goroutines the baseline would have let
+	// proceed first at each step (Emmi, Qadeer and Rakamarić, POPL 2011).
+	BoundDelays
+)
+
+func (b Bound) String() string {
+	switch b {
+	case BoundPreemptions:
+		return "preemption"
+	case BoundDelays:
+		return "delay"
+	default:
+		return fmt.Sprintf("Bound(%d)", b)
+	}
+}
+
+// ParseBound parses the name of a bound, "preemption" or "delay".
+func ParseBound(s string) (Bound, error) {
+	switch s {
+	case "preemption", "preemptions":
+		return BoundPreemptions, nil
+	case "delay", "delays":
+		return BoundDelays, nil
+	}
+	return 0, fmt.Errorf("unknown bound %q, expected preemption or delay", s)
+}
+
+// cost returns how much letting goroutine id proceed at step adds to the
+// bound, after goroutine last proceeded at the step before.
+func (b Bound) cost(last uint64, step runtime.ScheduleStep, id uint64) int {
+	if id == last {
+		return 0
+	}
+	lastEnabled := slices.ContainsFunc(step.Enabled, func(g runtime.GoroutineState) bool { return g.ID == last })
+	if b == BoundPreemptions {
+		if lastEnabled {
+			return 1
+		}
+		return 0
+	}
+	// The baseline prefers the last goroutine, then lower IDs; each goroutine
+	// it prefers over id is delayed.
+	delays := 0
+	for _, g := range step.Enabled {
+		if g.ID == last || g.ID < id {
+			delays++
+		}
+	}
+	return delays
+}
+
+// alternative is a schedule still to run: the decisions of an earlier run up
+// to step, then goroutine id.
+type alternative struct {
+	chosen []uint64 // decisions of the earlier run, shared by its alternatives
+	step   int
+	id     uint64
+}
+
+func (a alternative) schedule() []uint64 {
+	return append(slices.Clone(a.chosen[:a.step]), a.id)
+}
+
+// Bounded runs the program under every schedule that strays from the
+// baseline by at most maxBound preemptions or delays, with iterative context
+// bounding: all schedules within a bound of 0 first, then those that need
+// exactly 1, and so on, so that the failing schedule found is one of the
+// simplest. Result.Bound tells the bound the exploration reached. Runs that
+// do not follow their schedule are counted, but no schedules are derived
+// from them.
+func Bounded(ctx context.Context, r Runner, bound Bound, maxBound int, opts Options) (*Result, error) {
+	res := &Result{}
+	pending := make([][]alternative, maxBound+1) // schedules by their bound
+
+	// try runs schedule, whose bound is k, and adds the schedules that
+	// differ from the run in a single later decision.
+	try := func(schedule []uint64, k int) error {
+		run, err := r.Run(ctx, schedule)
+		if err != nil {
+			return err
+		}
+		res.Schedules++
+		if opts.Progress != nil {
+			opts.Progress(res.Schedules, run)
+		}
+		if run.Failure != nil {
+			res.Failure = run
+			return nil
+		}
+		if run.Deviated() {
+			res.Deviated++
+			return nil
+		}
+		chosen := make([]uint64, len(run.Steps))
+		for i, step := range run.Steps {
+			chosen[i] = step.Chosen
+		}
+		for i := len(schedule); i < len(run.Steps); i++ {
+			var last uint64
+			if i > 0 {
+				last = chosen[i-1]
+			}
+			step := run.Steps[i]
+			for _, g := range step.Enabled {
+				if g.ID == step.Chosen {
+					continue
+				}
+				if c := k + bound.cost(last, step, g.ID); c <= maxBound {
+					pending[c] = append(pending[c], alternative{chosen, i, g.ID})
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := try(nil, 0); err != nil || res.Failure != nil {
+		return res, err
+	}
+	for k := 0; k <= maxBound; k++ {
+		res.Bound = k
+		for len(pending[k]) > 0 {
+			if opts.MaxSchedules > 0 && res.Schedules >= opts.MaxSchedules {
+				return res, nil
+			}
+			alt := pending[k][len(pending[k])-1]
+			pending[k] = pending[k][:len(pending[k])-1]
+			if err := try(alt.schedule(), k); err != nil || res.Failure != nil {
+				return res, err
+			}
+		}
+	}
+	res.Complete = true
+	return res, nil
+}
@@ -0,0 +1,99 @@
+package explore_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+func bounded(t *testing.T, m *model, bound explore.Bound, maxBound int) *explore.Result {
+	t.Helper()
+	res, err := explore.Bounded(context.Background(), m, bound, maxBound, explore.Options{})
+	if err != nil {
+		t.Fatalf("Bounded failed: %v", err)
+	}
+	return res
+}
+
+func TestBoundedDelays(t *testing.T) {
+	// Each order of three single events takes as many delays as goroutines
+	// it lets proceed out of ID order.
+	for maxBound, want := range []int{1, 3, 5, 6} {
+		m := &model{goroutines: map[uint64][]runtime.Event{
+			1: {write(0x10)},
+			2: {write(0x20)},
+			3: {write(0x30)},
+		}}
+		res := bounded(t, m, explore.BoundDelays, maxBound)
+		seen := make(map[string]bool)
+		for _, order := range m.runs {
+			seen[fmt.Sprint(order)] = true
+		}
+		if !res.Complete || res.Schedules != want || len(seen) != want {
+			t.Errorf("Expected %d distinct schedules within %d delays, got %v", want, maxBound, m.runs)
+		}
+	}
+}
+
+func TestBoundedPreemptions(t *testing.T) {
+	m := &model{goroutines: map[uint64][]runtime.Event{
+		1: {write(0x10), write(0x10)},
+		2: {write(0x20), write(0x20)},
+	}}
+	// Without preemptions, a goroutine runs until it is done, but either
+	// may start.
+	res := bounded(t, m, explore.BoundPreemptions, 0)
+	if !res.Complete || !slices.EqualFunc(m.runs, [][]uint64{{1, 1, 2, 2}, {2, 2, 1, 1}}, slices.Equal) {
+		t.Errorf("Expected the two non-preemptive schedules, got %v", m.runs)
+	}
+}
+
+func TestBoundedFindsSimplestFailure(t *testing.T) {
+	// Goroutine 1 fails unless it reads its own write back, which only a
+	// preemption between its write and read prevents.
+	newModel := func() *model {
+		return &model{
+			goroutines: map[uint64][]runtime.Event{
+				1: {write(0x10), {Kind: runtime.KindGoEnter}, read(0x10)},
+				2: {{Kind: runtime.KindGoEnter}, write(0x10)},
+			},
+			check: func(trace []runtime.Event) bool {
+				var writer uint64
+				for _, e := range trace {
+					switch {
+					case e.Kind == runtime.KindWrite:
+						writer = e.GoID
+					case e.Kind == runtime.KindRead && writer != e.GoID:
+						return false
+					}
+				}
+				return true
+			},
+		}
+	}
+	if res := bounded(t, newModel(), explore.BoundPreemptions, 0); res.Failure != nil || !res.Complete {
+		t.Errorf("Expected a complete exploration without failures, got %+v", res)
+	}
+	res := bounded(t, newModel(), explore.BoundPreemptions, 2)
+	if res.Failure == nil {
+		t.Fatal("Expected a failing schedule with a preemption")
+	}
+	if res.Bound != 1 {
+		t.Errorf("Expected the failure at bound 1, got %d", res.Bound)
+	}
+}
+
+func TestParseBound(t *testing.T) {
+	for s, want := range map[string]explore.Bound{"preemption": explore.BoundPreemptions, "delays": explore.BoundDelays} {
+		if b, err := explore.ParseBound(s); err != nil || b != want {
+			t.Errorf("ParseBound(%q) = %v, %v, expected %v", s, b, err, want)
+		}
+	}
+	if _, err := explore.ParseBound("fair"); err == nil {
+		t.Error("Expected an error for an unknown bound")
+	}
+}
@@ -0,0 +1,285 @@
+package explore
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// Options configure an exploration.
+type Options struct {
+	MaxSchedules int                 // Stop after this many runs, 0 for no limit
+	Progress     func(n int, r *Run) // Called after the n-th run if set
+}
+
+// Result summarizes an exploration.
+type Result struct {
+	Schedules int  // Number of runs
+	Deviated  int  // Runs that could not follow their schedule
+	Complete  bool // All schedules were explored
+	Bound     int  // Bound a bounded exploration reached
+	Failure   *Run // First failing run, nil if none failed
+}
+
+// state is a scheduling decision on the exploration stack.
+type state struct {
+	enabled   map[uint64]runtime.Event // stopped goroutines and their events
+	chosen    uint64
+	backtrack map[uint64]bool // goroutines to choose in some run
+	done      map[uint64]bool // goroutines chosen in some run
+}
+
+func newState(step runtime.ScheduleStep) *state {
+	s := &state{
+		enabled:   make(map[uint64]runtime.Event, len(step.Enabled)),
+		chosen:    step.Chosen,
+		backtrack: map[uint64]bool{step.Chosen: true},
+		done:      map[uint64]bool{step.Chosen: true},
+	}
+	for _, g := range step.Enabled {
+		s.enabled[g.ID] = g.Event
+	}
+	return s
+}
+
+// DPOR explores the schedules of the program run by r with dynamic
+// partial-order reduction (Flanagan and Godefroid, POPL 2005): after each
+// run, it looks for pairs of dependent events of different goroutines that
+// could have happened in the other order, and schedules a run that reverses
+// them. Runs that only reorder independent events are skipped, as they
+// cannot behave differently. The exploration stops at the first failing
+// run.
+//
+// Events are dependent if they access the same memory and one of them
+// writes, or operate on the same mutex, wait group, channel or other
+// synchronization object. A mutex is taken where the goroutine begins to
+// acquire it, so two acquisitions of a mutex race, while the events of the
+// goroutine holding it cannot be reordered with another's acquisition.
+// Select statements always take the first ready case, so their choices are
+// not explored.
+func DPOR(ctx context.Context, r Runner, opts Options) (*Result, error) {
+	res := &Result{}
+	var stack []*state
+	var schedule []uint64
+	for {
+		run, err := r.Run(ctx, schedule)
+		if err != nil {
+			return res, err
+		}
+		res.Schedules++
+		if opts.Progress != nil {
+			opts.Progress(res.Schedules, run)
+		}
+		if run.Failure != nil {
+			res.Failure = run
+			return res, nil
+		}
+
+		// The states up to the end of the schedule were explored before;
+		// the run adds the states after it, or after the step at which it
+		// left the schedule.
+		keep := min(len(schedule), len(run.Steps), len(stack))
+		if run.Deviated() {
+			res.Deviated++
+			for i := range keep {
+				if run.Steps[i].Chosen != schedule[i] {
+					keep = i
+					break
+				}
+			}
+		}
+		stack = stack[:keep]
+		for _, step := range run.Steps[keep:] {
+			stack = append(stack, newState(step))
+		}
+		addBacktracks(stack, run.Steps)
+
+		i := len(stack) - 1
+		for i >= 0 && len(pending(stack[i])) == 0 {
+			i--
+		}
+		if i < 0 {
+			res.Complete = true
+			return res, nil
+		}
+		if opts.MaxSchedules > 0 && res.Schedules >= opts.MaxSchedules {
+			return res, nil
+		}
+		stack = stack[:i+1]
+		next := pending(stack[i])[0]
+		stack[i].done[next] = true
+		stack[i].chosen = next
+		schedule = make([]uint64, i+1)
+		for j, s := range stack {
+			schedule[j] = s.chosen
+		}
+	}
+}
+
+// pending returns the goroutines to choose at s in a later run, lowest ID
+// first.
+func pending(s *state) []uint64 {
+	var ids []uint64
+	for id := range s.backtrack {
+		if !s.done[id] {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// vectorClock maps goroutine IDs to the number of their events that happen
+// before an event.
+type vectorClock map[uint64]int
+
+func (vc vectorClock) join(other vectorClock) {
+	for id, n := range other {
+		vc[id] = max(vc[id], n)
+	}
+}
+
+// addBacktracks finds the races of a run, pairs of dependent events of
+// different goroutines that may be enabled together and are not ordered by
+// happens-before, and adds the goroutine of the later event to the
+// backtrack set of the state before the earlier one, so that a later run
+// reverses them.
+func addBacktracks(stack []*state, steps []runtime.ScheduleStep) {
+	n := len(steps)
+	events := make([]runtime.Event, n)
+	clocks := make([]vectorClock, n)
+	local := make([]int, n) // index of the event among its goroutine's
+	last := make(map[uint64]int)
+	spawned := make(map[uint64]int) // index of the spawn of each goroutine
+
+	// before returns the clock of goroutine id before its next event.
+	before := func(id uint64) vectorClock {
+		vc := make(vectorClock)
+		if i, ok := last[id]; ok {
+			vc.join(clocks[i])
+		} else if i, ok := spawned[id]; ok {
+			vc.join(clocks[i])
+		}
+		return vc
+	}
+	// race handles the last event before event i that races with e, the
+	// next event of goroutine id.
+	race := func(i int, id uint64, e runtime.Event, vc vectorClock) {
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].Chosen == id || !dependent(events[j], e) || !coEnabled(events[j], e) ||
+				vc[steps[j].Chosen] >= local[j] {
+				continue
+			}
+			backtrack(stack, j, id)
+			return
+		}
+	}
+
+	counts := make(map[uint64]int)
+	for i, step := range steps {
+		id := step.Chosen
+		e := step.Event()
+		events[i] = e
+		vc := before(id)
+		race(i, id, e, vc)
+
+		counts[id]++
+		local[i] = counts[id]
+		vc[id] = local[i]
+		for j := range i {
+			if steps[j].Chosen != id && dependent(events[j], e) {
+				vc.join(clocks[j])
+			}
+		}
+		clocks[i] = vc
+		last[id] = i
+		if e.Kind == runtime.KindSpawn {
+			spawned[e.Arg] = i
+		}
+	}
+
+	// Goroutines stopped at the end of the run never performed their last
+	// event, which may race as well.
+	if n > 0 {
+		for _, g := range steps[n-1].Enabled {
+			if g.ID != steps[n-1].Chosen {
+				race(n, g.ID, g.Event, before(g.ID))
+			}
+		}
+	}
+}
+
+// backtrack makes a later run choose goroutine id at state j. If id was not
+// enabled there, e.g. because it was blocked, all enabled goroutines are
+// tried instead, as one of them may lead to a state in which id is.
+func backtrack(stack []*state, j int, id uint64) {
+	if j >= len(stack) {
+		return
+	}
+	if _, ok := stack[j].enabled[id]; ok {
+		stack[j].backtrack[id] = true
+		return
+	}
+	for other := range maps.Keys(stack[j].enabled) {
+		stack[j].backtrack[other] = true
+	}
+}
+
+// dependent reports whether the order of events a and b of different
+// goroutines may matter.
+func dependent(a, b runtime.Event) bool {
+	if a.Addr == 0 || b.Addr == 0 {
+		return false
+	}
+	switch ca, cb := class(a.Kind), class(b.Kind); {
+	case ca == memory && cb == memory:
+		return (writes(a.Kind) || writes(b.Kind)) &&
+			a.Addr < b.Addr+max(b.Size, 1) && b.Addr < a.Addr+max(a.Size, 1)
+	case ca == synchronization && cb == synchronization:
+		return a.Addr == b.Addr
+	}
+	return false
+}
+
+// coEnabled reports whether dependent events a and b of different
+// goroutines may both be enabled, and so be performed in either order. A
+// goroutine beginning to acquire an object cannot get past its acquisition
+// while another goroutine holds it, from its acquire to its release.
+func coEnabled(a, b runtime.Event) bool {
+	holds := func(k runtime.Kind) bool { return k == runtime.KindAcquire || k == runtime.KindRelease }
+	switch {
+	case a.Kind == runtime.KindBeginAcquire:
+		return !holds(b.Kind)
+	case b.Kind == runtime.KindBeginAcquire:
+		return !holds(a.Kind)
+	}
+	return true
+}
+
+type eventClass uint8
+
+const (
+	independent eventClass = iota
+	memory
+	synchronization
+)
+
+func class(k runtime.Kind) eventClass {
+	switch k {
+	case runtime.KindRead, runtime.KindWrite,
+		runtime.KindAtomicLoad, runtime.KindAtomicStore, runtime.KindAtomicRMW:
+		return memory
+	case runtime.KindBeginAcquire, runtime.KindAcquire, runtime.KindRelease,
+		runtime.KindBeginWait, runtime.KindWait, runtime.KindSignal,
+		runtime.KindChanSend, runtime.KindChanSendDone, runtime.KindChanRecv,
+		runtime.KindChanRecvDone, runtime.KindChanClose:
+		return synchronization
+	}
+	return independent
+}
+
+func writes(k runtime.Kind) bool {
+	return k == runtime.KindWrite || k == runtime.KindAtomicStore || k == runtime.KindAtomicRMW
+}
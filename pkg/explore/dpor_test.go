@@ -0,0 +1,231 @@
+package explore_test
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// model simulates a program whose goroutines perform fixed events. They
+// only block beginning to acquire a mutex another goroutine holds, until it
+// is released, as in the scheduler. A run fails if check returns false for
+// the events in the order they were performed.
+type model struct {
+	goroutines map[uint64][]runtime.Event
+	check      func(trace []runtime.Event) bool
+	runs       [][]uint64 // goroutine order of each run
+}
+
+func (m *model) Run(ctx context.Context, schedule []uint64) (*explore.Run, error) {
+	next := make(map[uint64]int)
+	held := make(map[uintptr]uint64) // holder of each mutex
+	var blocked []uint64             // goroutines waiting for a mutex, in order
+	run := &explore.Run{Schedule: schedule}
+	var last uint64
+	var order []uint64
+	for {
+		var enabled []runtime.GoroutineState
+		for id, events := range m.goroutines {
+			if next[id] < len(events) && !slices.Contains(blocked, id) {
+				e := events[next[id]]
+				e.GoID = id
+				enabled = append(enabled, runtime.GoroutineState{ID: id, Event: e})
+			}
+		}
+		if len(enabled) == 0 {
+			break
+		}
+		slices.SortFunc(enabled, func(a, b runtime.GoroutineState) int { return cmp.Compare(a.ID, b.ID) })
+		isEnabled := func(id uint64) bool {
+			return slices.ContainsFunc(enabled, func(g runtime.GoroutineState) bool { return g.ID == id })
+		}
+		// Follow the schedule, then keep running the last goroutine, as
+		// ExploreStrategy does.
+		chosen := enabled[0].ID
+		if i := len(run.Steps); i < len(schedule) && isEnabled(schedule[i]) {
+			chosen = schedule[i]
+		} else if isEnabled(last) {
+			chosen = last
+		}
+		run.Steps = append(run.Steps, runtime.ScheduleStep{Enabled: enabled, Chosen: chosen})
+		e := m.goroutines[chosen][next[chosen]]
+		switch e.Kind {
+		case runtime.KindBeginAcquire:
+			if held[e.Addr] == 0 {
+				held[e.Addr] = chosen
+			} else {
+				blocked = append(blocked, chosen)
+			}
+		case runtime.KindRelease:
+			delete(held, e.Addr)
+			// The first goroutine waiting for the mutex takes it.
+			for i, id := range blocked {
+				if m.goroutines[id][next[id]-1].Addr == e.Addr {
+					held[e.Addr] = id
+					blocked = slices.Delete(blocked, i, i+1)
+					break
+				}
+			}
+		}
+		next[chosen]++
+		last = chosen
+		order = append(order, chosen)
+	}
+	m.runs = append(m.runs, order)
+	if m.check != nil && !m.check(run.Trace()) {
+		run.Failure = &explore.Failure{Kind: explore.FailExit, Reason: "check failed"}
+	}
+	return run, nil
+}
+
+func write(addr uintptr) runtime.Event {
+	return runtime.Event{Kind: runtime.KindWrite, Addr: addr, Size: 8}
+}
+
+func read(addr uintptr) runtime.Event {
+	return runtime.Event{Kind: runtime.KindRead, Addr: addr, Size: 8}
+}
+
+func lock(addr uintptr) []runtime.Event {
+	return []runtime.Event{
+		{Kind: runtime.KindBeginAcquire, Addr: addr},
+		{Kind: runtime.KindAcquire, Addr: addr},
+	}
+}
+
+func unlock(addr uintptr) runtime.Event {
+	return runtime.Event{Kind: runtime.KindRelease, Addr: addr}
+}
+
+func explore1(t *testing.T, m *model) *explore.Result {
+	t.Helper()
+	res, err := explore.DPOR(context.Background(), m, explore.Options{})
+	if err != nil {
+		t.Fatalf("DPOR failed: %v", err)
+	}
+	return res
+}
+
+func TestDPORIndependent(t *testing.T) {
+	m := &model{goroutines: map[uint64][]runtime.Event{
+		1: {write(0x10), read(0x10)},
+		2: {write(0x20), read(0x20)},
+	}}
+	res := explore1(t, m)
+	if res.Schedules != 1 || !res.Complete {
+		t.Errorf("Expected a single schedule for independent goroutines, got %d: %v", res.Schedules, m.runs)
+	}
+}
+
+func TestDPORConflicting(t *testing.T) {
+	m := &model{goroutines: map[uint64][]runtime.Event{
+		1: {write(0x10)},
+		2: {write(0x10)},
+		3: {write(0x10)},
+	}}
+	res := explore1(t, m)
+	if !res.Complete {
+		t.Fatal("Expected a complete exploration")
+	}
+	// Every order of the writes is a distinct behavior.
+	seen := make(map[[3]uint64]bool)
+	for _, order := range m.runs {
+		seen[[3]uint64(order)] = true
+	}
+	if len(seen) != 6 || res.Schedules != 6 {
+		t.Errorf("Expected each of the 6 orders of the writes once, got %v", m.runs)
+	}
+}
+
+func TestDPORReadsCommute(t *testing.T) {
+	m := &model{goroutines: map[uint64][]runtime.Event{
+		1: {read(0x10), write(0x20)},
+		2: {read(0x10), write(0x30)},
+	}}
+	if res := explore1(t, m); res.Schedules != 1 {
+		t.Errorf("Expected reads of the same memory to commute, got %d schedules: %v", res.Schedules, m.runs)
+	}
+}
+
+func TestDPORFindsFailure(t *testing.T) {
+	// Goroutine 1 writes x and expects to read its own write back.
+	m := &model{
+		goroutines: map[uint64][]runtime.Event{
+			1: {write(0x10), {Kind: runtime.KindGoEnter}, read(0x10)},
+			2: {{Kind: runtime.KindGoEnter}, write(0x10)},
+		},
+		check: func(trace []runtime.Event) bool {
+			var writer uint64
+			for _, e := range trace {
+				switch {
+				case e.Kind == runtime.KindWrite:
+					writer = e.GoID
+				case e.Kind == runtime.KindRead && writer != e.GoID:
+					return false
+				}
+			}
+			return true
+		},
+	}
+	res := explore1(t, m)
+	if res.Failure == nil {
+		t.Fatalf("Expected a failing schedule among %v", m.runs)
+	}
+	trace := res.Failure.Trace()
+	index := func(id uint64, kind runtime.Kind) int {
+		return slices.IndexFunc(trace, func(e runtime.Event) bool { return e.GoID == id && e.Kind == kind })
+	}
+	if w := index(2, runtime.KindWrite); w < index(1, runtime.KindWrite) || w > index(1, runtime.KindRead) {
+		t.Errorf("Expected goroutine 2 to write between the write and read of goroutine 1, got %v", trace)
+	}
+}
+
+func TestDPORMaxSchedules(t *testing.T) {
+	m := &model{goroutines: map[uint64][]runtime.Event{
+		1: {write(0x10)},
+		2: {write(0x10)},
+		3: {write(0x10)},
+	}}
+	res, err := explore.DPOR(context.Background(), m, explore.Options{MaxSchedules: 2})
+	if err != nil {
+		t.Fatalf("DPOR failed: %v", err)
+	}
+	if res.Schedules != 2 || res.Complete {
+		t.Errorf("Expected the exploration to stop after 2 schedules, got %d (complete %v)", res.Schedules, res.Complete)
+	}
+}
+
+func TestDPORFindsLostUpdate(t *testing.T) {
+	// Each goroutine reads x and writes it back incremented, locking the
+	// mutex for each access but not across both.
+	const mu, x = 0x10, 0x20
+	var increment []runtime.Event
+	increment = append(increment, lock(mu)...)
+	increment = append(increment, read(x), unlock(mu))
+	increment = append(increment, lock(mu)...)
+	increment = append(increment, write(x), unlock(mu))
+	m := &model{
+		goroutines: map[uint64][]runtime.Event{1: increment, 2: increment},
+		check: func(trace []runtime.Event) bool {
+			value := 0
+			seen := make(map[uint64]int)
+			for _, e := range trace {
+				switch {
+				case e.Kind == runtime.KindRead && e.Addr == x:
+					seen[e.GoID] = value
+				case e.Kind == runtime.KindWrite && e.Addr == x:
+					value = seen[e.GoID] + 1
+				}
+			}
+			return value == 2
+		},
+	}
+	res := explore1(t, m)
+	if res.Failure == nil {
+		t.Fatalf("Expected a schedule losing an update among %v (complete %v)", m.runs, res.Complete)
+	}
+}
@@ -0,0 +1,283 @@
+package explore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// Replay is the outcome of replaying a trace once.
+type Replay struct {
+	Trace    []runtime.Event // Events as performed
+	Diverged bool            // The program left the trace; Trace holds the run it took
+	Stalled  bool            // The replay watchdog ended the program
+	Failure  *Failure        // Nil if the run passed
+	Output   []byte          // Standard error of the program
+}
+
+// Replayer replays a trace, written after header, once.
+type Replayer interface {
+	Replay(ctx context.Context, header *runtime.TraceHeader, trace []runtime.Event) (*Replay, error)
+}
+
+// Replay runs the binary in replay mode. A run that diverges from the trace
+// is recorded from there on, so that Replay.Trace holds the events it
+// performed. Set Command.Env to MORIARTY_WATCHDOG with a short timeout to
+// end replays that cannot follow their trace quickly.
+func (c *Command) Replay(ctx context.Context, header *runtime.TraceHeader, trace []runtime.Event) (*Replay, error) {
+	dir, err := os.MkdirTemp("", "moriarty-replay-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	traceFile := filepath.Join(dir, "trace")
+	divergedFile := filepath.Join(dir, "diverged")
+	if err := runtime.SaveTraceWith(traceFile, trace, runtime.TraceOptions{Header: header, Format: runtime.FormatBinary}); err != nil {
+		return nil, err
+	}
+
+	output, failure, err := c.exec(ctx,
+		"MORIARTY_MODE=replay",
+		"MORIARTY_TRACE="+traceFile,
+		"MORIARTY_ON_DIVERGENCE=record",
+		"MORIARTY_DIVERGENCE_TRACE="+divergedFile,
+	)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replay{Trace: trace, Failure: failure, Output: output}
+	r.Stalled = bytes.Contains(output, []byte("moriarty: replay made no progress"))
+	if _, err := os.Stat(divergedFile); err == nil {
+		r.Diverged = true
+		if r.Trace, err = runtime.LoadTrace(divergedFile); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Oracle decides whether a run reproduces the failure being minimized, from
+// how it failed and its standard error.
+type Oracle func(f *Failure, output []byte) bool
+
+// SameFailure returns an oracle accepting runs that fail like f, of the same
+// kind and for the same reason.
+func SameFailure(f *Failure) Oracle {
+	return func(g *Failure, output []byte) bool {
+		return g.Kind == f.Kind && g.Reason == f.Reason
+	}
+}
+
+// ErrNotReproduced is returned by Minimize if replaying the trace does not
+// fail as the oracle expects.
+var ErrNotReproduced = errors.New("the trace does not reproduce the failure")
+
+// MinimizeOptions configure a minimization.
+type MinimizeOptions struct {
+	MaxRuns  int                       // Stop after this many replays, 0 for no limit
+	Progress func(n int, switches int) // Called after the n-th replay if set
+}
+
+// Minimized is the outcome of a minimization.
+type Minimized struct {
+	Trace    []runtime.Event // Smallest reproducing trace found
+	Failure  *Failure        // Failure of its replay
+	Original int             // Context switches of the original trace
+	Switches int             // Context switches of Trace
+	Runs     int             // Number of replays
+	Complete bool            // Moving any single run of events loses the failure
+}
+
+// Switches returns the number of context switches of trace, the events that
+// belong to another goroutine than the event before them.
+func Switches(trace []runtime.Event) int {
+	n := 0
+	for i := 1; i < len(trace); i++ {
+		if trace[i].GoID != trace[i-1].GoID {
+			n++
+		}
+	}
+	return n
+}
+
+// Minimize reduces the context switches of a failing trace while replaying
+// it still fails as the oracle expects, in the manner of delta debugging: it
+// moves whole sets of a goroutine's runs of events next to the goroutine's
+// previous or next run, so that they merge, and splits the sets as long as
+// replays stop failing. The order of each goroutine's events is kept. A
+// replay that diverges from its trace is accepted if it fails and has fewer
+// context switches, as its trace is what actually ran; a replay that stalls
+// is not.
+//
+// A nil oracle accepts the failure of the first replay of trace. Minimize
+// returns ErrNotReproduced if that replay does not fail as expected.
+func Minimize(ctx context.Context, r Replayer, header *runtime.TraceHeader, trace []runtime.Event, oracle Oracle, opts MinimizeOptions) (*Minimized, error) {
+	m := &minimizer{ctx: ctx, r: r, header: header, oracle: oracle, opts: opts}
+	first, err := m.replay(trace)
+	if err != nil {
+		return nil, err
+	}
+	if first.Failure == nil || first.Stalled {
+		return nil, ErrNotReproduced
+	}
+	if m.oracle == nil {
+		m.oracle = SameFailure(first.Failure)
+	} else if !m.oracle(first.Failure, first.Output) {
+		return nil, ErrNotReproduced
+	}
+	m.best = &Minimized{Trace: first.Trace, Failure: first.Failure, Original: Switches(trace)}
+
+	for progress := true; progress; {
+		progress = false
+		for _, reversed := range []bool{false, true} {
+			improved, err := m.reduce(reversed)
+			if err != nil {
+				if errors.Is(err, errMaxRuns) {
+					return m.result(false), nil
+				}
+				return nil, err
+			}
+			progress = progress || improved
+		}
+	}
+	return m.result(true), nil
+}
+
+var errMaxRuns = errors.New("maximum number of runs reached")
+
+type minimizer struct {
+	ctx    context.Context
+	r      Replayer
+	header *runtime.TraceHeader
+	oracle Oracle
+	opts   MinimizeOptions
+	runs   int
+	best   *Minimized
+}
+
+func (m *minimizer) result(complete bool) *Minimized {
+	m.best.Switches = Switches(m.best.Trace)
+	m.best.Runs = m.runs
+	m.best.Complete = complete
+	return m.best
+}
+
+func (m *minimizer) replay(trace []runtime.Event) (*Replay, error) {
+	if m.opts.MaxRuns > 0 && m.runs >= m.opts.MaxRuns {
+		return nil, errMaxRuns
+	}
+	r, err := m.r.Replay(m.ctx, m.header, trace)
+	if err != nil {
+		return nil, err
+	}
+	m.runs++
+	if m.opts.Progress != nil {
+		m.opts.Progress(m.runs, Switches(r.Trace))
+	}
+	return r, nil
+}
+
+// try replays trace and keeps the trace that ran if it reproduces the
+// failure with fewer context switches than the best trace so far.
+func (m *minimizer) try(trace []runtime.Event) (bool, error) {
+	r, err := m.replay(trace)
+	if err != nil {
+		return false, err
+	}
+	if r.Stalled || r.Failure == nil || !m.oracle(r.Failure, r.Output) ||
+		Switches(r.Trace) >= Switches(m.best.Trace) {
+		return false, nil
+	}
+	m.best.Trace, m.best.Failure = r.Trace, r.Failure
+	return true, nil
+}
+
+// reduce moves runs of events back to the previous run of their goroutine,
+// or forward to the next one if reversed, first all at once, then in ever
+// smaller sets. It reports whether the best trace improved.
+func (m *minimizer) reduce(reversed bool) (bool, error) {
+	orient := func(trace []runtime.Event) []runtime.Event {
+		if reversed {
+			trace = slices.Clone(trace)
+			slices.Reverse(trace)
+		}
+		return trace
+	}
+
+	improved := false
+	runs := eventRuns(orient(m.best.Trace))
+	movable := movableRuns(runs)
+	for size := len(movable); size > 0 && len(movable) > 0; {
+		found := false
+		for start := 0; start < len(movable); start += size {
+			set := movable[start:min(start+size, len(movable))]
+			ok, err := m.try(orient(pullBack(runs, set)))
+			if err != nil {
+				return improved, err
+			}
+			if ok {
+				improved, found = true, true
+				runs = eventRuns(orient(m.best.Trace))
+				movable = movableRuns(runs)
+				size = min(size, len(movable))
+				break
+			}
+		}
+		if !found {
+			size /= 2
+		}
+	}
+	return improved, nil
+}
+
+// eventRuns splits trace into maximal runs of events of the same goroutine.
+func eventRuns(trace []runtime.Event) [][]runtime.Event {
+	var runs [][]runtime.Event
+	for i := 0; i < len(trace); {
+		j := i + 1
+		for j < len(trace) && trace[j].GoID == trace[i].GoID {
+			j++
+		}
+		runs = append(runs, trace[i:j])
+		i = j
+	}
+	return runs
+}
+
+// movableRuns returns the indices of the runs that follow an earlier run of
+// their goroutine.
+func movableRuns(runs [][]runtime.Event) []int {
+	seen := make(map[uint64]bool)
+	var movable []int
+	for i, run := range runs {
+		id := run[0].GoID
+		if seen[id] {
+			movable = append(movable, i)
+		}
+		seen[id] = true
+	}
+	return movable
+}
+
+// pullBack returns the events of runs with each run in set, sorted indices
+// of runs, moved right after the previous run of its goroutine.
+func pullBack(runs [][]runtime.Event, set []int) []runtime.Event {
+	var out [][]runtime.Event
+	lastOf := make(map[uint64]int) // index in out of each goroutine's last run
+	for i, run := range runs {
+		id := run[0].GoID
+		if _, moved := slices.BinarySearch(set, i); moved {
+			j := lastOf[id]
+			out[j] = append(slices.Clip(out[j]), run...)
+			continue
+		}
+		lastOf[id] = len(out)
+		out = append(out, run)
+	}
+	return slices.Concat(out...)
+}
@@ -0,0 +1,104 @@
+package explore_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// replayModel replays any trace exactly, and fails the replay if check
+// returns false for it.
+type replayModel struct {
+	check func(trace []runtime.Event) bool
+	runs  int
+}
+
+func (m *replayModel) Replay(ctx context.Context, header *runtime.TraceHeader, trace []runtime.Event) (*explore.Replay, error) {
+	m.runs++
+	r := &explore.Replay{Trace: trace}
+	if !m.check(trace) {
+		r.Failure = &explore.Failure{Kind: explore.FailExit, Reason: "exit status 2"}
+	}
+	return r, nil
+}
+
+// lostUpdate fails if goroutine 2 writes between the write and the read of
+// goroutine 1.
+func lostUpdate(trace []runtime.Event) bool {
+	var writer uint64
+	for _, e := range trace {
+		switch {
+		case e.Kind == runtime.KindWrite && e.Addr == 0x10:
+			writer = e.GoID
+		case e.Kind == runtime.KindRead && e.Addr == 0x10 && e.GoID == 1:
+			return writer == 1
+		}
+	}
+	return true
+}
+
+func on(id uint64, e runtime.Event) runtime.Event {
+	e.GoID = id
+	return e
+}
+
+func TestMinimize(t *testing.T) {
+	// Goroutines 1 and 2 race on 0x10 while goroutine 3 works on its own,
+	// with many needless switches in between.
+	trace := []runtime.Event{
+		on(3, write(0x30)), on(1, write(0x20)), on(3, write(0x30)), on(1, write(0x10)),
+		on(3, write(0x30)), on(2, write(0x20)), on(3, write(0x30)), on(2, write(0x10)),
+		on(1, write(0x20)), on(3, read(0x30)), on(1, read(0x10)), on(2, read(0x20)),
+		on(3, read(0x30)), on(1, write(0x20)), on(2, read(0x20)), on(3, read(0x30)),
+	}
+	m := &replayModel{check: lostUpdate}
+	res, err := explore.Minimize(context.Background(), m, nil, trace, nil, explore.MinimizeOptions{})
+	if err != nil {
+		t.Fatalf("Minimize failed: %v", err)
+	}
+	if res.Original != explore.Switches(trace) || res.Runs != m.runs || !res.Complete {
+		t.Errorf("Expected a complete minimization of %d switches in %d runs, got %+v",
+			explore.Switches(trace), m.runs, res)
+	}
+	// Goroutine 1 must be preempted once, and goroutine 3 adds one switch.
+	if res.Switches != 3 || explore.Switches(res.Trace) != 3 {
+		t.Errorf("Expected 3 switches, got %d: %v", res.Switches, res.Trace)
+	}
+	if lostUpdate(res.Trace) {
+		t.Errorf("Expected the minimized trace to fail: %v", res.Trace)
+	}
+	for id := range uint64(3) {
+		of := func(trace []runtime.Event) []runtime.Event {
+			return slices.DeleteFunc(slices.Clone(trace), func(e runtime.Event) bool { return e.GoID != id+1 })
+		}
+		if !slices.Equal(of(res.Trace), of(trace)) {
+			t.Errorf("Expected the events of goroutine %d in their order, got %v", id+1, res.Trace)
+		}
+	}
+}
+
+func TestMinimizeNotReproduced(t *testing.T) {
+	trace := []runtime.Event{on(1, write(0x10)), on(1, read(0x10)), on(2, write(0x10))}
+	m := &replayModel{check: lostUpdate}
+	if _, err := explore.Minimize(context.Background(), m, nil, trace, nil, explore.MinimizeOptions{}); !errors.Is(err, explore.ErrNotReproduced) {
+		t.Errorf("Expected ErrNotReproduced for a passing trace, got %v", err)
+	}
+}
+
+func TestMinimizeMaxRuns(t *testing.T) {
+	trace := []runtime.Event{
+		on(1, write(0x10)), on(3, write(0x30)), on(2, write(0x10)), on(3, write(0x30)), on(1, read(0x10)),
+	}
+	m := &replayModel{check: lostUpdate}
+	res, err := explore.Minimize(context.Background(), m, nil, trace, nil, explore.MinimizeOptions{MaxRuns: 1})
+	if err != nil {
+		t.Fatalf("Minimize failed: %v", err)
+	}
+	if res.Runs != 1 || res.Complete || !slices.Equal(res.Trace, trace) {
+		t.Errorf("Expected to stop after the first replay with the original trace, got %+v", res)
+	}
+}
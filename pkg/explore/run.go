@@ -0,0 +1,206 @@
+// Package explore drives instrumented programs through many schedules to
+// find the ones that make them fail. The program is run repeatedly in the
+// "explore" mode of package runtime, each time forced to follow a schedule
+// prefix, and the decisions it logs determine the schedules still to try.
+// Failing traces are minimized the same way, by replaying reduced ones.
+package explore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// FailureKind classifies how a run failed.
+type FailureKind uint8
+
+const (
+	FailExit    FailureKind = iota + 1 // Non-zero exit status
+	FailPanic                          // Unrecovered panic or fatal runtime error
+	FailRace                           // Data race reported by the detector
+	FailTimeout                        // Run did not end in time
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailExit:
+		return "exit"
+	case FailPanic:
+		return "panic"
+	case FailRace:
+		return "race"
+	case FailTimeout:
+		return "timeout"
+	default:
+		return fmt.Sprintf("FailureKind(%d)", k)
+	}
+}
+
+// Failure describes why a run failed.
+type Failure struct {
+	Kind   FailureKind
+	Reason string // Human-readable description, such as "exit status 2"
+}
+
+func (f *Failure) String() string {
+	return f.Reason
+}
+
+// Run is the outcome of running the program once.
+type Run struct {
+	Schedule []uint64               // Schedule the run was asked to follow
+	Header   *runtime.TraceHeader   // Header of the run's schedule log
+	Steps    []runtime.ScheduleStep // Scheduling decisions of the run
+	Failure  *Failure               // Nil if the run passed
+	Output   []byte                 // Standard error of the program
+}
+
+// Deviated reports whether the run did not follow its schedule, because a
+// goroutine the schedule names did not stop when expected.
+func (r *Run) Deviated() bool {
+	if len(r.Steps) < len(r.Schedule) {
+		return r.Failure == nil
+	}
+	for i, id := range r.Schedule {
+		if r.Steps[i].Chosen != id {
+			return true
+		}
+	}
+	return false
+}
+
+// Trace returns the events of the run in the order they were performed.
+func (r *Run) Trace() []runtime.Event {
+	trace := make([]runtime.Event, len(r.Steps))
+	for i, step := range r.Steps {
+		trace[i] = step.Event()
+	}
+	return trace
+}
+
+// SaveTrace writes the events of the run to a trace file that replays it.
+func (r *Run) SaveTrace(filename string, opts runtime.TraceOptions) error {
+	opts.Header = r.Header
+	return runtime.SaveTraceWith(filename, r.Trace(), opts)
+}
+
+// Runner runs the program once, following schedule.
+type Runner interface {
+	Run(ctx context.Context, schedule []uint64) (*Run, error)
+}
+
+// Command runs an instrumented binary as a Runner.
+type Command struct {
+	Path    string
+	Args    []string
+	Env     []string      // Added to the environment of the program
+	Timeout time.Duration // Limit of a single run, 0 for none
+	Stdout  io.Writer     // Standard output of the program, discarded if nil
+	Stderr  io.Writer     // Standard error of the program besides Run.Output
+}
+
+// Run runs the binary in explore mode and reads the schedule log it wrote.
+func (c *Command) Run(ctx context.Context, schedule []uint64) (*Run, error) {
+	dir, err := os.MkdirTemp("", "moriarty-explore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	scheduleFile := filepath.Join(dir, "schedule")
+	logFile := filepath.Join(dir, "log")
+	if err := runtime.SaveSchedule(scheduleFile, schedule); err != nil {
+		return nil, err
+	}
+
+	output, failure, err := c.exec(ctx,
+		"MORIARTY_MODE=explore",
+		"MORIARTY_SCHEDULE="+scheduleFile,
+		"MORIARTY_SCHEDULE_LOG="+logFile,
+	)
+	if err != nil {
+		return nil, err
+	}
+	run := &Run{Schedule: schedule, Failure: failure, Output: output}
+	run.Header, run.Steps, err = runtime.ReadScheduleLog(logFile)
+	if err != nil {
+		if run.Failure == nil {
+			return nil, fmt.Errorf("%s did not log its schedule, is it instrumented? %w", c.Path, err)
+		}
+		// The program failed before the runtime was initialized.
+		run.Header, run.Steps = nil, nil
+	}
+	return run, nil
+}
+
+// exec runs the binary with env added to its environment, and returns its
+// standard error and how it failed, if it did.
+func (c *Command) exec(ctx context.Context, env ...string) ([]byte, *Failure, error) {
+	runCtx := ctx
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(runCtx, c.Path, c.Args...)
+	// Let the runtime finalize, so that the program's trace is complete up
+	// to the timeout, before the program is killed.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Env = append(cmd.Env, env...)
+	var stderr bytes.Buffer
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = &stderr
+	if c.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, c.Stderr)
+	}
+	runErr := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		return nil, nil, runErr
+	}
+	return stderr.Bytes(), classify(runErr, runCtx.Err() != nil, c.Timeout, stderr.Bytes()), nil
+}
+
+// classify returns the failure of a run from the error it ended with and
+// its standard error, or nil if it passed.
+func classify(err error, timedOut bool, timeout time.Duration, stderr []byte) *Failure {
+	switch {
+	case timedOut:
+		return &Failure{Kind: FailTimeout, Reason: fmt.Sprintf("timed out after %v", timeout)}
+	case bytes.Contains(stderr, []byte("WARNING: DATA RACE")):
+		return &Failure{Kind: FailRace, Reason: "data race"}
+	}
+	if line := panicLine(stderr); line != "" {
+		return &Failure{Kind: FailPanic, Reason: line}
+	}
+	if err != nil {
+		return &Failure{Kind: FailExit, Reason: err.Error()}
+	}
+	return nil
+}
+
+// panicLine returns the line starting the report of a panic or fatal error
+// in stderr, or "" if there is none.
+func panicLine(stderr []byte) string {
+	for _, line := range bytes.Split(stderr, []byte("\n")) {
+		for _, prefix := range []string{"panic: ", "fatal error: "} {
+			if bytes.HasPrefix(line, []byte(prefix)) {
+				return string(line)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,219 @@
+package explore
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sample is the outcome of running the program once under a randomized
+// mode with a seed.
+type Sample struct {
+	Index   int    // Position of the run in the sweep
+	Mode    string // MORIARTY_MODE of the run
+	Seed    int64
+	Trace   string   // Trace the run was recorded to
+	Failure *Failure // Nil if the run passed
+	Output  []byte   // Standard error of the program
+}
+
+// Sampler runs the program once in mode with seed, recording the run to
+// traceFile.
+type Sampler interface {
+	Sample(ctx context.Context, mode string, seed int64, traceFile string) (*Sample, error)
+}
+
+// Sample runs the binary in mode with seed and records its schedule to
+// traceFile.
+func (c *Command) Sample(ctx context.Context, mode string, seed int64, traceFile string) (*Sample, error) {
+	output, failure, err := c.exec(ctx,
+		"MORIARTY_MODE="+mode,
+		"MORIARTY_SEED="+strconv.FormatInt(seed, 10),
+		"MORIARTY_RECORD="+traceFile,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Sample{Mode: mode, Seed: seed, Trace: traceFile, Failure: failure, Output: output}, nil
+}
+
+// SweepOptions configure a sweep.
+type SweepOptions struct {
+	Modes     []string      // Modes the runs cycle through
+	FirstSeed int64         // Seed of the first run of each mode
+	Runs      int           // Number of runs, 0 to run until the context ends
+	Jobs      int           // Runs at a time, 1 if not positive
+	Dir       string        // Directory the traces of failing runs are kept in
+	Progress  func(*Sample) // Called after each run if set, never concurrently
+}
+
+// FailureGroup collects the failing runs of a sweep with the same signature.
+type FailureGroup struct {
+	Signature string
+	Count     int
+	First     *Sample // Failing run with the lowest index, whose trace is kept
+}
+
+// SweepResult summarizes a sweep.
+type SweepResult struct {
+	Runs     int             // Completed runs
+	Failures int             // Failing runs
+	Groups   []*FailureGroup // Distinct failures, by the index of their first run
+	Complete bool            // All requested runs completed
+}
+
+// Sweep runs the program under opts.Modes with one seed after another,
+// opts.Jobs runs at a time, until opts.Runs runs completed or ctx ends. Run
+// i uses mode opts.Modes[i%len(opts.Modes)] with seed opts.FirstSeed +
+// i/len(opts.Modes), so that every seed is tried in each mode. Failing runs
+// are grouped by their Signature, and the trace of the first run of each
+// group is kept in opts.Dir, named after its mode and seed; the traces of
+// other runs are removed. The groups do not depend on opts.Jobs.
+//
+// Runs cut short by the end of ctx are not counted, and Sweep returns what
+// the completed runs found.
+func Sweep(ctx context.Context, s Sampler, opts SweepOptions) (*SweepResult, error) {
+	if len(opts.Modes) == 0 {
+		return nil, fmt.Errorf("no modes to sweep")
+	}
+	res := &SweepResult{}
+	groups := make(map[string]*FailureGroup)
+	var (
+		mu       sync.Mutex
+		next     int
+		firstErr error
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	worker := func() {
+		for {
+			mu.Lock()
+			i := next
+			if ctx.Err() != nil || (opts.Runs > 0 && i >= opts.Runs) {
+				mu.Unlock()
+				return
+			}
+			next++
+			mu.Unlock()
+
+			mode := opts.Modes[i%len(opts.Modes)]
+			seed := opts.FirstSeed + int64(i/len(opts.Modes))
+			traceFile := filepath.Join(opts.Dir, fmt.Sprintf("%s-%d.trace", mode, seed))
+			sample, err := s.Sample(ctx, mode, seed, traceFile)
+
+			mu.Lock()
+			if err != nil {
+				os.Remove(traceFile)
+				if ctx.Err() == nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+				return
+			}
+			sample.Index = i
+			res.Runs++
+			keep := false
+			if sample.Failure != nil {
+				res.Failures++
+				sig := Signature(sample.Failure, sample.Output)
+				g := groups[sig]
+				if g == nil {
+					g = &FailureGroup{Signature: sig}
+					groups[sig] = g
+				}
+				g.Count++
+				if g.First == nil || i < g.First.Index {
+					if g.First != nil {
+						os.Remove(g.First.Trace)
+					}
+					g.First, keep = sample, true
+				}
+			}
+			if !keep {
+				os.Remove(traceFile)
+			}
+			if opts.Progress != nil {
+				opts.Progress(sample)
+			}
+			mu.Unlock()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range max(opts.Jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return res, firstErr
+	}
+
+	for _, g := range groups {
+		res.Groups = append(res.Groups, g)
+	}
+	slices.SortFunc(res.Groups, func(a, b *FailureGroup) int { return cmp.Compare(a.First.Index, b.First.Index) })
+	res.Complete = opts.Runs > 0 && res.Runs == opts.Runs
+	return res, nil
+}
+
+var (
+	// raceAccess matches the line introducing an access in a race report.
+	raceAccess = regexp.MustCompile(`^(Previous )?[A-Za-z ]+ at 0x[0-9a-f]+ by goroutine \d+:$`)
+	// location matches a source location line of a stack.
+	location  = regexp.MustCompile(`^\s+(\S+:\d+)`)
+	hexNumber = regexp.MustCompile(`0x[0-9a-f]+`)
+)
+
+// Signature identifies the cause of a failure, so that failing runs with the
+// same cause can be told from others: the source locations of the accesses
+// of the first data race reported, the message of a panic without
+// addresses, or the exit status.
+func Signature(f *Failure, output []byte) string {
+	switch f.Kind {
+	case FailRace:
+		if race := firstRace(output); race != "" {
+			return "data race: " + race
+		}
+	case FailPanic:
+		return hexNumber.ReplaceAllString(f.Reason, "0x?")
+	case FailTimeout:
+		return "timeout"
+	}
+	return f.Reason
+}
+
+// firstRace returns the source locations of the accesses of the first race
+// reported in output, in order, or "" if there is none.
+func firstRace(output []byte) string {
+	var locs []string
+	inAccess := false
+	for _, line := range strings.Split(string(output), "\n") {
+		switch {
+		case raceAccess.MatchString(line):
+			inAccess = true
+		case inAccess:
+			if m := location.FindStringSubmatch(line); m != nil {
+				locs = append(locs, m[1])
+				inAccess = false
+				if len(locs) == 2 {
+					slices.Sort(locs)
+					return locs[0] + ", " + locs[1]
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package explore_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/explore"
+)
+
+// seedModel fails in "pct" mode for seeds divisible by 3 and with a panic
+// in "online" mode for seed 4. Every run writes its trace file.
+type seedModel struct{}
+
+func (seedModel) Sample(ctx context.Context, mode string, seed int64, traceFile string) (*explore.Sample, error) {
+	if err := os.WriteFile(traceFile, []byte(mode), 0644); err != nil {
+		return nil, err
+	}
+	s := &explore.Sample{Mode: mode, Seed: seed, Trace: traceFile}
+	switch {
+	case mode == "pct" && seed%3 == 0:
+		s.Failure = &explore.Failure{Kind: explore.FailExit, Reason: "exit status 2"}
+	case mode == "online" && seed == 4:
+		s.Failure = &explore.Failure{Kind: explore.FailPanic, Reason: "panic: bad pointer 0xc000012345"}
+	}
+	return s, nil
+}
+
+func TestSweep(t *testing.T) {
+	for _, jobs := range []int{1, 4} {
+		dir := t.TempDir()
+		res, err := explore.Sweep(context.Background(), seedModel{}, explore.SweepOptions{
+			Modes: []string{"online", "pct"}, FirstSeed: 1, Runs: 20, Jobs: jobs, Dir: dir,
+		})
+		if err != nil {
+			t.Fatalf("Sweep failed: %v", err)
+		}
+		// Seeds 1 to 10 in both modes: pct fails for 3, 6 and 9, online for 4.
+		if res.Runs != 20 || res.Failures != 4 || !res.Complete {
+			t.Errorf("-j %d: expected 20 complete runs with 4 failures, got %+v", jobs, res)
+		}
+		if len(res.Groups) != 2 {
+			t.Fatalf("-j %d: expected 2 distinct failures, got %d", jobs, len(res.Groups))
+		}
+		exit, crash := res.Groups[0], res.Groups[1]
+		if exit.Signature != "exit status 2" || exit.Count != 3 || exit.First.Seed != 3 || exit.First.Mode != "pct" {
+			t.Errorf("-j %d: expected 3 exits first seen with pct seed 3, got %+v", jobs, exit)
+		}
+		if crash.Signature != "panic: bad pointer 0x?" || crash.Count != 1 || crash.First.Seed != 4 {
+			t.Errorf("-j %d: expected a panic with online seed 4, got %+v", jobs, crash)
+		}
+		kept, _ := filepath.Glob(filepath.Join(dir, "*"))
+		want := []string{filepath.Join(dir, "online-4.trace"), filepath.Join(dir, "pct-3.trace")}
+		if len(kept) != 2 || kept[0] != want[0] || kept[1] != want[1] {
+			t.Errorf("-j %d: expected only the traces %v to be kept, got %v", jobs, want, kept)
+		}
+	}
+}
+
+func TestSweepUntilCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	res, err := explore.Sweep(ctx, seedModel{}, explore.SweepOptions{
+		Modes: []string{"online"}, Dir: t.TempDir(),
+		Progress: func(*explore.Sample) {
+			if n++; n == 5 {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if res.Runs != 5 || res.Complete {
+		t.Errorf("Expected 5 runs until the sweep was canceled, got %+v", res)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	output := []byte(`==================
+WARNING: DATA RACE
+Write at 0x762200 by goroutine 3:
+  main.main()
+      /src/main.go:18
+
+Previous read at 0x762200 by goroutine 2:
+  main.main()
+      /src/main.go:17
+
+Goroutine 3 (running) created at:
+  main.main()
+      /src/main.go:15
+==================
+==================
+WARNING: DATA RACE
+Read at 0x762200 by goroutine 2:
+  main.main()
+      /src/main.go:17
+
+Previous write at 0x762200 by goroutine 3:
+  main.main()
+      /src/main.go:18
+==================
+`)
+	race := &explore.Failure{Kind: explore.FailRace, Reason: "data race"}
+	if sig := explore.Signature(race, output); sig != "data race: /src/main.go:17, /src/main.go:18" {
+		t.Errorf("Expected the locations of the race, got %q", sig)
+	}
+	exit := &explore.Failure{Kind: explore.FailExit, Reason: "exit status 1"}
+	if sig := explore.Signature(exit, nil); sig != "exit status 1" {
+		t.Errorf("Expected the exit status, got %q", sig)
+	}
+}
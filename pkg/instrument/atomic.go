@@ -0,0 +1,269 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// collectAtomic handles a call to a sync/atomic function or to a method of
+// one of the sync/atomic types. Instead of reading the variable the call
+// operates on, which would be reported as a plain access, it emits the
+// atomic hook matching the operation:
+//
+//	atomic.AddInt64(&n, 1)  →  runtime.AtomicRMW(unsafe.Pointer(&n), 8, site)
+//	s.count.Load()          →  runtime.AtomicLoad(unsafe.Pointer(&s.count), 8, site)
+//
+// Loads and read-modify-writes are remembered for wrapAtomicResults. Reads
+// of the other operands are still collected. The address is evaluated again
+// by the hook and by AtomicDone, so an operation on an address with side
+// effects, such as atomic.AddInt64(next(), 1), gets no hook. It reports
+// whether call was an atomic operation.
+func (instr *Instrumenter) collectAtomic(call *ast.CallExpr, stmts *[]ast.Stmt) bool {
+	if instr.typeInfo == nil {
+		return false
+	}
+	fun, ok := astutil.Unparen(call.Fun).(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	obj, ok := instr.typeInfo.Uses[fun.Sel].(*types.Func)
+	if !ok || obj.Pkg() == nil || obj.Pkg().Path() != "sync/atomic" {
+		return false
+	}
+	hook, kind := instr.atomicHook(obj.Name())
+	if hook == "" {
+		return false
+	}
+
+	var addr ast.Expr
+	var elem types.Type
+	args := call.Args
+	if obj.Signature().Recv() != nil {
+		sel, ok := instr.typeInfo.Selections[fun]
+		if !ok || sel.Kind() != types.MethodVal {
+			return false
+		}
+		var recv ast.Expr
+		recv, elem = instr.atomicReceiver(fun.X, sel)
+		if p, isPtr := elem.Underlying().(*types.Pointer); isPtr {
+			instr.collectReads(recv, stmts)
+			addr, elem = recv, p.Elem()
+		} else {
+			instr.collectAddrReads(recv, stmts)
+			addr = &ast.UnaryExpr{Op: token.AND, X: recv}
+		}
+	} else {
+		if len(args) == 0 {
+			return false
+		}
+		p, isPtr := instr.typeInfo.TypeOf(args[0]).Underlying().(*types.Pointer)
+		if !isPtr {
+			return false
+		}
+		instr.collectReads(args[0], stmts)
+		addr, elem, args = args[0], p.Elem(), args[1:]
+	}
+
+	for _, arg := range args {
+		instr.collectReads(arg, stmts)
+	}
+	if !isPureAddr(addr) {
+		return true
+	}
+	if kind != "KindAtomicStore" {
+		instr.atomics[call] = cloneExpr(addr)
+	}
+	*stmts = append(*stmts, &ast.ExprStmt{X: instr.makeAccessCall(hook, cloneExpr(addr),
+		instr.sizeOfElem(elem, cloneExpr(addr)), instr.makeSite(call, types.ExprString(addr), kind))})
+	return true
+}
+
+// wrapAtomicResults passes the result of every atomic load and
+// read-modify-write through the runtime, so that the runtime learns when the
+// operation was performed:
+//
+//	atomic.LoadInt32(&flag)  →  runtime.AtomicDone(atomic.LoadInt32(&flag), unsafe.Pointer(&flag), site)
+//
+// The hooks emitted by collectAtomic run before the statement and order the
+// goroutine's earlier accesses before a store; AtomicDone orders the stores
+// the operation may have observed before the goroutine's later accesses.
+// Deferred calls and calls in go statements are left unchanged, as their
+// result is discarded anyway.
+func (instr *Instrumenter) wrapAtomicResults(f *ast.File) {
+	if instr.config.AtomicDoneFunc == "" || len(instr.atomics) == 0 {
+		return
+	}
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		call, ok := c.Node().(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		addr, ok := instr.atomics[call]
+		if !ok {
+			return true
+		}
+		switch c.Parent().(type) {
+		case *ast.DeferStmt, *ast.GoStmt:
+			return true
+		}
+		instr.usesUnsafe = true
+		c.Replace(&ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{Name: instr.config.RuntimeAlias},
+				Sel: &ast.Ident{Name: instr.config.AtomicDoneFunc},
+			},
+			Args: []ast.Expr{
+				call,
+				&ast.CallExpr{
+					Fun: &ast.SelectorExpr{
+						X:   &ast.Ident{Name: "unsafe"},
+						Sel: &ast.Ident{Name: "Pointer"},
+					},
+					Args: []ast.Expr{addr},
+				},
+				instr.makeSite(call, types.ExprString(addr), "KindAtomicDone"),
+			},
+		})
+		return true
+	})
+}
+
+// atomicHook returns the hook and site kind for the sync/atomic operation
+// name, or an empty hook if the operation is not instrumented
+func (instr *Instrumenter) atomicHook(name string) (hook, kind string) {
+	switch {
+	case strings.HasPrefix(name, "Load"):
+		return instr.config.AtomicLoadFunc, "KindAtomicLoad"
+	case strings.HasPrefix(name, "Store"):
+		return instr.config.AtomicStoreFunc, "KindAtomicStore"
+	case strings.HasPrefix(name, "Add"), strings.HasPrefix(name, "Swap"),
+		strings.HasPrefix(name, "CompareAndSwap"), strings.HasPrefix(name, "And"),
+		strings.HasPrefix(name, "Or"):
+		return instr.config.AtomicRMWFunc, "KindAtomicRMW"
+	}
+	return "", ""
+}
+
+// atomicReceiver returns the expression and type of the receiver of a method
+// call, following the fields a promoted method was selected through
+func (instr *Instrumenter) atomicReceiver(x ast.Expr, sel *types.Selection) (ast.Expr, types.Type) {
+	recv, t := x, instr.typeInfo.TypeOf(x)
+	path := sel.Index()
+	for _, i := range path[:len(path)-1] {
+		if p, ok := t.Underlying().(*types.Pointer); ok {
+			t = p.Elem()
+		}
+		field := t.Underlying().(*types.Struct).Field(i)
+		recv = &ast.SelectorExpr{X: recv, Sel: &ast.Ident{Name: field.Name()}}
+		t = field.Type()
+	}
+	return recv, t
+}
+
+// collectAddrReads collects the reads needed to take the address of expr,
+// e.g. the pointer dereferenced by p.f, but not expr itself
+func (instr *Instrumenter) collectAddrReads(expr ast.Expr, stmts *[]ast.Stmt) {
+	switch e := astutil.Unparen(expr).(type) {
+	case *ast.SelectorExpr:
+		if _, isPkg := instr.typeInfo.Uses[identOf(e.X)].(*types.PkgName); isPkg {
+			return
+		}
+		if isPointer(instr.typeInfo.TypeOf(e.X)) {
+			instr.collectReads(e.X, stmts)
+		} else {
+			instr.collectAddrReads(e.X, stmts)
+		}
+	case *ast.IndexExpr:
+		if t := instr.typeInfo.TypeOf(e.X); t != nil && isSlice(t) {
+			instr.collectReads(e.X, stmts)
+		} else {
+			instr.collectAddrReads(e.X, stmts)
+		}
+		instr.collectReads(e.Index, stmts)
+	case *ast.StarExpr:
+		instr.collectReads(e.X, stmts)
+	}
+}
+
+// sizeOfElem returns the size of the variable of type t that ptr points to
+func (instr *Instrumenter) sizeOfElem(t types.Type, ptr ast.Expr) ast.Expr {
+	if size, ok := instr.constSize(t); ok {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(size, 10)}
+	}
+	return &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{Name: "unsafe"},
+			Sel: &ast.Ident{Name: "Sizeof"},
+		},
+		Args: []ast.Expr{&ast.StarExpr{X: ptr}},
+	}
+}
+
+func isPointer(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	_, ok := t.Underlying().(*types.Pointer)
+	return ok
+}
+
+func isSlice(t types.Type) bool {
+	_, ok := t.Underlying().(*types.Slice)
+	return ok
+}
+
+// isPureAddr reports whether the address expr can be evaluated again without
+// side effects
+func isPureAddr(expr ast.Expr) bool {
+	if u, ok := astutil.Unparen(expr).(*ast.UnaryExpr); ok && u.Op == token.AND {
+		return isPure(u.X)
+	}
+	return isPure(expr)
+}
+
+// cloneExpr returns a copy of expr, which must be a pure address, so that
+// the copy can be placed in the tree next to the original
+func cloneExpr(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return &ast.Ident{Name: e.Name}
+	case *ast.BasicLit:
+		return &ast.BasicLit{Kind: e.Kind, Value: e.Value}
+	case *ast.ParenExpr:
+		return &ast.ParenExpr{X: cloneExpr(e.X)}
+	case *ast.SelectorExpr:
+		return &ast.SelectorExpr{X: cloneExpr(e.X), Sel: &ast.Ident{Name: e.Sel.Name}}
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: cloneExpr(e.X)}
+	case *ast.UnaryExpr:
+		return &ast.UnaryExpr{Op: e.Op, X: cloneExpr(e.X)}
+	case *ast.IndexExpr:
+		return &ast.IndexExpr{X: cloneExpr(e.X), Index: cloneExpr(e.Index)}
+	case *ast.SliceExpr:
+		c := &ast.SliceExpr{X: cloneExpr(e.X), Slice3: e.Slice3}
+		if e.Low != nil {
+			c.Low = cloneExpr(e.Low)
+		}
+		if e.High != nil {
+			c.High = cloneExpr(e.High)
+		}
+		if e.Max != nil {
+			c.Max = cloneExpr(e.Max)
+		}
+		return c
+	case *ast.BinaryExpr:
+		return &ast.BinaryExpr{X: cloneExpr(e.X), Op: e.Op, Y: cloneExpr(e.Y)}
+	}
+	return expr
+}
+
+// identOf returns expr if it is an identifier, nil otherwise
+func identOf(expr ast.Expr) *ast.Ident {
+	ident, _ := expr.(*ast.Ident)
+	return ident
+}
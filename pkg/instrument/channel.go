@@ -0,0 +1,286 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// lowerChannelOps replaces sends, receives, close calls and ranges over
+// channels with calls to the runtime's channel hooks:
+//
+//	ch <- v            →  runtime.ChanSend(ch, site).Send(v)
+//	<-ch               →  runtime.ChanRecv(ch, site)
+//	v, ok := <-ch      →  v, ok := runtime.ChanRecv2(ch, site)
+//	close(ch)          →  runtime.ChanClose(ch, site)
+//	for v := range ch  →  for c := ch; ; { v, ok := runtime.ChanRecv2(c, site); if !ok { break }; {...} }
+//
+// Select statements are lowered by lowerSelect.
+func (instr *Instrumenter) lowerChannelOps(f *ast.File) {
+	comms, commaOk := collectChanForms(f)
+
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.SendStmt:
+			if !comms[n] && instr.config.ChanSendFunc != "" {
+				c.Replace(&ast.ExprStmt{X: instr.makeChanSendCall(n)})
+			}
+		case *ast.UnaryExpr:
+			if n.Op != token.ARROW || comms[n] {
+				break
+			}
+			fn := instr.config.ChanRecvFunc
+			if commaOk[n] {
+				fn = instr.config.ChanRecv2Func
+			}
+			if fn != "" {
+				c.Replace(instr.makeChanCall(fn, n.X, instr.makeSite(n, types.ExprString(n.X), "KindChanRecv")))
+			}
+		case *ast.CallExpr:
+			if instr.config.ChanCloseFunc != "" && len(n.Args) == 1 && instr.isBuiltinCall(n, "close") {
+				c.Replace(instr.makeChanCall(instr.config.ChanCloseFunc, n.Args[0],
+					instr.makeSite(n, types.ExprString(n.Args[0]), "KindChanClose")))
+			}
+		case *ast.RangeStmt:
+			if instr.config.ChanRecv2Func != "" && instr.isChan(n.X) {
+				c.Replace(instr.lowerChanRange(n))
+			}
+		case *ast.SelectStmt:
+			if instr.config.SelectFunc != "" && instr.config.ChanRecvCaseFunc != "" &&
+				instr.config.ChanSendFunc != "" && len(n.Body.List) > 0 {
+				c.Replace(instr.lowerSelect(n))
+			}
+		}
+		return true
+	})
+}
+
+// collectChanForms finds the channel operations that need special treatment:
+// comms are the sends and receives of select cases, and commaOk are the
+// receives in v, ok := <-ch form.
+func collectChanForms(f *ast.File) (comms, commaOk map[ast.Node]bool) {
+	comms = make(map[ast.Node]bool)
+	commaOk = make(map[ast.Node]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CommClause:
+			switch comm := n.Comm.(type) {
+			case *ast.SendStmt:
+				comms[comm] = true
+			case *ast.ExprStmt:
+				comms[astutil.Unparen(comm.X)] = true
+			case *ast.AssignStmt:
+				comms[astutil.Unparen(comm.Rhs[0])] = true
+			}
+		case *ast.AssignStmt:
+			if len(n.Lhs) == 2 && len(n.Rhs) == 1 {
+				commaOk[astutil.Unparen(n.Rhs[0])] = true
+			}
+		case *ast.ValueSpec:
+			if len(n.Names) == 2 && len(n.Values) == 1 {
+				commaOk[astutil.Unparen(n.Values[0])] = true
+			}
+		}
+		return true
+	})
+	return comms, commaOk
+}
+
+// makeChanCall creates runtime.fn(ch, site)
+func (instr *Instrumenter) makeChanCall(fn string, ch, site ast.Expr) *ast.CallExpr {
+	instr.instrumented = true
+	return &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{Name: instr.config.RuntimeAlias},
+			Sel: &ast.Ident{Name: fn},
+		},
+		Args: []ast.Expr{ch, site},
+	}
+}
+
+// makeChanSendCall creates runtime.ChanSend(ch, site).Send(v). The value is
+// passed separately so that it is assigned to the element type rather than
+// used to infer it.
+func (instr *Instrumenter) makeChanSendCall(stmt *ast.SendStmt) *ast.CallExpr {
+	site := instr.makeSite(stmt, types.ExprString(stmt.Chan), "KindChanSend")
+	return &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   instr.makeChanCall(instr.config.ChanSendFunc, stmt.Chan, site),
+			Sel: &ast.Ident{Name: "Send"},
+		},
+		Args: []ast.Expr{stmt.Value},
+	}
+}
+
+// lowerChanRange turns a range over a channel into a loop of receives.
+// The channel is evaluated once, and the original body gets its own block
+// so that it may still redeclare the iteration variable.
+func (instr *Instrumenter) lowerChanRange(stmt *ast.RangeStmt) *ast.ForStmt {
+	ch := &ast.Ident{Name: "__moriarty_ch"}
+	ok := &ast.Ident{Name: "__moriarty_ok"}
+	recv := instr.makeChanCall(instr.config.ChanRecv2Func, ch,
+		instr.makeSite(stmt, types.ExprString(stmt.X), "KindChanRecv"))
+
+	var body []ast.Stmt
+	switch {
+	case stmt.Key == nil || stmt.Tok == token.DEFINE:
+		key := stmt.Key
+		if key == nil {
+			key = &ast.Ident{Name: "_"}
+		}
+		body = append(body, &ast.AssignStmt{Lhs: []ast.Expr{key, ok}, Tok: token.DEFINE, Rhs: []ast.Expr{recv}})
+	default:
+		v := &ast.Ident{Name: "__moriarty_v"}
+		body = append(body, &ast.AssignStmt{Lhs: []ast.Expr{v, ok}, Tok: token.DEFINE, Rhs: []ast.Expr{recv}})
+	}
+	body = append(body, &ast.IfStmt{
+		Cond: &ast.UnaryExpr{Op: token.NOT, X: ok},
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.BranchStmt{Tok: token.BREAK}}},
+	})
+	if stmt.Key != nil && stmt.Tok == token.ASSIGN {
+		if !isBlankIdent(stmt.Key) {
+			instr.collectWrites(stmt.Key, &body)
+		}
+		body = append(body, &ast.AssignStmt{
+			Lhs: []ast.Expr{stmt.Key},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.Ident{Name: "__moriarty_v"}},
+		})
+	}
+	body = append(body, stmt.Body)
+
+	return &ast.ForStmt{
+		For:  stmt.For,
+		Init: &ast.AssignStmt{Lhs: []ast.Expr{ch}, Tok: token.DEFINE, Rhs: []ast.Expr{stmt.X}},
+		Body: &ast.BlockStmt{List: body},
+	}
+}
+
+// lowerSelect turns a select statement into a switch on the case chosen by
+// the runtime. The clauses are built in the switch's init statement, which
+// evaluates channels and sent values once and in source order, as select
+// does:
+//
+//	select {                         switch c0, c1 := runtime.ChanRecvCase(ch1, site), runtime.ChanSend(ch2, site).Case(x); runtime.Select(site, true, c0, c1) {
+//	case v := <-ch1:                 case 0:
+//		...                              v := c0.Value; ...
+//	case ch2 <- x:             →     case 1:
+//		...                              ...
+//	default:                         default:
+//		...                              ...
+//	}                                }
+//
+// A break in a clause still leaves the statement, and a label on the select
+// statement now labels the switch.
+func (instr *Instrumenter) lowerSelect(stmt *ast.SelectStmt) *ast.SwitchStmt {
+	instr.instrumented = true
+	init := &ast.AssignStmt{Tok: token.DEFINE}
+	var clauses []ast.Stmt
+	hasDefault := false
+
+	for _, s := range stmt.Body.List {
+		cc := s.(*ast.CommClause)
+		if cc.Comm == nil {
+			hasDefault = true
+			clauses = append(clauses, &ast.CaseClause{Case: cc.Case, Colon: cc.Colon, Body: cc.Body})
+			continue
+		}
+
+		i := len(init.Lhs)
+		name := &ast.Ident{Name: fmt.Sprintf("__moriarty_c%d", i)}
+		var body []ast.Stmt
+
+		switch comm := cc.Comm.(type) {
+		case *ast.SendStmt:
+			init.Rhs = append(init.Rhs, &ast.CallExpr{
+				Fun: &ast.SelectorExpr{
+					X: instr.makeChanCall(instr.config.ChanSendFunc, comm.Chan,
+						instr.makeSite(comm, types.ExprString(comm.Chan), "KindChanSend")),
+					Sel: &ast.Ident{Name: "Case"},
+				},
+				Args: []ast.Expr{comm.Value},
+			})
+		case *ast.ExprStmt:
+			init.Rhs = append(init.Rhs, instr.makeRecvCase(astutil.Unparen(comm.X).(*ast.UnaryExpr)))
+		case *ast.AssignStmt:
+			init.Rhs = append(init.Rhs, instr.makeRecvCase(astutil.Unparen(comm.Rhs[0]).(*ast.UnaryExpr)))
+			results := []ast.Expr{
+				&ast.SelectorExpr{X: name, Sel: &ast.Ident{Name: "Value"}},
+				&ast.SelectorExpr{X: name, Sel: &ast.Ident{Name: "OK"}},
+			}
+			if comm.Tok == token.ASSIGN {
+				for _, lhs := range comm.Lhs {
+					if !isBlankIdent(lhs) {
+						instr.collectWrites(lhs, &body)
+					}
+				}
+			}
+			body = append(body, &ast.AssignStmt{Lhs: comm.Lhs, Tok: comm.Tok, Rhs: results[:len(comm.Lhs)]})
+		}
+		init.Lhs = append(init.Lhs, name)
+
+		clauses = append(clauses, &ast.CaseClause{
+			Case:  cc.Case,
+			List:  []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(i)}},
+			Colon: cc.Colon,
+			Body:  append(body, cc.Body...),
+		})
+	}
+
+	args := []ast.Expr{
+		instr.makeSite(stmt, "select", "KindSelect"),
+		&ast.Ident{Name: strconv.FormatBool(hasDefault)},
+	}
+	sw := &ast.SwitchStmt{
+		Switch: stmt.Select,
+		Tag: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{Name: instr.config.RuntimeAlias},
+				Sel: &ast.Ident{Name: instr.config.SelectFunc},
+			},
+			Args: append(args, init.Lhs...),
+		},
+		Body: &ast.BlockStmt{Lbrace: stmt.Body.Lbrace, List: clauses, Rbrace: stmt.Body.Rbrace},
+	}
+	if len(init.Lhs) > 0 {
+		sw.Init = init
+	}
+	return sw
+}
+
+// makeRecvCase creates runtime.ChanRecvCase(ch, site) for the receive of a
+// select case
+func (instr *Instrumenter) makeRecvCase(recv *ast.UnaryExpr) *ast.CallExpr {
+	return instr.makeChanCall(instr.config.ChanRecvCaseFunc, recv.X,
+		instr.makeSite(recv, types.ExprString(recv.X), "KindChanRecv"))
+}
+
+// isChan reports whether expr is known to be a channel
+func (instr *Instrumenter) isChan(expr ast.Expr) bool {
+	if instr.typeInfo == nil {
+		return false
+	}
+	tv, ok := instr.typeInfo.Types[expr]
+	if !ok || tv.Type == nil {
+		return false
+	}
+	_, isChan := tv.Type.Underlying().(*types.Chan)
+	return isChan
+}
+
+// isBuiltinCall reports whether call calls the builtin function name
+func (instr *Instrumenter) isBuiltinCall(call *ast.CallExpr, name string) bool {
+	ident, ok := astutil.Unparen(call.Fun).(*ast.Ident)
+	if !ok || ident.Name != name {
+		return false
+	}
+	if instr.typeInfo == nil {
+		return true
+	}
+	_, isBuiltin := instr.typeInfo.Uses[ident].(*types.Builtin)
+	return isBuiltin
+}
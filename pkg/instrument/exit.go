@@ -0,0 +1,118 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/types"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// lowerExits replaces calls that end the program without running deferred
+// calls with runtime hooks that finalize the runtime first:
+//
+//	os.Exit(code)          →  runtime.Exit(code)
+//	log.Fatalf(format, v)  →  runtime.Fatalf(log.Default(), format, v)
+//	l.Fatal(v)             →  runtime.Fatal(l, v)
+//
+// The same applies to Fatal and Fatalln. The functions of os/signal are
+// replaced as well, so that the runtime finalizes on a signal only when the
+// program does not handle it:
+//
+//	signal.Notify(c, sig)  →  runtime.SignalNotify(c, sig)
+//
+// Calls are recognized by type, so renamed imports and shadowed package
+// names are handled. An import only used by replaced calls, as os often is,
+// becomes a blank import.
+func (instr *Instrumenter) lowerExits(f *ast.File) {
+	if instr.typeInfo == nil {
+		return
+	}
+	replaced := make(map[*types.PkgName]bool)
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		call, ok := c.Node().(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		fun, ok := astutil.Unparen(call.Fun).(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		obj, ok := instr.typeInfo.Uses[fun.Sel].(*types.Func)
+		if !ok || obj.Pkg() == nil {
+			return true
+		}
+
+		var hook string
+		args := call.Args
+		switch path, name := obj.Pkg().Path(), obj.Name(); {
+		case path == "os" && name == "Exit":
+			hook = instr.config.ExitFunc
+		case path == "log" && name == "Fatal":
+			hook = instr.config.FatalFunc
+		case path == "log" && name == "Fatalf":
+			hook = instr.config.FatalfFunc
+		case path == "log" && name == "Fatalln":
+			hook = instr.config.FatallnFunc
+		case path == "os/signal" && name == "Notify":
+			hook = instr.config.SignalNotifyFunc
+		case path == "os/signal" && name == "NotifyContext":
+			hook = instr.config.SignalNotifyContextFunc
+		case path == "os/signal" && name == "Ignore":
+			hook = instr.config.SignalIgnoreFunc
+		case path == "os/signal" && name == "Reset":
+			hook = instr.config.SignalResetFunc
+		case path == "os/signal" && name == "Stop":
+			hook = instr.config.SignalStopFunc
+		}
+		if hook == "" {
+			return true
+		}
+		if obj.Pkg().Path() == "log" {
+			// Fatal functions of the log package use its standard logger.
+			logger := fun.X
+			if obj.Signature().Recv() == nil {
+				logger = &ast.CallExpr{Fun: &ast.SelectorExpr{X: fun.X, Sel: &ast.Ident{Name: "Default"}}}
+			}
+			args = append([]ast.Expr{logger}, args...)
+		}
+
+		if id, ok := fun.X.(*ast.Ident); ok {
+			if pkg, ok := instr.typeInfo.Uses[id].(*types.PkgName); ok {
+				replaced[pkg] = true
+			}
+		}
+		instr.instrumented = true
+		c.Replace(&ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{Name: instr.config.RuntimeAlias},
+				Sel: &ast.Ident{Name: hook},
+			},
+			Args:     args,
+			Ellipsis: call.Ellipsis,
+		})
+		return true
+	})
+
+	// Blank the imports of the packages whose calls were all replaced
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if pkg, ok := instr.typeInfo.Uses[id].(*types.PkgName); ok {
+				delete(replaced, pkg)
+			}
+		}
+		return true
+	})
+	for pkg := range replaced {
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			name := pkg.Imported().Name()
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			if err == nil && path == pkg.Imported().Path() && name == pkg.Name() {
+				spec.Name = ast.NewIdent("_")
+			}
+		}
+	}
+}
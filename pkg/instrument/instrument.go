@@ -5,17 +5,24 @@ import (
 	"encoding/hex"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/importer"
 	"go/parser"
 	"go/token"
 	"go/types"
 	"golang.org/x/tools/go/ast/astutil"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // Config holds configuration for the instrumentation
 type Config struct {
-	// ImportRewrites maps import paths to replacement paths
+	// ImportRewrites maps import paths to replacement paths. By default
+	// "sync" is replaced by the moriarty shim that reports synchronization
+	// to the runtime.
 	ImportRewrites map[string]string
 
 	// BaseRuntimeAddress is the base package path for runtime functions
@@ -31,6 +38,56 @@ type Config struct {
 	// MemWriteFunc is the name of the memory write function
 	MemWriteFunc string
 
+	// MemReadRangeFunc and MemWriteRangeFunc are the names of the hooks for
+	// accesses to whole structs, arrays and slice ranges
+	MemReadRangeFunc  string
+	MemWriteRangeFunc string
+
+	// ChanSendFunc, ChanRecvFunc, ChanRecv2Func and ChanCloseFunc are the
+	// names of the channel operation hooks. Operations whose hook name is
+	// empty are left unchanged.
+	ChanSendFunc  string
+	ChanRecvFunc  string
+	ChanRecv2Func string
+	ChanCloseFunc string
+
+	// SelectFunc and ChanRecvCaseFunc are the names of the hooks that run a
+	// select statement under the control of the scheduler. Send cases use
+	// ChanSendFunc. Select statements are left unchanged if any of them is
+	// empty.
+	SelectFunc       string
+	ChanRecvCaseFunc string
+
+	// AtomicLoadFunc, AtomicStoreFunc and AtomicRMWFunc are the names of the
+	// hooks called before sync/atomic operations, and AtomicDoneFunc is the
+	// name of the hook that receives the result of loads and
+	// read-modify-writes. Operations whose hook name is empty are
+	// instrumented as ordinary calls.
+	AtomicLoadFunc  string
+	AtomicStoreFunc string
+	AtomicRMWFunc   string
+	AtomicDoneFunc  string
+
+	// ExitFunc, FatalFunc, FatalfFunc and FatallnFunc are the names of the
+	// hooks replacing os.Exit and the Fatal functions and methods of package
+	// log, which finalize the runtime before the program exits. Calls whose
+	// hook name is empty are left unchanged.
+	ExitFunc    string
+	FatalFunc   string
+	FatalfFunc  string
+	FatallnFunc string
+
+	// SignalNotifyFunc, SignalNotifyContextFunc, SignalIgnoreFunc,
+	// SignalResetFunc and SignalStopFunc are the names of the hooks
+	// replacing the functions of os/signal, which tell the runtime the
+	// signals the program handles itself. Calls whose hook name is empty are
+	// left unchanged.
+	SignalNotifyFunc        string
+	SignalNotifyContextFunc string
+	SignalIgnoreFunc        string
+	SignalResetFunc         string
+	SignalStopFunc          string
+
 	// SpawnFunc is the name of the goroutine spawn function
 	SpawnFunc string
 
@@ -41,11 +98,20 @@ type Config struct {
 	GoroutineExitFunc string
 
 	InitializeFunc string
-	FinalizeFunc string
+	FinalizeFunc   string
+
+	// RegisterSitesFunc is the name of the function that registers the
+	// per-package site table. If empty, no table is emitted and every
+	// hook receives site ID 0.
+	RegisterSitesFunc string
 
 	// Importer is used for resolving imports during type checking
 	// If nil, importer.Default() is used
 	Importer types.Importer
+
+	// Sizes is used to compute access sizes
+	// If nil, the gc sizes for the target GOARCH are used
+	Sizes types.Sizes
 }
 
 // DefaultConfig returns a Config with default settings
@@ -56,21 +122,78 @@ func DefaultConfig() *Config {
 		RuntimeAlias:       "", // Will be auto-generated
 		MemReadFunc:        "MemRead",
 		MemWriteFunc:       "MemWrite",
+		MemReadRangeFunc:   "MemReadRange",
+		MemWriteRangeFunc:  "MemWriteRange",
+		ChanSendFunc:       "ChanSend",
+		ChanRecvFunc:       "ChanRecv",
+		ChanRecv2Func:      "ChanRecv2",
+		ChanCloseFunc:      "ChanClose",
+		SelectFunc:         "Select",
+		ChanRecvCaseFunc:   "ChanRecvCase",
+		AtomicLoadFunc:     "AtomicLoad",
+		AtomicStoreFunc:    "AtomicStore",
+		AtomicRMWFunc:      "AtomicRMW",
+		AtomicDoneFunc:     "AtomicDone",
+		ExitFunc:           "Exit",
+		FatalFunc:          "Fatal",
+		FatalfFunc:         "Fatalf",
+		FatallnFunc:        "Fatalln",
+
+		SignalNotifyFunc:        "SignalNotify",
+		SignalNotifyContextFunc: "SignalNotifyContext",
+		SignalIgnoreFunc:        "SignalIgnore",
+		SignalResetFunc:         "SignalReset",
+		SignalStopFunc:          "SignalStop",
+
 		SpawnFunc:          "Spawn",
 		GoroutineEnterFunc: "GoroutineEnter",
 		GoroutineExitFunc:  "GoroutineExit",
 		InitializeFunc:     "Initialize",
 		FinalizeFunc:       "Finalize",
-		ImportRewrites:     map[string]string{},
+		RegisterSitesFunc:  "RegisterSites",
+		ImportRewrites: map[string]string{
+			"sync": "github.com/amirkhaki/moriarty/pkg/shim/sync",
+		},
 	}
 }
 
+// siteTableVar is the package-level variable holding the base site ID
+// returned by the runtime when the package's site table is registered.
+const siteTableVar = "__moriarty_sites"
+
+// site is an instrumented location, emitted into the per-package site table.
+type site struct {
+	pos  token.Position
+	fn   string
+	expr string
+	kind string // Name of the runtime Kind constant
+}
+
+// funcRange maps a function body to its qualified name.
+type funcRange struct {
+	pos, end token.Pos
+	name     string
+}
+
 // Instrumenter handles the instrumentation of Go source code
 type Instrumenter struct {
 	config          *Config
 	typeInfo        *types.Info
 	instrumented    bool // tracks if any instrumentation was added to current file
+	usesUnsafe      bool // tracks if the current file needs the unsafe import
 	anyInstrumented bool // tracks if any file had instrumentation
+
+	fset      *token.FileSet
+	funcs     []funcRange // functions of the current file
+	sites     []site      // sites of the current package
+	tableFile *ast.File   // file that receives the site table
+
+	// atomics maps the atomic loads and read-modify-writes of the current
+	// file to the address they operate on
+	atomics map[*ast.CallExpr]ast.Expr
+
+	// roots caches the module root found for each source directory
+	roots map[string]string
 }
 
 // NewInstrumenter creates a new Instrumenter with the given config
@@ -100,7 +223,8 @@ func generateRuntimeAlias(importPath string) string {
 	return "__moriarty_" + hashStr
 }
 
-// WasInstrumented returns true if any instrumentation was added during the last operation
+// WasInstrumented returns true if any instrumentation was added or any import
+// was rewritten during the last operation
 func (instr *Instrumenter) WasInstrumented() bool {
 	return instr.anyInstrumented
 }
@@ -133,8 +257,9 @@ func (instr *Instrumenter) InstrumentFiles(fset *token.FileSet, filenames []stri
 
 // InstrumentASTs instruments multiple already-parsed ASTs together
 func (instr *Instrumenter) InstrumentASTs(fset *token.FileSet, files []*ast.File) ([]*ast.File, error) {
-	// Reset the any-instrumented flag for this batch
+	// Reset the any-instrumented flag and site table for this batch
 	instr.anyInstrumented = false
+	instr.resetSites(fset)
 
 	// Perform type checking on all files together
 	imp := instr.config.Importer
@@ -143,9 +268,10 @@ func (instr *Instrumenter) InstrumentASTs(fset *token.FileSet, files []*ast.File
 	}
 	conf := types.Config{Importer: imp}
 	instr.typeInfo = &types.Info{
-		Types: make(map[ast.Expr]types.TypeAndValue),
-		Defs:  make(map[*ast.Ident]types.Object),
-		Uses:  make(map[*ast.Ident]types.Object),
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
 	}
 	_, typeErr := conf.Check("", fset, files, instr.typeInfo)
 	// If type checking completely failed (no useful type info), disable it
@@ -158,12 +284,15 @@ func (instr *Instrumenter) InstrumentASTs(fset *token.FileSet, files []*ast.File
 	for _, f := range files {
 		instr.instrumentSingleAST(fset, f)
 	}
+	instr.emitSiteTable()
 
 	return files, nil
 }
 
 // InstrumentAST instruments an already-parsed AST
 func (instr *Instrumenter) InstrumentAST(fset *token.FileSet, f *ast.File) (*ast.File, error) {
+	instr.resetSites(fset)
+
 	// Perform type checking on single file
 	imp := instr.config.Importer
 	if imp == nil {
@@ -171,9 +300,10 @@ func (instr *Instrumenter) InstrumentAST(fset *token.FileSet, f *ast.File) (*ast
 	}
 	conf := types.Config{Importer: imp}
 	instr.typeInfo = &types.Info{
-		Types: make(map[ast.Expr]types.TypeAndValue),
-		Defs:  make(map[*ast.Ident]types.Object),
-		Uses:  make(map[*ast.Ident]types.Object),
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
 	}
 	_, typeErr := conf.Check("", fset, []*ast.File{f}, instr.typeInfo)
 	// If type checking completely failed (no useful type info), disable it
@@ -183,6 +313,7 @@ func (instr *Instrumenter) InstrumentAST(fset *token.FileSet, f *ast.File) (*ast
 	// Otherwise, we can use partial type info even if there were errors
 
 	instr.instrumentSingleAST(fset, f)
+	instr.emitSiteTable()
 	return f, nil
 }
 
@@ -192,11 +323,16 @@ func (instr *Instrumenter) instrumentSingleAST(fset *token.FileSet, f *ast.File)
 
 	// Apply import rewrites
 	for k, v := range instr.config.ImportRewrites {
-		astutil.RewriteImport(fset, f, k, v)
+		if astutil.RewriteImport(fset, f, k, v) {
+			instr.anyInstrumented = true
+		}
 	}
 
-	// Reset instrumentation flag
+	// Reset instrumentation flags
 	instr.instrumented = false
+	instr.usesUnsafe = false
+	instr.atomics = make(map[*ast.CallExpr]ast.Expr)
+	instr.collectFuncs(f)
 
 	// Pass 0: Lower control flow structures (if/for with init)
 	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
@@ -242,15 +378,194 @@ func (instr *Instrumenter) instrumentSingleAST(fset *token.FileSet, f *ast.File)
 		return true
 	})
 
-	// Third pass: instrument main function if this is the main package
+	// Third pass: replace channel operations with runtime calls, after go
+	// statements so that receives in their arguments happen in the parent
+	instr.lowerChannelOps(f)
+
+	// Fourth pass: report the completion of atomic operations
+	instr.wrapAtomicResults(f)
+
+	// Fifth pass: finalize the runtime before os.Exit and log.Fatal
+	instr.lowerExits(f)
+
+	// Sixth pass: instrument main function if this is the main package
 	instr.instrumentMainFunction(f)
 
 	// Only add imports if instrumentation was actually added
 	if instr.instrumented {
 		instr.anyInstrumented = true
-		astutil.AddImport(fset, f, "unsafe")
+		if instr.usesUnsafe {
+			astutil.AddImport(fset, f, "unsafe")
+		}
 		astutil.AddNamedImport(fset, f, instr.config.RuntimeAlias, instr.config.BaseRuntimeAddress)
 	}
+
+	// The first file that produced sites hosts the package's site table
+	if instr.tableFile == nil && len(instr.sites) > 0 {
+		instr.tableFile = f
+	}
+}
+
+// resetSites starts a new per-package site table
+func (instr *Instrumenter) resetSites(fset *token.FileSet) {
+	instr.fset = fset
+	instr.sites = nil
+	instr.tableFile = nil
+}
+
+// collectFuncs records the body ranges of the file's functions so sites can
+// name their enclosing function
+func (instr *Instrumenter) collectFuncs(f *ast.File) {
+	instr.funcs = instr.funcs[:0]
+	for _, decl := range f.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok || funcDecl.Body == nil {
+			continue
+		}
+		name := funcDecl.Name.Name
+		if funcDecl.Recv != nil && len(funcDecl.Recv.List) > 0 {
+			name = types.ExprString(funcDecl.Recv.List[0].Type) + "." + name
+			if strings.HasPrefix(name, "*") {
+				name = "(" + strings.Replace(name, ".", ").", 1)
+			}
+		}
+		instr.funcs = append(instr.funcs, funcRange{
+			pos:  funcDecl.Body.Pos(),
+			end:  funcDecl.Body.End(),
+			name: f.Name.Name + "." + name,
+		})
+	}
+}
+
+func (instr *Instrumenter) enclosingFunc(pos token.Pos) string {
+	for _, fr := range instr.funcs {
+		if fr.pos <= pos && pos < fr.end {
+			return fr.name
+		}
+	}
+	return ""
+}
+
+// makeSite assigns the next site ID to node and returns the expression that
+// evaluates to it in the generated code
+func (instr *Instrumenter) makeSite(node ast.Node, expr string, kind string) ast.Expr {
+	if instr.config.RegisterSitesFunc == "" {
+		return &ast.BasicLit{Kind: token.INT, Value: "0"}
+	}
+	id := len(instr.sites)
+	instr.sites = append(instr.sites, site{
+		pos:  instr.fset.Position(node.Pos()),
+		fn:   instr.enclosingFunc(node.Pos()),
+		expr: expr,
+		kind: kind,
+	})
+	return &ast.BinaryExpr{
+		X:  &ast.Ident{Name: siteTableVar},
+		Op: token.ADD,
+		Y:  &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(id)},
+	}
+}
+
+// moduleRelative returns file relative to the root of its module, the
+// closest directory above it holding a go.mod file, or file itself if it is
+// not found
+func (instr *Instrumenter) moduleRelative(file string) string {
+	dir := filepath.Dir(file)
+	root, ok := instr.roots[dir]
+	if !ok {
+		root = moduleRoot(dir)
+		if instr.roots == nil {
+			instr.roots = make(map[string]string)
+		}
+		instr.roots[dir] = root
+	}
+	if root == "" {
+		return file
+	}
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// moduleRoot returns the closest directory holding a go.mod file from dir
+// upwards, or "" if there is none
+func moduleRoot(dir string) string {
+	if !filepath.IsAbs(dir) {
+		return ""
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// emitSiteTable appends the package's site table to the hosting file:
+//
+//	var __moriarty_sites = runtime.RegisterSites([]runtime.Site{...})
+func (instr *Instrumenter) emitSiteTable() {
+	if instr.tableFile == nil {
+		return
+	}
+
+	rt := func(name string) ast.Expr {
+		return &ast.SelectorExpr{
+			X:   &ast.Ident{Name: instr.config.RuntimeAlias},
+			Sel: &ast.Ident{Name: name},
+		}
+	}
+	field := func(name string, value ast.Expr) ast.Expr {
+		return &ast.KeyValueExpr{Key: &ast.Ident{Name: name}, Value: value}
+	}
+	str := func(v string) ast.Expr {
+		return &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(v)}
+	}
+	num := func(v int) ast.Expr {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(v)}
+	}
+
+	var elts []ast.Expr
+	for _, s := range instr.sites {
+		elts = append(elts, &ast.CompositeLit{
+			Elts: []ast.Expr{
+				field("File", str(s.pos.Filename)),
+				field("Path", str(instr.moduleRelative(s.pos.Filename))),
+				field("Line", num(s.pos.Line)),
+				field("Column", num(s.pos.Column)),
+				field("Func", str(s.fn)),
+				field("Expr", str(s.expr)),
+				field("Kind", rt(s.kind)),
+			},
+		})
+	}
+
+	decl := &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{
+			&ast.ValueSpec{
+				Names: []*ast.Ident{{Name: siteTableVar}},
+				Values: []ast.Expr{
+					&ast.CallExpr{
+						Fun: rt(instr.config.RegisterSitesFunc),
+						Args: []ast.Expr{
+							&ast.CompositeLit{
+								Type: &ast.ArrayType{Elt: rt("Site")},
+								Elts: elts,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	instr.tableFile.Decls = append(instr.tableFile.Decls, decl)
 }
 
 // WriteInstrumented writes the instrumented AST to the given writer
@@ -259,11 +574,31 @@ func WriteInstrumented(w io.Writer, fset *token.FileSet, f *ast.File) error {
 }
 
 func (instr *Instrumenter) makeMemReadCall(expr ast.Expr) *ast.CallExpr {
+	fn := instr.config.MemReadFunc
+	if instr.isAggregate(expr) {
+		fn = instr.config.MemReadRangeFunc
+	}
+	return instr.makeAccessCall(fn, &ast.UnaryExpr{Op: token.AND, X: expr}, instr.sizeOf(expr),
+		instr.makeSite(expr, types.ExprString(expr), "KindRead"))
+}
+
+func (instr *Instrumenter) makeMemWriteCall(expr ast.Expr) *ast.CallExpr {
+	fn := instr.config.MemWriteFunc
+	if instr.isAggregate(expr) {
+		fn = instr.config.MemWriteRangeFunc
+	}
+	return instr.makeAccessCall(fn, &ast.UnaryExpr{Op: token.AND, X: expr}, instr.sizeOf(expr),
+		instr.makeSite(expr, types.ExprString(expr), "KindWrite"))
+}
+
+// makeAccessCall builds runtime.fn(unsafe.Pointer(ptr), size, site)
+func (instr *Instrumenter) makeAccessCall(fn string, ptr, size, site ast.Expr) *ast.CallExpr {
 	instr.instrumented = true
+	instr.usesUnsafe = true
 	return &ast.CallExpr{
 		Fun: &ast.SelectorExpr{
 			X:   &ast.Ident{Name: instr.config.RuntimeAlias},
-			Sel: &ast.Ident{Name: instr.config.MemReadFunc},
+			Sel: &ast.Ident{Name: fn},
 		},
 		Args: []ast.Expr{
 			&ast.CallExpr{
@@ -271,33 +606,277 @@ func (instr *Instrumenter) makeMemReadCall(expr ast.Expr) *ast.CallExpr {
 					X:   &ast.Ident{Name: "unsafe"},
 					Sel: &ast.Ident{Name: "Pointer"},
 				},
-				Args: []ast.Expr{
-					&ast.UnaryExpr{Op: token.AND, X: expr},
-				},
+				Args: []ast.Expr{ptr},
 			},
+			size,
+			site,
 		},
 	}
 }
 
-func (instr *Instrumenter) makeMemWriteCall(expr ast.Expr) *ast.CallExpr {
-	instr.instrumented = true
+// sizes returns the type sizes used to compute access sizes
+func (instr *Instrumenter) sizes() types.Sizes {
+	if instr.config.Sizes != nil {
+		return instr.config.Sizes
+	}
+	return types.SizesFor("gc", build.Default.GOARCH)
+}
+
+// sizeOf returns the size of the value denoted by expr: a constant when the
+// type is known, unsafe.Sizeof(expr) otherwise (e.g. for type parameters)
+func (instr *Instrumenter) sizeOf(expr ast.Expr) ast.Expr {
+	if instr.typeInfo != nil {
+		if t := instr.typeInfo.TypeOf(expr); t != nil {
+			if size, ok := instr.constSize(t); ok {
+				return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(size, 10)}
+			}
+		}
+	}
 	return &ast.CallExpr{
 		Fun: &ast.SelectorExpr{
-			X:   &ast.Ident{Name: instr.config.RuntimeAlias},
-			Sel: &ast.Ident{Name: instr.config.MemWriteFunc},
+			X:   &ast.Ident{Name: "unsafe"},
+			Sel: &ast.Ident{Name: "Sizeof"},
 		},
-		Args: []ast.Expr{
-			&ast.CallExpr{
-				Fun: &ast.SelectorExpr{
-					X:   &ast.Ident{Name: "unsafe"},
-					Sel: &ast.Ident{Name: "Pointer"},
-				},
-				Args: []ast.Expr{
-					&ast.UnaryExpr{Op: token.AND, X: expr},
-				},
-			},
+		Args: []ast.Expr{expr},
+	}
+}
+
+// constSize returns the size of t if it is known while instrumenting. It is
+// not for type parameters, nor for types holding values of a package that
+// ImportRewrites replaces: the types are checked against the original
+// package, whose layout the replacement need not share.
+func (instr *Instrumenter) constSize(t types.Type) (int64, bool) {
+	sizes := instr.sizes()
+	if sizes == nil || hasTypeParam(t) || instr.hasRewrittenType(t) {
+		return 0, false
+	}
+	return sizes.Sizeof(t), true
+}
+
+// hasRewrittenType reports whether a value of type t holds a value of a type
+// declared in a package that ImportRewrites replaces
+func (instr *Instrumenter) hasRewrittenType(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.Alias:
+		return instr.hasRewrittenType(types.Unalias(t))
+	case *types.Named:
+		if pkg := t.Obj().Pkg(); pkg != nil {
+			if _, ok := instr.config.ImportRewrites[pkg.Path()]; ok {
+				return true
+			}
+		}
+		return instr.hasRewrittenType(t.Underlying())
+	case *types.Array:
+		return instr.hasRewrittenType(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if instr.hasRewrittenType(t.Field(i).Type()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isAggregate reports whether expr is a whole struct or array, whose
+// accesses are reported as ranges
+func (instr *Instrumenter) isAggregate(expr ast.Expr) bool {
+	if instr.typeInfo == nil {
+		return false
+	}
+	t := instr.typeInfo.TypeOf(expr)
+	if t == nil {
+		return false
+	}
+	switch t.Underlying().(type) {
+	case *types.Struct, *types.Array:
+		return true
+	}
+	return false
+}
+
+func hasTypeParam(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.TypeParam:
+		return true
+	case *types.Named:
+		if args := t.TypeArgs(); args != nil {
+			for i := 0; i < args.Len(); i++ {
+				if hasTypeParam(args.At(i)) {
+					return true
+				}
+			}
+		}
+		return false
+	case *types.Pointer, *types.Slice, *types.Map, *types.Chan, *types.Signature, *types.Interface:
+		// Fixed size regardless of their element types
+		return false
+	case *types.Array:
+		return hasTypeParam(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if hasTypeParam(t.Field(i).Type()) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// isPure reports whether expr can be evaluated again without side effects
+func isPure(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.Ident, *ast.BasicLit:
+		return true
+	case *ast.ParenExpr:
+		return isPure(e.X)
+	case *ast.SelectorExpr:
+		return isPure(e.X)
+	case *ast.StarExpr:
+		return isPure(e.X)
+	case *ast.IndexExpr:
+		return isPure(e.X) && isPure(e.Index)
+	case *ast.SliceExpr:
+		for _, x := range []ast.Expr{e.Low, e.High, e.Max} {
+			if x != nil && !isPure(x) {
+				return false
+			}
+		}
+		return isPure(e.X)
+	case *ast.BinaryExpr:
+		return isPure(e.X) && isPure(e.Y)
+	}
+	return false
+}
+
+// sliceElemSize returns the element size of a slice-typed expression: a
+// constant when the type is known, unsafe.Sizeof(expr[0]) otherwise
+func (instr *Instrumenter) sliceElemSize(expr ast.Expr) (ast.Expr, bool) {
+	t := instr.typeInfo.TypeOf(expr)
+	if t == nil {
+		return nil, false
+	}
+	slice, ok := t.Underlying().(*types.Slice)
+	if !ok || hasTypeParam(slice.Elem()) {
+		return nil, false
+	}
+	if size, ok := instr.constSize(slice.Elem()); ok {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(size, 10)}, true
+	}
+	// The operand of unsafe.Sizeof is not evaluated, so an empty slice is fine
+	return &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{Name: "unsafe"},
+			Sel: &ast.Ident{Name: "Sizeof"},
+		},
+		Args: []ast.Expr{&ast.IndexExpr{X: expr, Index: &ast.BasicLit{Kind: token.INT, Value: "0"}}},
+	}, true
+}
+
+// makeSliceRangeCall builds a range hook covering the first n elements of
+// slice: runtime.fn(unsafe.Pointer(unsafe.SliceData(slice)), uintptr(n)*elemSize, site)
+func (instr *Instrumenter) makeSliceRangeCall(fn string, slice, n ast.Expr, elemSize ast.Expr, node ast.Node, kind string) ast.Stmt {
+	size := &ast.BinaryExpr{
+		X:  &ast.CallExpr{Fun: &ast.Ident{Name: "uintptr"}, Args: []ast.Expr{n}},
+		Op: token.MUL,
+		Y:  elemSize,
+	}
+	ptr := &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{Name: "unsafe"},
+			Sel: &ast.Ident{Name: "SliceData"},
 		},
+		Args: []ast.Expr{slice},
+	}
+	site := instr.makeSite(node, types.ExprString(node.(ast.Expr)), kind)
+	return &ast.ExprStmt{X: instr.makeAccessCall(fn, ptr, size, site)}
+}
+
+func lenOf(x ast.Expr) ast.Expr {
+	return &ast.CallExpr{Fun: &ast.Ident{Name: "len"}, Args: []ast.Expr{x}}
+}
+
+// collectRangeAccesses instruments calls that access whole memory ranges:
+// copy(), append() and conversions from slices to strings
+func (instr *Instrumenter) collectRangeAccesses(call *ast.CallExpr, stmts *[]ast.Stmt) {
+	if instr.typeInfo == nil {
+		return
+	}
+
+	// Conversion string(b) reads all of b
+	if tv, ok := instr.typeInfo.Types[call.Fun]; ok && tv.IsType() {
+		if len(call.Args) != 1 || !isString(tv.Type) || !isPure(call.Args[0]) {
+			return
+		}
+		if esz, ok := instr.sliceElemSize(call.Args[0]); ok {
+			arg := call.Args[0]
+			*stmts = append(*stmts, instr.makeSliceRangeCall(instr.config.MemReadRangeFunc, arg, lenOf(arg), esz, call, "KindRead"))
+		}
+		return
+	}
+
+	ident, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return
+	}
+	builtin, ok := instr.typeInfo.Uses[ident].(*types.Builtin)
+	if !ok {
+		return
 	}
+
+	switch builtin.Name() {
+	case "copy":
+		// copy(dst, src) writes and reads min(len(dst), len(src)) elements
+		if len(call.Args) != 2 || !isPure(call.Args[0]) || !isPure(call.Args[1]) {
+			return
+		}
+		dst, src := call.Args[0], call.Args[1]
+		esz, ok := instr.sliceElemSize(dst)
+		if !ok {
+			return
+		}
+		n := &ast.CallExpr{Fun: &ast.Ident{Name: "min"}, Args: []ast.Expr{lenOf(dst), lenOf(src)}}
+		// Strings are immutable, so reading them cannot race
+		if _, isSlice := instr.typeInfo.TypeOf(src).Underlying().(*types.Slice); isSlice {
+			*stmts = append(*stmts, instr.makeSliceRangeCall(instr.config.MemReadRangeFunc, src, n, esz, call, "KindRead"))
+		}
+		*stmts = append(*stmts, instr.makeSliceRangeCall(instr.config.MemWriteRangeFunc, dst, n, esz, call, "KindWrite"))
+	case "append":
+		// append(s, x...) reads x and writes into the spare capacity of s
+		if len(call.Args) < 2 || !isPure(call.Args[0]) {
+			return
+		}
+		s := call.Args[0]
+		esz, ok := instr.sliceElemSize(s)
+		if !ok {
+			return
+		}
+		var n ast.Expr = &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(len(call.Args) - 1)}
+		if call.Ellipsis.IsValid() {
+			src := call.Args[1]
+			if !isPure(src) {
+				return
+			}
+			n = lenOf(src)
+			if _, isSlice := instr.typeInfo.TypeOf(src).Underlying().(*types.Slice); isSlice {
+				*stmts = append(*stmts, instr.makeSliceRangeCall(instr.config.MemReadRangeFunc, src, n, esz, call, "KindRead"))
+			}
+		}
+		// s[len(s):cap(s)] never points past the end of the backing array
+		spare := &ast.SliceExpr{
+			X:    s,
+			Low:  lenOf(s),
+			High: &ast.CallExpr{Fun: &ast.Ident{Name: "cap"}, Args: []ast.Expr{s}},
+		}
+		written := &ast.CallExpr{Fun: &ast.Ident{Name: "min"}, Args: []ast.Expr{lenOf(spare), n}}
+		*stmts = append(*stmts, instr.makeSliceRangeCall(instr.config.MemWriteRangeFunc, spare, written, esz, call, "KindWrite"))
+	}
+}
+
+func isString(t types.Type) bool {
+	basic, ok := t.Underlying().(*types.Basic)
+	return ok && basic.Info()&types.IsString != 0
 }
 
 func (instr *Instrumenter) instrumentGoStmt(c *astutil.Cursor, stmt *ast.GoStmt) {
@@ -310,9 +889,9 @@ func (instr *Instrumenter) instrumentGoStmt(c *astutil.Cursor, stmt *ast.GoStmt)
 	//   ...
 	//   runtime.Spawn(func() {
 	//     runtime.GoroutineEnter()
+	//     defer runtime.GoroutineExit()
 	//     f(p1, p2, ...)
-	//     runtime.GoroutineExit()
-	//   })
+	//   }, site)
 	// }
 
 	instr.instrumented = true
@@ -356,9 +935,10 @@ func (instr *Instrumenter) instrumentGoStmt(c *astutil.Cursor, stmt *ast.GoStmt)
 		},
 	}
 
-	// Create runtime.GoroutineExit() call
-	exitCall := &ast.ExprStmt{
-		X: &ast.CallExpr{
+	// Create defer runtime.GoroutineExit(), which also runs if f panics or
+	// calls runtime.Goexit
+	exitCall := &ast.DeferStmt{
+		Call: &ast.CallExpr{
 			Fun: &ast.SelectorExpr{
 				X:   &ast.Ident{Name: instr.config.RuntimeAlias},
 				Sel: &ast.Ident{Name: instr.config.GoroutineExitFunc},
@@ -366,26 +946,26 @@ func (instr *Instrumenter) instrumentGoStmt(c *astutil.Cursor, stmt *ast.GoStmt)
 		},
 	}
 
-	// Create the function literal: func() { GoroutineEnter(); f(p1, p2, ...); GoroutineExit() }
+	// Create the function literal: func() { GoroutineEnter(); defer GoroutineExit(); f(p1, p2, ...) }
 	funcLit := &ast.FuncLit{
 		Type: &ast.FuncType{Params: &ast.FieldList{}},
 		Body: &ast.BlockStmt{
 			List: []ast.Stmt{
 				enterCall,
-				&ast.ExprStmt{X: wrappedCall},
 				exitCall,
+				&ast.ExprStmt{X: wrappedCall},
 			},
 		},
 	}
 
-	// Create runtime.Spawn(funcLit) call
+	// Create runtime.Spawn(funcLit, site) call
 	spawnCall := &ast.ExprStmt{
 		X: &ast.CallExpr{
 			Fun: &ast.SelectorExpr{
 				X:   &ast.Ident{Name: instr.config.RuntimeAlias},
 				Sel: &ast.Ident{Name: instr.config.SpawnFunc},
 			},
-			Args: []ast.Expr{funcLit},
+			Args: []ast.Expr{funcLit, instr.makeSite(stmt, types.ExprString(callExpr), "KindSpawn")},
 		},
 	}
 	blockStmts = append(blockStmts, spawnCall)
@@ -686,11 +1266,11 @@ func (instr *Instrumenter) collectReads(expr ast.Expr, stmts *[]ast.Stmt) {
 				return
 			}
 		}
-		instr.collectReads(e.X, stmts)
+		instr.collectOperandReads(e.X, stmts)
 		*stmts = append(*stmts, &ast.ExprStmt{X: instr.makeMemReadCall(e)})
 	case *ast.IndexExpr:
 		// Use type information to determine if this is a map or array/slice
-		instr.collectReads(e.X, stmts)
+		instr.collectOperandReads(e.X, stmts)
 		instr.collectReads(e.Index, stmts)
 
 		// Check if the indexed expression is addressable (not a map)
@@ -721,6 +1301,9 @@ func (instr *Instrumenter) collectReads(expr ast.Expr, stmts *[]ast.Stmt) {
 		instr.collectReads(e.X, stmts)
 		instr.collectReads(e.Y, stmts)
 	case *ast.CallExpr:
+		if instr.collectAtomic(e, stmts) {
+			return
+		}
 		// Don't instrument the function itself if it's a simple identifier or selector
 		// Only instrument if it's a function value from a variable
 		switch fun := e.Fun.(type) {
@@ -736,12 +1319,12 @@ func (instr *Instrumenter) collectReads(expr ast.Expr, stmts *[]ast.Stmt) {
 							break
 						}
 						// Not a package, it's a real object - instrument it
-						instr.collectReads(fun.X, stmts)
+						instr.collectReceiverReads(fun, stmts)
 					}
 					// obj is nil - unknown, assume it's a package (conservative)
 				} else {
 					// X is not a simple ident (e.g., obj.field.method())
-					instr.collectReads(fun.X, stmts)
+					instr.collectReceiverReads(fun, stmts)
 				}
 			} else {
 				// No type info - be conservative
@@ -759,6 +1342,7 @@ func (instr *Instrumenter) collectReads(expr ast.Expr, stmts *[]ast.Stmt) {
 		for _, arg := range e.Args {
 			instr.collectReads(arg, stmts)
 		}
+		instr.collectRangeAccesses(e, stmts)
 	case *ast.ParenExpr:
 		instr.collectReads(e.X, stmts)
 	case *ast.SliceExpr:
@@ -784,6 +1368,50 @@ func (instr *Instrumenter) collectReads(expr ast.Expr, stmts *[]ast.Stmt) {
 	}
 }
 
+// collectOperandReads collects the reads of the operand x of a selector or
+// index expression. A struct or array operand is not read as a whole, as
+// only the selected field or element is accessed, but the pointers and
+// indices locating it are.
+func (instr *Instrumenter) collectOperandReads(x ast.Expr, stmts *[]ast.Stmt) {
+	if !instr.isAggregate(x) {
+		instr.collectReads(x, stmts)
+		return
+	}
+	switch e := x.(type) {
+	case *ast.Ident:
+		// A variable: nothing to read to locate it
+	case *ast.ParenExpr:
+		instr.collectOperandReads(e.X, stmts)
+	case *ast.SelectorExpr:
+		instr.collectOperandReads(e.X, stmts)
+	case *ast.IndexExpr:
+		instr.collectOperandReads(e.X, stmts)
+		instr.collectReads(e.Index, stmts)
+	case *ast.StarExpr:
+		instr.collectReads(e.X, stmts)
+	default:
+		// Not addressable, e.g. a call result: read what computes it
+		instr.collectReads(x, stmts)
+	}
+}
+
+// collectReceiverReads collects the reads of the receiver of the method
+// call fun. A method with a pointer receiver called on a value takes the
+// value's address rather than reading it.
+func (instr *Instrumenter) collectReceiverReads(fun *ast.SelectorExpr, stmts *[]ast.Stmt) {
+	if sel := instr.typeInfo.Selections[fun]; sel != nil && sel.Kind() == types.MethodVal {
+		recv := sel.Obj().Type().(*types.Signature).Recv()
+		_, ptrRecv := types.Unalias(recv.Type()).(*types.Pointer)
+		if t := instr.typeInfo.TypeOf(fun.X); ptrRecv && t != nil {
+			if _, ptrX := t.Underlying().(*types.Pointer); !ptrX {
+				instr.collectOperandReads(fun.X, stmts)
+				return
+			}
+		}
+	}
+	instr.collectReads(fun.X, stmts)
+}
+
 func (instr *Instrumenter) collectWrites(expr ast.Expr, stmts *[]ast.Stmt) {
 	if expr == nil {
 		return
@@ -795,13 +1423,13 @@ func (instr *Instrumenter) collectWrites(expr ast.Expr, stmts *[]ast.Stmt) {
 	case *ast.SelectorExpr:
 		// For writes to obj.field, we need to read obj first
 		var readStmts []ast.Stmt
-		instr.collectReads(e.X, &readStmts)
+		instr.collectOperandReads(e.X, &readStmts)
 		*stmts = append(*stmts, readStmts...)
 		*stmts = append(*stmts, &ast.ExprStmt{X: instr.makeMemWriteCall(e)})
 	case *ast.IndexExpr:
 		// For writes to arr[i] or m[key], we need to read arr/m and i/key first
 		var readStmts []ast.Stmt
-		instr.collectReads(e.X, &readStmts)
+		instr.collectOperandReads(e.X, &readStmts)
 		instr.collectReads(e.Index, &readStmts)
 		*stmts = append(*stmts, readStmts...)
 
@@ -863,9 +1491,11 @@ func (instr *Instrumenter) instrumentMainFunction(f *ast.File) {
 				},
 			}
 
-			// Add GoroutineExit at the end
-			exitCall := &ast.ExprStmt{
-				X: &ast.CallExpr{
+			// Defer GoroutineExit and Finalize, so that they run however
+			// main ends: by returning, panicking or calling runtime.Goexit.
+			// Deferred calls run in reverse order, so Finalize comes last.
+			exitCall := &ast.DeferStmt{
+				Call: &ast.CallExpr{
 					Fun: &ast.SelectorExpr{
 						X:   &ast.Ident{Name: instr.config.RuntimeAlias},
 						Sel: &ast.Ident{Name: instr.config.GoroutineExitFunc},
@@ -880,8 +1510,8 @@ func (instr *Instrumenter) instrumentMainFunction(f *ast.File) {
 					},
 				},
 			}
-			finalizeCall := &ast.ExprStmt{
-				X: &ast.CallExpr{
+			finalizeCall := &ast.DeferStmt{
+				Call: &ast.CallExpr{
 					Fun: &ast.SelectorExpr{
 						X:   &ast.Ident{Name: instr.config.RuntimeAlias},
 						Sel: &ast.Ident{Name: instr.config.FinalizeFunc},
@@ -889,11 +1519,10 @@ func (instr *Instrumenter) instrumentMainFunction(f *ast.File) {
 				},
 			}
 
-			// Prepend enter call to the body
+			// Prepend the hooks to the body
 			if funcDecl.Body != nil {
-				funcDecl.Body.List = append([]ast.Stmt{initializeCall, enterCall}, funcDecl.Body.List...)
-				// Append exit call to the body
-				funcDecl.Body.List = append(funcDecl.Body.List, exitCall, finalizeCall)
+				hooks := []ast.Stmt{initializeCall, finalizeCall, enterCall, exitCall}
+				funcDecl.Body.List = append(hooks, funcDecl.Body.List...)
 				instr.instrumented = true
 			}
 
@@ -2,9 +2,11 @@ package instrument_test
 
 import (
 	"bytes"
+	"fmt"
 	"go/printer"
 	"go/token"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -125,7 +127,7 @@ func main() {
 	result := buf.String()
 
 	// Should instrument array element
-	if !strings.Contains(result, "MemWrite(unsafe.Pointer(&arr[0]))") {
+	if !strings.Contains(result, "MemWrite(unsafe.Pointer(&arr[0]), 8, __moriarty_sites+") {
 		t.Error("Expected instrumentation for array element write")
 	}
 
@@ -219,3 +221,668 @@ func UseCounter() {
 		}
 	}
 }
+
+func TestSiteTable(t *testing.T) {
+	src := `package main
+
+var counter int
+
+func increment() {
+	counter = counter + 1
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "site.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	// Hooks receive the site ID as an offset from the registered table base
+	if !strings.Contains(result, "MemRead(unsafe.Pointer(&counter), 8, __moriarty_sites+0)") {
+		t.Errorf("Expected read hook with site 0, got:\n%s", result)
+	}
+	if !strings.Contains(result, "MemWrite(unsafe.Pointer(&counter), 8, __moriarty_sites+1)") {
+		t.Errorf("Expected write hook with site 1, got:\n%s", result)
+	}
+
+	// The table is registered once per package with the original positions
+	if strings.Count(result, "var __moriarty_sites = ") != 1 {
+		t.Errorf("Expected exactly one site table, got:\n%s", result)
+	}
+	for _, want := range []string{
+		`File: "site.go", Path: "site.go", Line: 6, Column: 12, Func: "main.increment", Expr: "counter"`,
+		".KindRead}",
+		".KindWrite}",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected site table to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestSitePathIsModuleRelative(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "pkg", "site.go")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := `package pkg
+
+var counter int
+
+func increment() {
+	counter++
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, file, src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	// Reports name the file by its full path, the program hash by its path
+	// in its module
+	want := fmt.Sprintf("File: %q, Path: \"pkg/site.go\"", file)
+	if result := buf.String(); !strings.Contains(result, want) {
+		t.Errorf("Expected site table to contain %q, got:\n%s", want, result)
+	}
+}
+
+func TestRangeAccesses(t *testing.T) {
+	src := `package main
+
+type point struct{ x, y int }
+
+var p, q point
+
+func main() {
+	dst := make([]byte, 4)
+	src := []byte("abcd")
+	copy(dst, src)
+	dst = append(dst, src...)
+	_ = string(src)
+	p = q
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "range.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		// copy reads the source and writes the destination
+		"MemReadRange(unsafe.Pointer(unsafe.SliceData(src)), uintptr(min(len(dst), len(src)))*1,",
+		"MemWriteRange(unsafe.Pointer(unsafe.SliceData(dst)), uintptr(min(len(dst), len(src)))*1,",
+		// string conversion reads the whole slice
+		"MemReadRange(unsafe.Pointer(unsafe.SliceData(src)), uintptr(len(src))*1,",
+		// struct copies cover the whole value
+		"MemReadRange(unsafe.Pointer(&q), 16,",
+		"MemWriteRange(unsafe.Pointer(&p), 16,",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestFieldAccessesDoNotReadAggregates(t *testing.T) {
+	src := `package main
+
+import "sync"
+
+type account struct {
+	mu  sync.Mutex
+	bal int
+}
+
+var a account
+var arr [4]int
+
+func main() {
+	a.mu.Lock()
+	a.bal++
+	a.mu.Unlock()
+	arr[1] = arr[2]
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "field.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	// Only the fields and elements are accessed, not the whole values
+	for _, unwanted := range []string{"unsafe.Pointer(&a)", "unsafe.Pointer(&a.mu)", "unsafe.Pointer(&arr)"} {
+		if strings.Contains(result, unwanted) {
+			t.Errorf("Expected output not to contain %q, got:\n%s", unwanted, result)
+		}
+	}
+	for _, want := range []string{
+		"MemRead(unsafe.Pointer(&a.bal), 8,",
+		"MemWrite(unsafe.Pointer(&a.bal), 8,",
+		"MemRead(unsafe.Pointer(&arr[2]), 8,",
+		"MemWrite(unsafe.Pointer(&arr[1]), 8,",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestShimTypeSizesAreNotConstant(t *testing.T) {
+	src := `package main
+
+import "sync"
+
+type cache struct {
+	mu sync.RWMutex
+	n  int
+}
+
+var c, d cache
+var caches []cache
+
+func main() {
+	c = d
+	caches = append(caches, c)
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "shim.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	// The shim's RWMutex is not laid out like the standard library's, so
+	// sizes are left to the compiler
+	for _, want := range []string{
+		"MemReadRange(unsafe.Pointer(&d), unsafe.Sizeof(d),",
+		"MemWriteRange(unsafe.Pointer(&c), unsafe.Sizeof(c),",
+		")*unsafe.Sizeof(caches[0]),",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+	buildInstrumented(t, result)
+}
+
+func TestChannelOps(t *testing.T) {
+	src := `package main
+
+func main() {
+	ch := make(chan int, 1)
+	done := make(chan bool)
+	ch <- 1
+	x := <-ch + 1
+	v, ok := <-ch
+	close(ch)
+	for y := range ch {
+		_ = y
+	}
+	select {
+	case done <- true:
+	case z := <-ch:
+		_ = z
+	}
+	_, _, _ = x, v, ok
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "chan.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		".ChanSend(ch, __moriarty_sites+",
+		").Send(1)",
+		"x := __moriarty_5decea860786e867.ChanRecv(ch, __moriarty_sites+",
+		"v, ok := __moriarty_5decea860786e867.ChanRecv2(ch, __moriarty_sites+",
+		".ChanClose(ch, __moriarty_sites+",
+		"for __moriarty_ch := ch; ; {",
+		"y, __moriarty_ok := __moriarty_5decea860786e867.ChanRecv2(__moriarty_ch, __moriarty_sites+",
+		// Select statements become a switch on the runtime's choice
+		"switch __moriarty_c0, __moriarty_c1 := __moriarty_5decea860786e867.ChanSend(done, __moriarty_sites+",
+		").Case(true), __moriarty_5decea860786e867.ChanRecvCase(ch, __moriarty_sites+",
+		"); __moriarty_5decea860786e867.Select(__moriarty_sites+",
+		", false, __moriarty_c0, __moriarty_c1) {",
+		"case 1:\n\t\tz := __moriarty_c1.Value",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestSelectLowering(t *testing.T) {
+	src := `package main
+
+func main() {
+	ch := make(chan int)
+	var x int
+	var ok bool
+loop:
+	for {
+		select {
+		case x, ok = <-ch:
+			if !ok {
+				break loop
+			}
+		case <-ch:
+		default:
+			break loop
+		}
+	}
+	select {}
+	_, _ = x, ok
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "select.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		", true, __moriarty_c0, __moriarty_c1) {",
+		".MemWrite(unsafe.Pointer(&x), 8, __moriarty_sites+",
+		".MemWrite(unsafe.Pointer(&ok), 1, __moriarty_sites+",
+		"x, ok = __moriarty_c0.Value, __moriarty_c0.OK",
+		"break loop",
+		"default:",
+		// Empty selects block forever and are left alone
+		"select {}",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestAtomicOps(t *testing.T) {
+	src := `package main
+
+import "sync/atomic"
+
+type stats struct {
+	hits atomic.Int64
+}
+
+var flag int32
+
+func main() {
+	s := &stats{}
+	s.hits.Add(1)
+	atomic.StoreInt32(&flag, 1)
+	for atomic.LoadInt32(&flag) == 0 {
+	}
+	_ = s.hits.Load()
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "atomic.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		".AtomicRMW(unsafe.Pointer(&s.hits), 8, __moriarty_sites+",
+		".AtomicDone(s.hits.Add(1), unsafe.Pointer(&s.hits), __moriarty_sites+",
+		".AtomicStore(unsafe.Pointer(&flag), 4, __moriarty_sites+",
+		"\tatomic.StoreInt32(&flag, 1)",
+		".AtomicLoad(unsafe.Pointer(&flag), 4, __moriarty_sites+",
+		"for __moriarty_5decea860786e867.AtomicDone(atomic.LoadInt32(&flag), unsafe.Pointer(&flag), __moriarty_sites+",
+		".AtomicLoad(unsafe.Pointer(&s.hits), 8, __moriarty_sites+",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+
+	// The atomic variables themselves are not reported as plain accesses
+	for _, unwanted := range []string{"MemRead(unsafe.Pointer(&s.hits)", "MemRead(unsafe.Pointer(&flag)"} {
+		if strings.Contains(result, unwanted) {
+			t.Errorf("Expected output not to contain %q, got:\n%s", unwanted, result)
+		}
+	}
+}
+
+func TestAtomicAddressWithSideEffects(t *testing.T) {
+	src := `package main
+
+import "sync/atomic"
+
+type stats struct {
+	hits atomic.Int64
+}
+
+var n int64
+
+func next() *int64 { return &n }
+
+func current() *stats { return &stats{} }
+
+func main() {
+	atomic.AddInt64(next(), 1)
+	_ = current().hits.Add(1)
+	atomic.AddInt64(&n, 1)
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "atomic.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	// The address is evaluated once, by the operation itself
+	for _, call := range []string{"next()", "current()"} {
+		if got := strings.Count(result, call); got != 2 {
+			t.Errorf("Expected %q once besides its declaration, found %d times:\n%s", call, got-1, result)
+		}
+	}
+	if want := ".AtomicRMW(unsafe.Pointer(&n), 8, __moriarty_sites+"; !strings.Contains(result, want) {
+		t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+	}
+
+	buildInstrumented(t, result)
+}
+
+func TestExitHooksAreDeferred(t *testing.T) {
+	src := `package main
+
+func work() {}
+
+func main() {
+	go work()
+	if true {
+		return
+	}
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "exit.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		// main registers its hooks first, so they run after an early return
+		"func main() {\n\t__moriarty_5decea860786e867.Initialize()\n" +
+			"\tdefer __moriarty_5decea860786e867.Finalize()\n" +
+			"\t__moriarty_5decea860786e867.GoroutineEnter()\n" +
+			"\tdefer __moriarty_5decea860786e867.GoroutineExit()\n",
+		// goroutines defer their exit hook before running the function
+		"__moriarty_5decea860786e867.GoroutineEnter()\n" +
+			"\t\t\tdefer __moriarty_5decea860786e867.GoroutineExit()\n" +
+			"\t\t\twork()\n",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestExitCalls(t *testing.T) {
+	src := `package main
+
+import (
+	stdlog "log"
+	"os"
+)
+
+func main() {
+	l := stdlog.New(os.Stderr, "", 0)
+	args := []any{"a", 1}
+	if len(args) == 0 {
+		os.Exit(2)
+	}
+	if len(args) == 1 {
+		stdlog.Fatalf("%v", args...)
+	}
+	l.Fatal(args...)
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "exit.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		"__moriarty_5decea860786e867.Exit(2)",
+		`__moriarty_5decea860786e867.Fatalf(stdlog.Default(), "%v", args...)`,
+		"__moriarty_5decea860786e867.Fatal(l, args...)",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+}
+
+func TestExitOnlyImportCompiles(t *testing.T) {
+	src := `package main
+
+import "os"
+
+func main() {
+	os.Exit(3)
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "exit.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+	if !strings.Contains(result, `_ "os"`) {
+		t.Errorf("Expected the unused os import to be blank, got:\n%s", result)
+	}
+	buildInstrumented(t, result)
+}
+
+func TestSignalCalls(t *testing.T) {
+	src := `package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	signal.Ignore(syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	signal.Reset()
+	<-ctx.Done()
+}
+`
+
+	instr := instrument.NewInstrumenter(nil)
+	fset := token.NewFileSet()
+
+	f, err := instr.InstrumentFile(fset, "signal.go", src)
+	if err != nil {
+		t.Fatalf("InstrumentFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+
+	result := buf.String()
+
+	for _, want := range []string{
+		"__moriarty_5decea860786e867.SignalNotify(c, os.Interrupt)",
+		"defer __moriarty_5decea860786e867.SignalStop(c)",
+		"__moriarty_5decea860786e867.SignalIgnore(syscall.SIGTERM)",
+		"__moriarty_5decea860786e867.SignalNotifyContext(context.Background(), os.Interrupt)",
+		"__moriarty_5decea860786e867.SignalReset()",
+		`_ "os/signal"`,
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, result)
+		}
+	}
+	buildInstrumented(t, result)
+}
+
+// buildInstrumented compiles an instrumented main package against the
+// runtime of this checkout.
+func buildInstrumented(t *testing.T, src string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping build in short mode")
+	}
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	mod := "module example\n\ngo 1.25\n\n" +
+		"require github.com/amirkhaki/moriarty v0.0.0\n\n" +
+		"replace github.com/amirkhaki/moriarty => " + root + "\n"
+	for name, content := range map[string][]byte{"go.mod": []byte(mod), "go.sum": sum, "main.go": []byte(src)} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "build", "-o", os.DevNull, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Instrumented code doesn't compile: %v\n%s\n%s", err, out, src)
+	}
+}
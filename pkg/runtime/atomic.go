@@ -0,0 +1,47 @@
+package runtime
+
+import (
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/goid"
+)
+
+// --- Atomic Hooks ---
+//
+// The instrumenter reports every call to a sync/atomic function or method
+// through these hooks before the call's statement runs, and passes the
+// result of loads and read-modify-writes through AtomicDone:
+//
+//	n.Add(1)                 AtomicRMW(&n, 8, site); AtomicDone(n.Add(1), &n, site)
+//	atomic.StoreInt32(&f, 1) AtomicStore(&f, 4, site); atomic.StoreInt32(&f, 1)
+//
+// addr is the variable the operation works on and size its size in bytes.
+
+// AtomicLoad is called before an atomic load, e.g. atomic.LoadInt64 or
+// atomic.Int64.Load.
+func AtomicLoad(addr unsafe.Pointer, size uintptr, site SiteID) {
+	atomicEvent(KindAtomicLoad, addr, size, site)
+}
+
+// AtomicStore is called before an atomic store.
+func AtomicStore(addr unsafe.Pointer, size uintptr, site SiteID) {
+	atomicEvent(KindAtomicStore, addr, size, site)
+}
+
+// AtomicRMW is called before an atomic read-modify-write operation: Add,
+// Swap, CompareAndSwap, And or Or.
+func AtomicRMW(addr unsafe.Pointer, size uintptr, site SiteID) {
+	atomicEvent(KindAtomicRMW, addr, size, site)
+}
+
+// AtomicDone is called with the result v of an atomic load or
+// read-modify-write of addr once it was performed, and returns v.
+func AtomicDone[T any](v T, addr unsafe.Pointer, site SiteID) T {
+	atomicEvent(KindAtomicDone, addr, 0, site)
+	return v
+}
+
+func atomicEvent(kind Kind, addr unsafe.Pointer, size uintptr, site SiteID) {
+	id := goid.Get()
+	yieldEvent(Event{GoID: id, Kind: kind, Addr: uintptr(addr), Size: size, Site: site})
+}
@@ -0,0 +1,93 @@
+package runtime
+
+import (
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/goid"
+)
+
+// --- Channel Hooks ---
+//
+// The instrumenter rewrites channel operations into these hooks, which
+// perform the operation themselves so that the scheduler sees both the
+// point where a goroutine may block and the point where the operation
+// completed:
+//
+//	ch <- v              ChanSend(ch, site).Send(v)
+//	<-ch                 ChanRecv(ch, site)
+//	v, ok := <-ch        v, ok := ChanRecv2(ch, site)
+//	close(ch)            ChanClose(ch, site)
+//	for v := range ch    for { v, ok := ChanRecv2(ch, site); if !ok { break } ... }
+
+// Sender performs an instrumented send on a channel, see ChanSend.
+type Sender[T any] struct {
+	ch   chan<- T
+	site SiteID
+}
+
+// ChanSend prepares an instrumented send on ch. The value is passed to
+// Sender.Send rather than to ChanSend so that it is converted to the element
+// type by assignment, as in a plain send statement, instead of taking part
+// in type inference.
+func ChanSend[T any](ch chan<- T, site SiteID) Sender[T] {
+	return Sender[T]{ch: ch, site: site}
+}
+
+// Send sends v on the channel.
+func (s Sender[T]) Send(v T) {
+	e := chanEvent(KindChanSend, chanAddr(s.ch), cap(s.ch), s.site)
+	yieldEvent(e)
+	perform(e.GoID, func() bool {
+		select {
+		case s.ch <- v:
+			return true
+		default:
+			return false
+		}
+	}, func() { s.ch <- v }, []uintptr{e.Addr}, []Event{e})
+	e.Kind = KindChanSendDone
+	yieldEvent(e)
+}
+
+// ChanRecv receives a value from ch.
+func ChanRecv[T any](ch <-chan T, site SiteID) T {
+	v, _ := ChanRecv2(ch, site)
+	return v
+}
+
+// ChanRecv2 receives a value from ch and reports whether it was sent
+// rather than the zero value of a closed channel.
+func ChanRecv2[T any](ch <-chan T, site SiteID) (T, bool) {
+	e := chanEvent(KindChanRecv, chanAddr(ch), cap(ch), site)
+	yieldEvent(e)
+	var v T
+	var ok bool
+	perform(e.GoID, func() bool {
+		select {
+		case v, ok = <-ch:
+			return true
+		default:
+			return false
+		}
+	}, func() { v, ok = <-ch }, []uintptr{e.Addr}, []Event{e})
+	e.Kind = KindChanRecvDone
+	yieldEvent(e)
+	return v, ok
+}
+
+// ChanClose closes ch.
+func ChanClose[T any](ch chan<- T, site SiteID) {
+	yieldEvent(chanEvent(KindChanClose, chanAddr(ch), cap(ch), site))
+	close(ch)
+}
+
+func chanEvent(kind Kind, addr uintptr, capacity int, site SiteID) Event {
+	id := goid.Get()
+	return Event{GoID: id, Kind: kind, Addr: addr, Arg: uint64(capacity), Site: site}
+}
+
+// chanAddr returns the identity of a channel: a channel value is a single
+// pointer to its runtime representation.
+func chanAddr[C any](ch C) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&ch))
+}
@@ -0,0 +1,409 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Access describes one side of a data race.
+type Access struct {
+	GoID uint64
+	Kind Kind
+	Addr uintptr
+	// Pos is the source position of the access, if known.
+	Pos Position
+	// Created is the stack of the Spawn call that started the goroutine.
+	// It is empty for the main goroutine.
+	Created []Position
+	// Exited reports whether the goroutine had finished when the race was found.
+	Exited bool
+}
+
+// Race describes two conflicting accesses to the same address that are not
+// ordered by happens-before.
+type Race struct {
+	Current  Access
+	Previous Access
+}
+
+func (r Race) String() string {
+	return fmt.Sprintf("data race at %#x: %s by goroutine %d, previous %s by goroutine %d",
+		r.Current.Addr, r.Current.Kind, r.Current.GoID, r.Previous.Kind, r.Previous.GoID)
+}
+
+// granuleSize is the number of bytes tracked by one shadow cell.
+// Accesses are split into the aligned granules they overlap.
+const granuleSize = 8
+
+// shadowAccess is an access kept in a shadow cell, with the bytes of the
+// granule it covers.
+type shadowAccess struct {
+	epoch epoch
+	site  SiteID
+	addr  uintptr // Address the access started at, for reports
+	mask  uint8   // Bytes of the granule accessed
+}
+
+// shadowCell is the FastTrack shadow state of one memory granule: the last
+// write of each byte, and the reads of each byte since that are not
+// ordered before one another. Accesses conflict only if their bytes
+// overlap, so that adjacent small fields or slice elements sharing a
+// granule do not race.
+type shadowCell struct {
+	writes []shadowAccess
+	reads  []shadowAccess
+}
+
+// chanState is the happens-before state of a channel.
+type chanState struct {
+	// sends holds the clocks of sends whose values were not received yet.
+	sends []vectorClock
+	// recvs holds the clocks of started receives that may still order a
+	// later send completion. The first recvBase receives were dropped.
+	recvs    []vectorClock
+	recvBase uint64
+	sent     uint64 // Number of completed sends
+	closed   vectorClock
+}
+
+// raceKey identifies a race by its unordered pair of source locations.
+type raceKey struct {
+	a, b string
+}
+
+// Detector is a FastTrack-style happens-before race detector.
+// It decorates another Strategy: every event is analysed and then handed
+// to the wrapped strategy unchanged, so detection works in any mode.
+type Detector struct {
+	inner Strategy
+	out   io.Writer
+
+	mu     sync.Mutex
+	clocks map[uint64]vectorClock
+	shadow map[uintptr]*shadowCell
+	syncs  map[uintptr]vectorClock
+	chans  map[uintptr]*chanState
+	exited map[uint64]bool
+	seen   map[raceKey]bool
+	races  []Race
+}
+
+// NewDetector wraps inner with race detection.
+// Races are written to out as they are found; out may be nil.
+func NewDetector(inner Strategy, out io.Writer) *Detector {
+	return &Detector{
+		inner:  inner,
+		out:    out,
+		clocks: make(map[uint64]vectorClock),
+		shadow: make(map[uintptr]*shadowCell),
+		syncs:  make(map[uintptr]vectorClock),
+		chans:  make(map[uintptr]*chanState),
+		exited: make(map[uint64]bool),
+		seen:   make(map[raceKey]bool),
+	}
+}
+
+// Unwrap returns the decorated strategy.
+func (d *Detector) Unwrap() Strategy {
+	return d.inner
+}
+
+// Races returns the races found so far, one per distinct pair of access sites.
+func (d *Detector) Races() []Race {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Race(nil), d.races...)
+}
+
+// Choose leaves scheduling decisions to the wrapped strategy.
+func (d *Detector) Choose(enabled []GoroutineState) uint64 {
+	return d.inner.Choose(enabled)
+}
+
+func (d *Detector) RegisterGoroutine(goID uint64) {
+	if t, ok := d.inner.(GoroutineTracker); ok {
+		t.RegisterGoroutine(goID)
+	}
+}
+
+func (d *Detector) UnregisterGoroutine(goID uint64) {
+	if t, ok := d.inner.(GoroutineTracker); ok {
+		t.UnregisterGoroutine(goID)
+	}
+}
+
+func (d *Detector) SetWake(wake func()) {
+	if w, ok := d.inner.(Waker); ok {
+		w.SetWake(wake)
+	}
+}
+
+// OnEvent updates the happens-before state and forwards the event.
+func (d *Detector) OnEvent(e Event) {
+	d.mu.Lock()
+	d.handle(e)
+	d.mu.Unlock()
+	if o, ok := d.inner.(Observer); ok {
+		o.OnEvent(e)
+	}
+}
+
+// ChooseCase forwards select decisions to the wrapped strategy.
+func (d *Detector) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if c, ok := d.inner.(Chooser); ok {
+		return c.ChooseCase(goID, site, ready)
+	}
+	return -1
+}
+
+// OnFinalize prints a summary and finalizes the wrapped strategy.
+func (d *Detector) OnFinalize() {
+	d.mu.Lock()
+	n := len(d.races)
+	d.mu.Unlock()
+	if n > 0 && d.out != nil {
+		fmt.Fprintf(d.out, "moriarty: found %d data race(s)\n", n)
+	}
+	if f, ok := d.inner.(Finalizer); ok {
+		f.OnFinalize()
+	}
+}
+
+func (d *Detector) handle(e Event) {
+	vc := d.clock(e.GoID)
+	switch e.Kind {
+	case KindSpawn:
+		// Everything the parent did so far happens before the child starts.
+		child := vc.copy()
+		child[e.Arg] = 1
+		d.clocks[e.Arg] = child
+		vc[e.GoID]++
+	case KindRead:
+		forEachGranule(e, func(addr uintptr, mask uint8) { d.read(e, addr, mask, vc) })
+	case KindWrite:
+		forEachGranule(e, func(addr uintptr, mask uint8) { d.write(e, addr, mask, vc) })
+	case KindAcquire, KindWait:
+		// Everything released on the object happens before this point.
+		vc.join(d.syncs[e.Addr])
+	case KindRelease, KindSignal:
+		// Releases are merged so that e.g. every WaitGroup.Done and every
+		// RWMutex.RUnlock is ordered before the matching wait or lock.
+		sc, ok := d.syncs[e.Addr]
+		if !ok {
+			sc = make(vectorClock)
+			d.syncs[e.Addr] = sc
+		}
+		sc.join(vc)
+		vc[e.GoID]++
+	case KindChanSend, KindChanSendDone, KindChanRecv, KindChanRecvDone, KindChanClose:
+		d.channel(e, vc)
+	case KindAtomicLoad, KindAtomicStore, KindAtomicRMW, KindAtomicDone:
+		d.atomic(e, vc)
+	case KindGoExit:
+		d.exited[e.GoID] = true
+	}
+}
+
+// channel applies the memory model rules for channels: a send happens
+// before the matching receive completes, a close happens before a receive
+// that returns because the channel is closed, and the k-th receive on a
+// channel with capacity C happens before the (k+C)-th send completes.
+// Values are matched to receives in FIFO order.
+func (d *Detector) channel(e Event, vc vectorClock) {
+	c, ok := d.chans[e.Addr]
+	if !ok {
+		c = &chanState{}
+		d.chans[e.Addr] = c
+	}
+	switch e.Kind {
+	case KindChanSend:
+		c.sends = append(c.sends, vc.copy())
+		vc[e.GoID]++
+	case KindChanRecv:
+		// Nothing can be sent after a close, so receives need not be kept.
+		if c.closed == nil {
+			c.recvs = append(c.recvs, vc.copy())
+		}
+		vc[e.GoID]++
+	case KindChanSendDone:
+		c.sent++
+		if c.sent <= e.Arg {
+			return
+		}
+		k := c.sent - e.Arg - 1 // Index of the receive ordered before this send
+		if k >= c.recvBase && k-c.recvBase < uint64(len(c.recvs)) {
+			i := k - c.recvBase
+			vc.join(c.recvs[i])
+			c.recvs = c.recvs[i+1:]
+			c.recvBase = k + 1
+		}
+	case KindChanRecvDone:
+		if len(c.sends) > 0 {
+			vc.join(c.sends[0])
+			c.sends = c.sends[1:]
+		} else if c.closed != nil {
+			vc.join(c.closed)
+		}
+	case KindChanClose:
+		c.closed = vc.copy()
+		c.recvs = nil
+		vc[e.GoID]++
+	}
+}
+
+// atomic applies the memory model rule for sync/atomic: atomic operations
+// are sequentially consistent, so a store happens before an operation on the
+// same address that observes it. Like releases, stores and read-modify-writes
+// are merged into the address's clock before they are performed, and loads
+// and read-modify-writes join it once they were performed. Atomic accesses
+// are not checked for races.
+func (d *Detector) atomic(e Event, vc vectorClock) {
+	switch e.Kind {
+	case KindAtomicStore, KindAtomicRMW:
+		sc, ok := d.syncs[e.Addr]
+		if !ok {
+			sc = make(vectorClock)
+			d.syncs[e.Addr] = sc
+		}
+		sc.join(vc)
+		vc[e.GoID]++
+	case KindAtomicDone:
+		vc.join(d.syncs[e.Addr])
+	}
+}
+
+// clock returns the vector clock of a goroutine, creating it on first use.
+func (d *Detector) clock(goID uint64) vectorClock {
+	vc, ok := d.clocks[goID]
+	if !ok {
+		vc = vectorClock{goID: 1}
+		d.clocks[goID] = vc
+	}
+	return vc
+}
+
+func (d *Detector) cell(addr uintptr) *shadowCell {
+	c, ok := d.shadow[addr]
+	if !ok {
+		c = &shadowCell{}
+		d.shadow[addr] = c
+	}
+	return c
+}
+
+// forEachGranule calls f with the address of every granule overlapped by
+// the access and the mask of the bytes of the granule it covers. Accesses
+// of unknown size cover a single byte.
+func forEachGranule(e Event, f func(addr uintptr, mask uint8)) {
+	size := e.Size
+	if size == 0 {
+		size = 1
+	}
+	end := e.Addr + size
+	for addr := e.Addr &^ (granuleSize - 1); addr < end; addr += granuleSize {
+		lo := max(e.Addr, addr) - addr
+		hi := min(end, addr+granuleSize) - addr
+		f(addr, uint8(1<<hi-1<<lo))
+	}
+}
+
+func (d *Detector) read(e Event, addr uintptr, mask uint8, vc vectorClock) {
+	c := d.cell(addr)
+	cur := vc.epochOf(e.GoID)
+
+	// Same epoch: nothing new to learn.
+	for _, r := range c.reads {
+		if r.epoch == cur && r.mask&mask == mask {
+			return
+		}
+	}
+
+	for _, w := range c.writes {
+		if w.mask&mask != 0 && !w.epoch.happensBefore(vc) {
+			d.report(e, KindWrite, w)
+		}
+	}
+
+	// Reads ordered before this one need not be kept for the bytes it reads;
+	// concurrent reads are kept alongside it.
+	c.reads = without(c.reads, mask, func(r shadowAccess) bool { return r.epoch.happensBefore(vc) })
+	c.reads = append(c.reads, shadowAccess{epoch: cur, site: e.Site, addr: e.Addr, mask: mask})
+}
+
+func (d *Detector) write(e Event, addr uintptr, mask uint8, vc vectorClock) {
+	c := d.cell(addr)
+	cur := vc.epochOf(e.GoID)
+
+	for _, w := range c.writes {
+		if w.epoch == cur && w.mask&mask == mask {
+			return
+		}
+	}
+
+	for _, w := range c.writes {
+		if w.mask&mask != 0 && !w.epoch.happensBefore(vc) {
+			d.report(e, KindWrite, w)
+		}
+	}
+	for _, r := range c.reads {
+		if r.mask&mask != 0 && !r.epoch.happensBefore(vc) {
+			d.report(e, KindRead, r)
+			break
+		}
+	}
+
+	// The write replaces all earlier accesses to the bytes it writes.
+	all := func(shadowAccess) bool { return true }
+	c.writes = without(c.writes, mask, all)
+	c.reads = without(c.reads, mask, all)
+	c.writes = append(c.writes, shadowAccess{epoch: cur, site: e.Site, addr: e.Addr, mask: mask})
+}
+
+// without removes the bytes in mask from the accesses drop reports true
+// for, deleting the accesses left without bytes.
+func without(accesses []shadowAccess, mask uint8, drop func(shadowAccess) bool) []shadowAccess {
+	kept := accesses[:0]
+	for _, a := range accesses {
+		if a.mask&mask != 0 && drop(a) {
+			a.mask &^= mask
+		}
+		if a.mask != 0 {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// report records a race unless one between the same pair of sites was already seen.
+func (d *Detector) report(e Event, prevKind Kind, p shadowAccess) {
+	cur := Access{GoID: e.GoID, Kind: e.Kind, Addr: e.Addr, Pos: sitePosition(e.Site)}
+	prev := Access{GoID: p.epoch.goID, Kind: prevKind, Addr: p.addr, Pos: sitePosition(p.site)}
+
+	a, b := siteOf(cur), siteOf(prev)
+	if b < a {
+		a, b = b, a
+	}
+	key := raceKey{a: a, b: b}
+	if d.seen[key] {
+		return
+	}
+	d.seen[key] = true
+
+	cur.Created, cur.Exited = creationStack(cur.GoID), d.exited[cur.GoID]
+	prev.Created, prev.Exited = creationStack(prev.GoID), d.exited[prev.GoID]
+	r := Race{Current: cur, Previous: prev}
+	d.races = append(d.races, r)
+	if d.out != nil {
+		WriteReport(d.out, r)
+	}
+}
+
+// siteOf names the source location of an access for deduplication.
+// Accesses without a known position fall back to their address.
+func siteOf(a Access) string {
+	if a.Pos.File == "" {
+		return fmt.Sprintf("%#x", a.Addr)
+	}
+	return a.Pos.String()
+}
@@ -0,0 +1,328 @@
+package runtime_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// nopStrategy lets goroutines proceed in the order they stop without
+// recording anything.
+type nopStrategy struct{}
+
+func (nopStrategy) Choose(enabled []runtime.GoroutineState) uint64 { return enabled[0].ID }
+
+func runDetector(events []runtime.Event) []runtime.Race {
+	d := runtime.NewDetector(nopStrategy{}, nil)
+	for _, e := range events {
+		d.OnEvent(e)
+	}
+	return d.Races()
+}
+
+func TestDetectorConcurrentWrites(t *testing.T) {
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 3},
+		{GoID: 2, Kind: runtime.KindGoEnter},
+		{GoID: 3, Kind: runtime.KindGoEnter},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 3, Kind: runtime.KindWrite, Addr: 0x100},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+	r := races[0]
+	if r.Current.GoID != 3 || r.Previous.GoID != 2 {
+		t.Errorf("Expected race between goroutines 3 and 2, got %v", r)
+	}
+	if r.Current.Kind != runtime.KindWrite || r.Previous.Kind != runtime.KindWrite {
+		t.Errorf("Expected write/write race, got %v", r)
+	}
+}
+
+func TestDetectorSpawnOrdersAccesses(t *testing.T) {
+	// The parent's write happens before the spawn, so the child's read is ordered.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 2, Kind: runtime.KindGoEnter},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 0x100},
+	})
+
+	if len(races) != 0 {
+		t.Errorf("Expected no races, got %v", races)
+	}
+}
+
+func TestDetectorParentAfterSpawn(t *testing.T) {
+	// A parent write after the spawn is concurrent with the child's read.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 2, Kind: runtime.KindGoEnter},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 0x100},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+	if races[0].Current.Kind != runtime.KindRead || races[0].Previous.Kind != runtime.KindWrite {
+		t.Errorf("Expected read after write race, got %v", races[0])
+	}
+}
+
+func TestDetectorSharedReads(t *testing.T) {
+	// Concurrent reads are fine, but a later unordered write races with them.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 3},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 0x100},
+		{GoID: 3, Kind: runtime.KindRead, Addr: 0x100},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+	if races[0].Current.Kind != runtime.KindWrite || races[0].Previous.Kind != runtime.KindRead {
+		t.Errorf("Expected write after read race, got %v", races[0])
+	}
+}
+
+func TestDetectorDeduplicatesSites(t *testing.T) {
+	// Repeated racy accesses to the same address from the same sites are reported once.
+	var events []runtime.Event
+	events = append(events,
+		runtime.Event{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		runtime.Event{GoID: 1, Kind: runtime.KindSpawn, Arg: 3},
+	)
+	for i := 0; i < 10; i++ {
+		events = append(events,
+			runtime.Event{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+			runtime.Event{GoID: 3, Kind: runtime.KindWrite, Addr: 0x100},
+		)
+	}
+
+	races := runDetector(events)
+	if len(races) != 1 {
+		t.Errorf("Expected 1 deduplicated race, got %d", len(races))
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	r := runtime.Race{
+		Current: runtime.Access{
+			GoID: 3, Kind: runtime.KindWrite, Addr: 0x100,
+			Pos:     runtime.Position{Func: "main.increment", File: "race.go", Line: 14},
+			Created: []runtime.Position{{Func: "main.main", File: "race.go", Line: 25}},
+		},
+		Previous: runtime.Access{
+			GoID: 2, Kind: runtime.KindRead, Addr: 0x100, Exited: true,
+			Pos:     runtime.Position{Func: "main.increment", File: "race.go", Line: 14},
+			Created: []runtime.Position{{Func: "main.main", File: "race.go", Line: 24}},
+		},
+	}
+
+	var buf bytes.Buffer
+	runtime.WriteReport(&buf, r)
+	report := buf.String()
+
+	for _, want := range []string{
+		"WARNING: DATA RACE",
+		"Write at 0x100 by goroutine 3:",
+		"Previous read at 0x100 by goroutine 2:",
+		"main.increment()\n      race.go:14",
+		"Goroutine 3 (running) created at:\n  main.main()\n      race.go:25",
+		"Goroutine 2 (finished) created at:\n  main.main()\n      race.go:24",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, report)
+		}
+	}
+}
+
+func TestDetectorRangeOverlapsField(t *testing.T) {
+	// A whole-struct write overlaps a concurrent read of its second field.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100, Size: 16},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 0x108, Size: 8},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 0x110, Size: 8},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+	if races[0].Current.Addr != 0x108 {
+		t.Errorf("Expected race at 0x108, got %v", races[0])
+	}
+}
+
+func TestDetectorDistinctBytesInGranule(t *testing.T) {
+	// Writes to adjacent int32 elements share a granule but not their bytes,
+	// while a read of the first element races with its write.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 3},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100, Size: 4},
+		{GoID: 3, Kind: runtime.KindWrite, Addr: 0x104, Size: 4},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x102, Size: 2},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+	if r := races[0]; r.Previous.GoID != 2 || r.Current.Addr != 0x102 || r.Previous.Addr != 0x100 {
+		t.Errorf("Expected a race between the read at 0x102 and the write at 0x100, got %v", r)
+	}
+}
+
+func TestDetectorLockOrdersAccesses(t *testing.T) {
+	// Accesses inside critical sections of the same mutex are ordered.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindAcquire, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 1, Kind: runtime.KindRelease, Addr: 0x200},
+		{GoID: 2, Kind: runtime.KindAcquire, Addr: 0x200},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 2, Kind: runtime.KindRelease, Addr: 0x200},
+		// A different mutex does not order anything.
+		{GoID: 1, Kind: runtime.KindAcquire, Addr: 0x300},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x100},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+	if races[0].Current.GoID != 1 || races[0].Previous.GoID != 2 {
+		t.Errorf("Expected race between goroutines 1 and 2, got %v", races[0])
+	}
+}
+
+func TestDetectorSignalsMerge(t *testing.T) {
+	// A wait is ordered after every signal before it, like WaitGroup.Done.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 3},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 2, Kind: runtime.KindSignal, Addr: 0x200},
+		{GoID: 3, Kind: runtime.KindWrite, Addr: 0x108},
+		{GoID: 3, Kind: runtime.KindSignal, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindWait, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x100},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x108},
+	})
+
+	if len(races) != 0 {
+		t.Errorf("Expected no races, got %v", races)
+	}
+}
+
+func TestDetectorChannelOrdersAccesses(t *testing.T) {
+	// A send happens before the matching receive completes, and on an
+	// unbuffered channel the receive happens before the send completes.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 2, Kind: runtime.KindChanSend, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x108},
+		{GoID: 1, Kind: runtime.KindChanRecv, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindChanRecvDone, Addr: 0x200},
+		{GoID: 2, Kind: runtime.KindChanSendDone, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x100},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 0x108},
+	})
+
+	if len(races) != 0 {
+		t.Errorf("Expected no races, got %v", races)
+	}
+}
+
+func TestDetectorBufferedChannelSemaphore(t *testing.T) {
+	// With capacity 1, the first receive happens before the second send
+	// completes, so the channel works as a lock.
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindChanSend, Addr: 0x200, Arg: 1},
+		{GoID: 1, Kind: runtime.KindChanSendDone, Addr: 0x200, Arg: 1},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 1, Kind: runtime.KindChanRecv, Addr: 0x200, Arg: 1},
+		{GoID: 1, Kind: runtime.KindChanRecvDone, Addr: 0x200, Arg: 1},
+		{GoID: 2, Kind: runtime.KindChanSend, Addr: 0x200, Arg: 1},
+		{GoID: 2, Kind: runtime.KindChanSendDone, Addr: 0x200, Arg: 1},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+	})
+	if len(races) != 0 {
+		t.Errorf("Expected no races with capacity 1, got %v", races)
+	}
+
+	// With capacity 2, both sends complete without waiting for a receive.
+	races = runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 1, Kind: runtime.KindChanSend, Addr: 0x200, Arg: 2},
+		{GoID: 1, Kind: runtime.KindChanSendDone, Addr: 0x200, Arg: 2},
+		{GoID: 1, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 1, Kind: runtime.KindChanRecv, Addr: 0x200, Arg: 2},
+		{GoID: 1, Kind: runtime.KindChanRecvDone, Addr: 0x200, Arg: 2},
+		{GoID: 2, Kind: runtime.KindChanSend, Addr: 0x200, Arg: 2},
+		{GoID: 2, Kind: runtime.KindChanSendDone, Addr: 0x200, Arg: 2},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+	})
+	if len(races) != 1 {
+		t.Errorf("Expected 1 race with capacity 2, got %v", races)
+	}
+}
+
+func TestDetectorCloseOrdersReceive(t *testing.T) {
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100},
+		{GoID: 2, Kind: runtime.KindChanClose, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindChanRecv, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindChanRecvDone, Addr: 0x200},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x100},
+	})
+
+	if len(races) != 0 {
+		t.Errorf("Expected no races, got %v", races)
+	}
+}
+
+func TestDetectorAtomicsOrderAccesses(t *testing.T) {
+	const data, flag = 0x100, 0x200
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 2, Kind: runtime.KindGoEnter},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: data},
+		{GoID: 2, Kind: runtime.KindAtomicStore, Addr: flag},
+		{GoID: 1, Kind: runtime.KindAtomicLoad, Addr: flag},
+		{GoID: 1, Kind: runtime.KindAtomicDone, Addr: flag},
+		{GoID: 1, Kind: runtime.KindRead, Addr: data},
+	})
+
+	if len(races) != 0 {
+		t.Fatalf("Expected no races, got %v", races)
+	}
+}
+
+func TestDetectorAtomicLoadBeforeStore(t *testing.T) {
+	const data, flag = 0x100, 0x200
+	races := runDetector([]runtime.Event{
+		{GoID: 1, Kind: runtime.KindSpawn, Arg: 2},
+		{GoID: 2, Kind: runtime.KindGoEnter},
+		{GoID: 1, Kind: runtime.KindAtomicLoad, Addr: flag},
+		{GoID: 1, Kind: runtime.KindAtomicDone, Addr: flag},
+		{GoID: 2, Kind: runtime.KindWrite, Addr: data},
+		{GoID: 2, Kind: runtime.KindAtomicStore, Addr: flag},
+		{GoID: 1, Kind: runtime.KindRead, Addr: data},
+	})
+
+	if len(races) != 1 {
+		t.Fatalf("Expected 1 race, got %d: %v", len(races), races)
+	}
+}
@@ -0,0 +1,210 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// divergenceContext is the number of replayed events shown before a
+// divergence.
+const divergenceContext = 16
+
+// DivergenceExitCode is the exit status of a program whose replay was
+// aborted because it diverged from the trace.
+const DivergenceExitCode = 3
+
+// DivergencePolicy decides what happens when a program being replayed
+// produces an event that does not match the trace.
+type DivergencePolicy uint8
+
+const (
+	// DivergenceAbort reports the divergence and exits with
+	// DivergenceExitCode.
+	DivergenceAbort DivergencePolicy = iota
+	// DivergenceWarn reports the divergence and lets the program continue
+	// without following the trace.
+	DivergenceWarn
+	// DivergenceRecord behaves like DivergenceWarn and records the run to a
+	// new trace: the events replayed up to the divergence, then the events
+	// of the free-running program.
+	DivergenceRecord
+)
+
+func (p DivergencePolicy) String() string {
+	switch p {
+	case DivergenceAbort:
+		return "abort"
+	case DivergenceWarn:
+		return "warn"
+	case DivergenceRecord:
+		return "record"
+	default:
+		return fmt.Sprintf("DivergencePolicy(%d)", p)
+	}
+}
+
+// ParseDivergencePolicy returns the policy named s: "abort", "warn" or
+// "record".
+func ParseDivergencePolicy(s string) (DivergencePolicy, error) {
+	switch s {
+	case "abort":
+		return DivergenceAbort, nil
+	case "warn":
+		return DivergenceWarn, nil
+	case "record":
+		return DivergenceRecord, nil
+	}
+	return 0, fmt.Errorf("unknown divergence policy %q", s)
+}
+
+// Divergence describes the first event of a replayed program that did not
+// match the trace.
+type Divergence struct {
+	Index    uint64  // Number of events replayed before the divergence
+	Expected Event   // Event of the goroutine in the trace
+	Actual   Event   // Event the goroutine produced instead
+	Recent   []Event // Last events replayed before the divergence, oldest first
+}
+
+// Report writes a description of the divergence to w.
+func (d *Divergence) Report(w io.Writer) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "moriarty: replay diverged from the trace at event %d\n", d.Index)
+	fmt.Fprintf(&b, "  expected: %s\n", describeEvent(d.Expected))
+	fmt.Fprintf(&b, "  actual:   %s\n", describeEvent(d.Actual))
+	if len(d.Recent) > 0 {
+		fmt.Fprintf(&b, "  last %d replayed events:\n", len(d.Recent))
+		first := d.Index - uint64(len(d.Recent))
+		for i, e := range d.Recent {
+			fmt.Fprintf(&b, "    %d: %s\n", first+uint64(i), describeEvent(e))
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+// describeEvent formats e with the goroutine, kind and site of the event.
+func describeEvent(e Event) string {
+	s := fmt.Sprintf("goroutine %d %v", e.GoID, e.Kind)
+	if site, ok := LookupSite(e.Site); ok {
+		if site.Expr != "" {
+			s += " " + site.Expr
+		}
+		s += " at " + site.position().String()
+	}
+	return s
+}
+
+// diverger applies a DivergencePolicy on behalf of a strategy following a
+// trace. The strategy reports every event it replays as recorded, and the
+// first event that does not match the trace.
+type diverger struct {
+	policy    DivergencePolicy
+	traceFile string // trace written under DivergenceRecord
+	out       io.Writer
+
+	replayed uint64
+	recent   [divergenceContext]Event
+
+	diverged   atomic.Bool
+	divergence *Divergence
+
+	mu sync.Mutex
+	w  *TraceWriter // trace of the diverged run, nil if not recording
+}
+
+func newDiverger(policy DivergencePolicy, traceFile string) *diverger {
+	return &diverger{policy: policy, traceFile: traceFile, out: os.Stderr}
+}
+
+// replay notes that e was replayed as recorded.
+func (d *diverger) replay(e Event) {
+	d.recent[d.replayed%divergenceContext] = e
+	d.replayed++
+}
+
+// aborting reports whether the program is exiting after a divergence. It may
+// be called from any goroutine.
+func (d *diverger) aborting() bool {
+	return d.policy == DivergenceAbort && d.diverged.Load()
+}
+
+// matches reports whether the goroutine producing actual follows the trace,
+// which expected it to produce expected. Sites are compared only if the
+// trace has them.
+func matches(expected, actual Event) bool {
+	return expected.Kind == actual.Kind && (expected.Site == 0 || expected.Site == actual.Site)
+}
+
+// diverge reports the divergence of actual from expected and applies the
+// policy. Under DivergenceRecord, prefix writes the events replayed so far
+// to the new trace.
+func (d *diverger) diverge(expected, actual Event, prefix func(w *TraceWriter) error) {
+	n := min(d.replayed, divergenceContext)
+	recent := make([]Event, 0, n)
+	for i := d.replayed - n; i < d.replayed; i++ {
+		recent = append(recent, d.recent[i%divergenceContext])
+	}
+	d.divergence = &Divergence{Index: d.replayed, Expected: expected, Actual: actual, Recent: recent}
+	d.divergence.Report(d.out)
+	d.diverged.Store(true)
+
+	switch d.policy {
+	case DivergenceAbort:
+		// Exit finalizes the runtime, which needs the event loop this is
+		// called from.
+		go Exit(DivergenceExitCode)
+	case DivergenceRecord:
+		if err := d.record(prefix); err != nil {
+			fmt.Fprintf(d.out, "moriarty: %v\n", err)
+		} else {
+			fmt.Fprintf(d.out, "moriarty: recording the rest of the run to %s\n", d.traceFile)
+		}
+	}
+}
+
+// record starts the trace of the diverged run.
+func (d *diverger) record(prefix func(w *TraceWriter) error) error {
+	w, err := CreateTrace(d.traceFile, TraceOptions{Header: NewTraceHeader("replay", 0)})
+	if err != nil {
+		return err
+	}
+	if err := prefix(w); err != nil {
+		w.Close()
+		return err
+	}
+	d.mu.Lock()
+	d.w = w
+	d.mu.Unlock()
+	return nil
+}
+
+// free records e, produced after the divergence, if the run is recorded.
+func (d *diverger) free(e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w == nil {
+		return
+	}
+	if err := d.w.Write(e); err != nil {
+		fmt.Fprintf(d.out, "moriarty: %v\n", err)
+		d.w.Close()
+		d.w = nil
+	}
+}
+
+// close finishes the trace of the diverged run.
+func (d *diverger) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w == nil {
+		return
+	}
+	if err := d.w.Close(); err != nil {
+		fmt.Fprintf(d.out, "moriarty: %v\n", err)
+	}
+	d.w = nil
+}
@@ -9,6 +9,35 @@ const (
 	KindSpawn
 	KindGoEnter
 	KindGoExit
+	KindAcquire // Lock-style acquire of the synchronization object at Addr
+	KindRelease // Lock-style release of the synchronization object at Addr
+	KindWait    // Return from a blocking wait on the object at Addr
+	KindSignal  // Wake-up of goroutines waiting on the object at Addr
+
+	// Channel operations are reported before they start, when the goroutine
+	// may block, and again once they completed. Addr identifies the channel
+	// and Arg holds its capacity.
+	KindChanSend
+	KindChanSendDone
+	KindChanRecv
+	KindChanRecvDone
+	KindChanClose
+	KindSelect // Select statement finished; Arg is the taken case, or the number of cases for default
+
+	// Operations of package sync/atomic on the Size bytes at Addr, reported
+	// before they are performed. Loads and read-modify-writes are reported
+	// again with KindAtomicDone once they were performed.
+	KindAtomicLoad
+	KindAtomicStore
+	KindAtomicRMW // Add, Swap, CompareAndSwap, And and Or
+	KindAtomicDone
+
+	KindPanic // Goroutine is ending with a panic; Value holds the panic value
+
+	// Acquisitions and waits that may block are reported before they start,
+	// as well as with KindAcquire and KindWait once they completed.
+	KindBeginAcquire
+	KindBeginWait
 )
 
 func (k Kind) String() string {
@@ -23,6 +52,40 @@ func (k Kind) String() string {
 		return "enter"
 	case KindGoExit:
 		return "exit"
+	case KindAcquire:
+		return "acquire"
+	case KindRelease:
+		return "release"
+	case KindWait:
+		return "wait"
+	case KindSignal:
+		return "signal"
+	case KindChanSend:
+		return "send"
+	case KindChanSendDone:
+		return "send-done"
+	case KindChanRecv:
+		return "recv"
+	case KindChanRecvDone:
+		return "recv-done"
+	case KindChanClose:
+		return "close"
+	case KindSelect:
+		return "select"
+	case KindAtomicLoad:
+		return "atomic-load"
+	case KindAtomicStore:
+		return "atomic-store"
+	case KindAtomicRMW:
+		return "atomic-rmw"
+	case KindAtomicDone:
+		return "atomic-done"
+	case KindPanic:
+		return "panic"
+	case KindBeginAcquire:
+		return "begin-acquire"
+	case KindBeginWait:
+		return "begin-wait"
 	default:
 		return "unknown"
 	}
@@ -32,5 +95,10 @@ func (k Kind) String() string {
 type Event struct {
 	GoID uint64  `json:"goid"`
 	Kind Kind    `json:"kind"`
-	Addr uintptr `json:"addr,omitempty"` // Memory address for read/write events
+	Addr uintptr `json:"addr,omitempty"` // Memory address for read/write events, object or channel address for synchronization events
+	Size uintptr `json:"size,omitempty"` // Number of bytes accessed by read/write and atomic events
+	Arg  uint64  `json:"arg,omitempty"`  // Kind-specific argument: child goroutine ID for spawn events, capacity for channel events
+	Site SiteID  `json:"site,omitempty"` // Instrumented source location, see LookupSite
+	// Value is the formatted panic value of panic events.
+	Value string `json:"value,omitempty"`
 }
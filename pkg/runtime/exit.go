@@ -0,0 +1,66 @@
+package runtime
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// --- Exit Hooks ---
+//
+// os.Exit and log.Fatal end the program without running deferred calls, so
+// the instrumenter rewrites them into these hooks, which finalize the
+// runtime first:
+//
+//	os.Exit(code)          Exit(code)
+//	log.Fatalf(format, v)  Fatalf(log.Default(), format, v)
+//	l.Fatal(v)             Fatal(l, v)
+
+// RaceExitCode is the status code a program that found data races exits
+// with instead of 0, as under the Go race detector.
+const RaceExitCode = 66
+
+// Exit finalizes the runtime and exits with the given status code, or with
+// RaceExitCode if it is 0 and data races were found.
+func Exit(code int) {
+	finalize()
+	if code == 0 && racesFound() {
+		code = RaceExitCode
+	}
+	os.Exit(code)
+}
+
+// racesFound reports whether the race detector, if the scheduling strategy
+// has one, found data races.
+func racesFound() bool {
+	s := GetStrategy()
+	for s != nil {
+		if d, ok := s.(*Detector); ok {
+			return len(d.Races()) > 0
+		}
+		u, ok := s.(interface{ Unwrap() Strategy })
+		if !ok {
+			return false
+		}
+		s = u.Unwrap()
+	}
+	return false
+}
+
+// Fatal is the instrumented form of log.Fatal and log.Logger.Fatal.
+func Fatal(l *log.Logger, v ...any) {
+	l.Output(2, fmt.Sprint(v...))
+	Exit(1)
+}
+
+// Fatalf is the instrumented form of log.Fatalf and log.Logger.Fatalf.
+func Fatalf(l *log.Logger, format string, v ...any) {
+	l.Output(2, fmt.Sprintf(format, v...))
+	Exit(1)
+}
+
+// Fatalln is the instrumented form of log.Fatalln and log.Logger.Fatalln.
+func Fatalln(l *log.Logger, v ...any) {
+	l.Output(2, fmt.Sprintln(v...))
+	Exit(1)
+}
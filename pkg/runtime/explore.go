@@ -0,0 +1,248 @@
+package runtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefixWait is how long ExploreStrategy waits for the goroutine its
+// schedule lets proceed next to stop, before it gives up on the schedule.
+const prefixWait = 100 * time.Millisecond
+
+// maxExploreRun is how many steps in a row ExploreStrategy lets a goroutine
+// proceed past its schedule while others are enabled, so that a goroutine
+// busy-waiting for another one does not spin forever.
+const maxExploreRun = 1000
+
+// ScheduleStep is a scheduling decision of a run: the goroutines that were
+// enabled, with the events they stopped at, and the one that proceeded.
+type ScheduleStep struct {
+	Enabled []GoroutineState `json:"enabled"`
+	Chosen  uint64           `json:"chosen"`
+}
+
+// Event returns the event of the goroutine that proceeded.
+func (s ScheduleStep) Event() Event {
+	for _, g := range s.Enabled {
+		if g.ID == s.Chosen {
+			return g.Event
+		}
+	}
+	return Event{}
+}
+
+// ExploreStrategy lets goroutines proceed in the order given by a schedule,
+// the IDs of the goroutines chosen at the first steps of the run. Past the
+// schedule it keeps running the goroutine that ran last while it is enabled,
+// and otherwise the enabled goroutine with the lowest ID, so that the run
+// only switches goroutines where the schedule does, or where a goroutine
+// ran for maxExploreRun steps while others were enabled. Every decision is
+// written to a schedule log, from which an exploration driver derives the
+// schedules of the next runs.
+//
+// If the goroutine the schedule names does not stop, the run deviates from
+// the schedule and continues as past its end.
+type ExploreStrategy struct {
+	schedule []uint64
+	step     int
+	last     uint64    // goroutine chosen at the last step
+	run      int       // steps in a row last was chosen
+	missed   time.Time // since when the scheduled goroutine is awaited
+	retry    *time.Timer
+	deviated bool
+	wake     func()
+
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error // first write error, reported at finalization
+}
+
+// NewExploreStrategy creates a strategy following schedule that writes its
+// decisions to logFile, after header.
+func NewExploreStrategy(schedule []uint64, logFile string, header *TraceHeader) (*ExploreStrategy, error) {
+	f, err := os.Create(logFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &ExploreStrategy{schedule: schedule, wake: func() {}, f: f, w: bufio.NewWriter(f)}
+	s.enc = json.NewEncoder(s.w)
+	if err := s.enc.Encode(jsonHeader{header}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write schedule log header: %w", err)
+	}
+	return s, nil
+}
+
+func (s *ExploreStrategy) SetWake(wake func()) {
+	s.wake = wake
+}
+
+// Choose lets the goroutine the schedule names proceed.
+func (s *ExploreStrategy) Choose(enabled []GoroutineState) uint64 {
+	id := s.choose(enabled)
+	if id == 0 {
+		return 0
+	}
+	s.step++
+	if id == s.last {
+		s.run++
+	} else {
+		s.last, s.run = id, 1
+	}
+	s.log(ScheduleStep{Enabled: enabled, Chosen: id})
+	return id
+}
+
+func (s *ExploreStrategy) choose(enabled []GoroutineState) uint64 {
+	isEnabled := func(id uint64) bool {
+		return slices.ContainsFunc(enabled, func(g GoroutineState) bool { return g.ID == id })
+	}
+	if !s.deviated && s.step < len(s.schedule) {
+		id := s.schedule[s.step]
+		if isEnabled(id) {
+			s.missed = time.Time{}
+			return id
+		}
+		if s.missed.IsZero() {
+			s.missed = time.Now()
+		}
+		if wait := prefixWait - time.Since(s.missed); wait > 0 {
+			if s.retry == nil {
+				s.retry = time.AfterFunc(wait, func() { s.wake() })
+			} else {
+				s.retry.Reset(wait)
+			}
+			return 0
+		}
+		s.deviated = true
+		fmt.Fprintf(os.Stderr, "moriarty: goroutine %d did not stop for step %d of the schedule, leaving the schedule\n", id, s.step)
+	}
+	if isEnabled(s.last) && (s.run < maxExploreRun || len(enabled) == 1) {
+		return s.last
+	}
+	ids := make([]uint64, len(enabled))
+	for i, g := range enabled {
+		ids[i] = g.ID
+	}
+	slices.Sort(ids)
+	if s.run >= maxExploreRun {
+		// Pass on to the goroutine following the last one by ID.
+		if i := slices.IndexFunc(ids, func(id uint64) bool { return id > s.last }); i >= 0 {
+			return ids[i]
+		}
+	}
+	return ids[0]
+}
+
+// log appends step to the schedule log. The log is flushed at every step,
+// so that it is complete up to the last step even if the program hangs or
+// crashes.
+func (s *ExploreStrategy) log(step ScheduleStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil || s.err != nil {
+		return
+	}
+	if s.err = s.enc.Encode(step); s.err == nil {
+		s.err = s.w.Flush()
+	}
+}
+
+// ChooseCase takes the first ready case, so that runs with the same schedule
+// take the same cases.
+func (s *ExploreStrategy) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if len(ready) == 0 {
+		return -1
+	}
+	return ready[0]
+}
+
+// OnFinalize closes the schedule log.
+func (s *ExploreStrategy) OnFinalize() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return
+	}
+	err := s.err
+	if flushErr := s.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	s.f = nil
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: failed to write schedule log: %v\n", err)
+	}
+}
+
+// SaveSchedule writes a schedule, the IDs of the goroutines to choose at the
+// first steps of a run, to filename.
+func SaveSchedule(filename string, schedule []uint64) error {
+	var b strings.Builder
+	for i, id := range schedule {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(strconv.FormatUint(id, 10))
+	}
+	b.WriteByte('\n')
+	return os.WriteFile(filename, []byte(b.String()), 0644)
+}
+
+// LoadSchedule reads a schedule written by SaveSchedule.
+func LoadSchedule(filename string) ([]uint64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var schedule []uint64
+	for _, field := range strings.Fields(string(data)) {
+		id, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %s: %w", filename, err)
+		}
+		schedule = append(schedule, id)
+	}
+	return schedule, nil
+}
+
+// ReadScheduleLog reads the header and steps of a schedule log written by
+// ExploreStrategy. A log cut short in the middle of a step, because the
+// program was killed, ends with the last complete step.
+func ReadScheduleLog(filename string) (*TraceHeader, []ScheduleStep, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+
+	var h jsonHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, nil, fmt.Errorf("invalid schedule log %s: %w", filename, err)
+	}
+	var steps []ScheduleStep
+	for {
+		var step ScheduleStep
+		if err := dec.Decode(&step); err != nil {
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				return h.Header, steps, nil
+			}
+			return nil, nil, fmt.Errorf("invalid schedule log %s: %w", filename, err)
+		}
+		steps = append(steps, step)
+	}
+}
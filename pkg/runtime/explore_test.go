@@ -0,0 +1,74 @@
+package runtime_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+func TestExploreFollowsSchedule(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "log")
+	s, err := runtime.NewExploreStrategy([]uint64{2, 1}, logFile, runtime.NewTraceHeader("explore", 0))
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %v", err)
+	}
+	var chosen []uint64
+	for range 4 {
+		chosen = append(chosen, s.Choose(enabledGoroutines(1, 2, 3)))
+	}
+	s.OnFinalize()
+	// Past the schedule the last goroutine keeps running.
+	if want := []uint64{2, 1, 1, 1}; !slices.Equal(chosen, want) {
+		t.Errorf("Expected %v, got %v", want, chosen)
+	}
+
+	header, steps, err := runtime.ReadScheduleLog(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read schedule log: %v", err)
+	}
+	if header == nil || header.Mode != "explore" {
+		t.Errorf("Expected an explore header, got %+v", header)
+	}
+	if len(steps) != 4 {
+		t.Fatalf("Expected 4 logged steps, got %d", len(steps))
+	}
+	for i, step := range steps {
+		if step.Chosen != chosen[i] || len(step.Enabled) != 3 {
+			t.Errorf("Step %d: expected goroutine %d chosen among 3, got %+v", i, chosen[i], step)
+		}
+	}
+}
+
+func TestExplorePreemptsLongRuns(t *testing.T) {
+	s, err := runtime.NewExploreStrategy(nil, filepath.Join(t.TempDir(), "log"), nil)
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %v", err)
+	}
+	defer s.OnFinalize()
+	switched := 0
+	for range 5000 {
+		if s.Choose(enabledGoroutines(1, 2)) == 2 {
+			switched++
+		}
+	}
+	if switched == 0 || switched == 5000 {
+		t.Errorf("Expected both goroutines to run in 5000 steps, goroutine 2 ran %d", switched)
+	}
+}
+
+func TestScheduleRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schedule")
+	schedule := []uint64{1, 3, 2, 2}
+	if err := runtime.SaveSchedule(file, schedule); err != nil {
+		t.Fatalf("Failed to save schedule: %v", err)
+	}
+	got, err := runtime.LoadSchedule(file)
+	if err != nil {
+		t.Fatalf("Failed to load schedule: %v", err)
+	}
+	if !slices.Equal(got, schedule) {
+		t.Errorf("Expected %v, got %v", schedule, got)
+	}
+}
@@ -0,0 +1,155 @@
+package runtime
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// TraceVersion is the version of the event stream written to traces. It is
+// incremented whenever the meaning of recorded events changes, so that
+// traces recorded by a newer runtime are not misread.
+const TraceVersion = 2
+
+// modulePath is the path of the moriarty module, used to find its version
+// in the build information of instrumented programs.
+const modulePath = "github.com/amirkhaki/moriarty"
+
+// ErrTraceMismatch is returned when a trace was recorded from a different
+// program, or by an incompatible runtime, than the one replaying it.
+var ErrTraceMismatch = errors.New("trace does not match the program")
+
+// TraceHeader identifies the program and run a trace was recorded from. It
+// is written before the first event of a trace.
+type TraceHeader struct {
+	Version  int       `json:"version"`        // TraceVersion of the recording runtime
+	Program  string    `json:"program"`        // ProgramHash of the recorded program
+	Moriarty string    `json:"moriarty"`       // Version of the moriarty module
+	Mode     string    `json:"mode"`           // MORIARTY_MODE of the run
+	Seed     int64     `json:"seed,omitempty"` // Seed of the run, for modes using one
+	Args     []string  `json:"args"`           // Command line of the run
+	Time     time.Time `json:"time"`           // Start of the recording
+
+	PCT *PCTHeader `json:"pct,omitempty"` // Parameters of a PCT run
+}
+
+// NewTraceHeader returns the header for a trace recorded by the running
+// program in the given mode.
+func NewTraceHeader(mode string, seed int64) *TraceHeader {
+	return &TraceHeader{
+		Version:  TraceVersion,
+		Program:  ProgramHash(),
+		Moriarty: moriartyVersion(),
+		Mode:     mode,
+		Seed:     seed,
+		Args:     os.Args,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// ProgramHash returns a hash of the site tables registered by the running
+// program. Site tables are generated from the instrumented source, so two
+// builds of the same source share a hash, while most changes to the source
+// alter it. Files are hashed by their path in their module, as recorded by
+// the instrumenter, so that builds in different checkouts share a hash too.
+// It must be called after package initialization, when all tables are
+// registered.
+func ProgramHash() string {
+	sitesMu.RLock()
+	defer sitesMu.RUnlock()
+	h := sha256.New()
+	var buf []byte
+	for _, s := range sites[1:] {
+		buf = buf[:0]
+		for _, str := range []string{s.Path, s.Func, s.Expr} {
+			buf = binary.AppendUvarint(buf, uint64(len(str)))
+			buf = append(buf, str...)
+		}
+		buf = binary.AppendUvarint(buf, uint64(s.Line))
+		buf = binary.AppendUvarint(buf, uint64(s.Column))
+		buf = append(buf, byte(s.Kind))
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// moriartyVersion returns the version of the moriarty module the running
+// program was built with.
+func moriartyVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(unknown)"
+	}
+	if bi.Main.Path == modulePath {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+// Check compares the header of a trace with the running program. It returns
+// an error wrapping ErrTraceMismatch if the trace was recorded from another
+// program or by a newer runtime, and warnings for differences that do not
+// prevent reading the trace.
+func (h *TraceHeader) Check() (warnings []string, err error) {
+	if h == nil {
+		return []string{"trace has no header, it cannot be checked against the program"}, nil
+	}
+	if h.Version > TraceVersion {
+		return nil, fmt.Errorf("%w: trace version %d is newer than the supported version %d",
+			ErrTraceMismatch, h.Version, TraceVersion)
+	}
+	if p := ProgramHash(); h.Program != p {
+		return nil, fmt.Errorf("%w: trace was recorded from program %.12s, this is %.12s",
+			ErrTraceMismatch, h.Program, p)
+	}
+	if v := moriartyVersion(); h.Moriarty != v {
+		warnings = append(warnings, fmt.Sprintf("trace was recorded by moriarty %s, this is %s", h.Moriarty, v))
+	}
+	return warnings, nil
+}
+
+// checkTraceHeader checks the header of trace file traceFile. Mismatches are
+// returned as errors if strict is set and printed as warnings otherwise.
+func checkTraceHeader(traceFile string, h *TraceHeader, strict bool) error {
+	warnings, err := h.Check()
+	if err != nil {
+		if strict {
+			return fmt.Errorf("%s: %w", traceFile, err)
+		}
+		warnings = append(warnings, err.Error())
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "moriarty: warning: %s: %s\n", traceFile, w)
+	}
+	return nil
+}
+
+// ReadTraceHeader returns the header of the trace file filename, or nil if
+// the trace has none.
+func ReadTraceHeader(filename string) (*TraceHeader, error) {
+	r, err := OpenTrace(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return r.Header(), nil
+}
+
+// String formats the header for display.
+func (h *TraceHeader) String() string {
+	return fmt.Sprintf("version %d, program %.12s, moriarty %s, mode %s, seed %d, args %q, recorded %s",
+		h.Version, h.Program, h.Moriarty, h.Mode, h.Seed, h.Args, h.Time.Format(time.RFC3339))
+}
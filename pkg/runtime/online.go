@@ -0,0 +1,55 @@
+package runtime
+
+import (
+	"cmp"
+	"math/rand"
+	"slices"
+	"sync"
+)
+
+// OnlineRandomStrategy schedules goroutines at random without a trace: at
+// every event it lets a uniformly chosen enabled goroutine proceed. The
+// choices depend only on the seed and on the goroutines enabled at each
+// decision, so a seed that exposes a bug exposes it again as long as the
+// program behaves the same.
+type OnlineRandomStrategy struct {
+	seed int64
+	mu   sync.Mutex
+	rng  *rand.Rand
+}
+
+// NewOnlineRandomStrategy creates a strategy that picks goroutines at random,
+// driven by seed.
+func NewOnlineRandomStrategy(seed int64) *OnlineRandomStrategy {
+	return &OnlineRandomStrategy{seed: seed, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Seed returns the seed the strategy was created with.
+func (s *OnlineRandomStrategy) Seed() int64 {
+	return s.seed
+}
+
+// Choose picks one of the enabled goroutines at random.
+func (s *OnlineRandomStrategy) Choose(enabled []GoroutineState) uint64 {
+	// The order in which goroutines stopped depends on timing; their IDs
+	// do not.
+	ids := make([]uint64, len(enabled))
+	for i, g := range enabled {
+		ids[i] = g.ID
+	}
+	slices.SortFunc(ids, cmp.Compare[uint64])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ids[s.rng.Intn(len(ids))]
+}
+
+// ChooseCase picks one of the ready cases at random.
+func (s *OnlineRandomStrategy) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if len(ready) == 0 {
+		return -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ready[s.rng.Intn(len(ready))]
+}
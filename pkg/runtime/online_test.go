@@ -0,0 +1,66 @@
+package runtime_test
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// onlineChoices returns the goroutines s lets proceed over n decisions
+// between goroutines 1 to 3, offered in the given order.
+func onlineChoices(s *runtime.OnlineRandomStrategy, n int, order []uint64) []uint64 {
+	enabled := make([]runtime.GoroutineState, len(order))
+	for i, id := range order {
+		enabled[i] = runtime.GoroutineState{ID: id}
+	}
+	var choices []uint64
+	for range n {
+		choices = append(choices, s.Choose(enabled))
+	}
+	return choices
+}
+
+func TestOnlineRandomSeed(t *testing.T) {
+	a := onlineChoices(runtime.NewOnlineRandomStrategy(7), 50, []uint64{1, 2, 3})
+	// The order in which goroutines stopped does not change the choices.
+	b := onlineChoices(runtime.NewOnlineRandomStrategy(7), 50, []uint64{3, 1, 2})
+	if !slices.Equal(a, b) {
+		t.Errorf("Expected the same choices for the same seed, got %v and %v", a, b)
+	}
+	for _, id := range []uint64{1, 2, 3} {
+		if !slices.Contains(a, id) {
+			t.Errorf("Expected goroutine %d to be chosen in 50 decisions, got %v", id, a)
+		}
+	}
+	if c := onlineChoices(runtime.NewOnlineRandomStrategy(8), 50, []uint64{1, 2, 3}); slices.Equal(a, c) {
+		t.Errorf("Expected different choices for another seed, got %v", c)
+	}
+}
+
+func TestOnlineRandomRunsWithoutTrace(t *testing.T) {
+	runtime.SetStrategy(runtime.NewOnlineRandomStrategy(1))
+
+	var mu sync.Mutex
+	finished := 0
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x := new(int)
+			for range 10 {
+				runtime.MemWrite(unsafe.Pointer(x), 8, 0)
+			}
+			mu.Lock()
+			finished++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if finished != 4 {
+		t.Errorf("Expected 4 goroutines to finish, got %d", finished)
+	}
+}
@@ -0,0 +1,127 @@
+package runtime
+
+import (
+	"cmp"
+	"math/rand"
+	"slices"
+	"sync"
+)
+
+// Defaults of the PCT parameters.
+const (
+	DefaultPCTDepth = 3
+	DefaultPCTSteps = 1000
+)
+
+// PCTHeader describes the parameters of a PCT run in the header of its trace.
+type PCTHeader struct {
+	Depth        int   `json:"depth"`         // Bug depth the run targets
+	Steps        int   `json:"steps"`         // Estimated number of scheduling steps
+	ChangePoints []int `json:"change_points"` // Steps at which priorities were lowered
+}
+
+// PCTStrategy implements probabilistic concurrency testing (PCT, Burckhardt
+// et al., ASPLOS 2010). Every goroutine gets a random priority when it first
+// stops, and the enabled goroutine with the highest priority always
+// proceeds. At depth-1 change points, placed at random among the estimated
+// number of steps, the goroutine about to proceed gets a priority lower
+// than all initial ones, so that another one takes over.
+//
+// For a program with n goroutines and k steps, a run finds a given bug of
+// depth d, a bug that needs d ordering constraints to show, with a
+// probability of at least 1/(n*k^(d-1)).
+type PCTStrategy struct {
+	seed  int64
+	depth int
+	steps int
+
+	mu           sync.Mutex
+	rng          *rand.Rand
+	changePoints []int            // sorted steps at which priorities change
+	priorities   map[uint64]int64 // by goroutine ID
+	step         int              // number of decisions made
+	changes      int              // change points passed
+}
+
+// NewPCTStrategy creates a PCT strategy for bugs of the given depth in runs
+// of about steps scheduling steps, driven by seed.
+func NewPCTStrategy(seed int64, depth, steps int) *PCTStrategy {
+	depth = max(depth, 1)
+	steps = max(steps, 1)
+	s := &PCTStrategy{
+		seed:       seed,
+		depth:      depth,
+		steps:      steps,
+		rng:        rand.New(rand.NewSource(seed)),
+		priorities: make(map[uint64]int64),
+	}
+	// Distinct change points in [1, steps].
+	for len(s.changePoints) < min(depth-1, steps) {
+		if p := s.rng.Intn(steps) + 1; !slices.Contains(s.changePoints, p) {
+			s.changePoints = append(s.changePoints, p)
+		}
+	}
+	slices.Sort(s.changePoints)
+	return s
+}
+
+// ChangePoints returns the steps at which the strategy lowers the priority
+// of the goroutine about to proceed.
+func (s *PCTStrategy) ChangePoints() []int {
+	return slices.Clone(s.changePoints)
+}
+
+// Header returns the header of a trace recording a run of the strategy.
+func (s *PCTStrategy) Header() *TraceHeader {
+	h := NewTraceHeader("pct", s.seed)
+	h.PCT = &PCTHeader{Depth: s.depth, Steps: s.steps, ChangePoints: s.ChangePoints()}
+	return h
+}
+
+// Choose lets the enabled goroutine with the highest priority proceed.
+func (s *PCTStrategy) Choose(enabled []GoroutineState) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Goroutines seen for the first time get a random priority above the
+	// ones change points assign, in the order of their IDs so that the
+	// priorities only depend on the seed.
+	var fresh []uint64
+	for _, g := range enabled {
+		if _, ok := s.priorities[g.ID]; !ok {
+			fresh = append(fresh, g.ID)
+		}
+	}
+	slices.Sort(fresh)
+	for _, id := range fresh {
+		s.priorities[id] = int64(s.depth) + s.rng.Int63n(1<<62)
+	}
+
+	s.step++
+	chosen := s.highest(enabled)
+	if s.changes < len(s.changePoints) && s.step == s.changePoints[s.changes] {
+		s.changes++
+		s.priorities[chosen] = int64(s.depth - s.changes)
+		chosen = s.highest(enabled)
+	}
+	return chosen
+}
+
+// highest returns the enabled goroutine with the highest priority. It must
+// be called with mu held.
+func (s *PCTStrategy) highest(enabled []GoroutineState) uint64 {
+	g := slices.MaxFunc(enabled, func(a, b GoroutineState) int {
+		return cmp.Compare(s.priorities[a.ID], s.priorities[b.ID])
+	})
+	return g.ID
+}
+
+// ChooseCase picks one of the ready cases at random.
+func (s *PCTStrategy) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if len(ready) == 0 {
+		return -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ready[s.rng.Intn(len(ready))]
+}
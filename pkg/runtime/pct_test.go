@@ -0,0 +1,87 @@
+package runtime_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+func enabledGoroutines(ids ...uint64) []runtime.GoroutineState {
+	enabled := make([]runtime.GoroutineState, len(ids))
+	for i, id := range ids {
+		enabled[i] = runtime.GoroutineState{ID: id}
+	}
+	return enabled
+}
+
+func TestPCTChangePoints(t *testing.T) {
+	s := runtime.NewPCTStrategy(42, 4, 100)
+	cps := s.ChangePoints()
+	if len(slices.Compact(slices.Clone(cps))) != 3 || !slices.IsSorted(cps) {
+		t.Fatalf("Expected 3 distinct sorted change points, got %v", cps)
+	}
+	for _, p := range cps {
+		if p < 1 || p > 100 {
+			t.Errorf("Expected change points in [1, 100], got %v", cps)
+		}
+	}
+	if again := runtime.NewPCTStrategy(42, 4, 100).ChangePoints(); !slices.Equal(cps, again) {
+		t.Errorf("Expected the same change points for the same seed, got %v and %v", cps, again)
+	}
+}
+
+func TestPCTHighestPriority(t *testing.T) {
+	// Without change points the goroutine with the highest priority runs
+	// whenever it is enabled.
+	s := runtime.NewPCTStrategy(1, 1, 10)
+	first := s.Choose(enabledGoroutines(1, 2, 3))
+	for range 20 {
+		if id := s.Choose(enabledGoroutines(3, 2, 1)); id != first {
+			t.Fatalf("Expected goroutine %d to keep running, got %d", first, id)
+		}
+	}
+}
+
+func TestPCTChangePointPreempts(t *testing.T) {
+	for seed := range int64(10) {
+		// The only change point is at the first step. It lowers the priority
+		// of the goroutine about to run below that of any other goroutine.
+		s := runtime.NewPCTStrategy(seed, 2, 1)
+		other := s.Choose(enabledGoroutines(1, 2))
+		lowered := 3 - other
+		if id := s.Choose(enabledGoroutines(1, 2)); id != other {
+			t.Fatalf("Seed %d: expected goroutine %d to keep running, got %d", seed, other, id)
+		}
+		if id := s.Choose(enabledGoroutines(lowered, 3)); id != 3 {
+			t.Errorf("Seed %d: expected new goroutine 3 to run before lowered goroutine %d, got %d", seed, lowered, id)
+		}
+	}
+}
+
+func TestPCTHeader(t *testing.T) {
+	s := runtime.NewPCTStrategy(5, 3, 50)
+	path := filepath.Join(t.TempDir(), "trace")
+	tee, err := runtime.NewTee(s, path, runtime.TraceOptions{Format: runtime.FormatBinary, Header: s.Header()})
+	if err != nil {
+		t.Fatalf("NewTee failed: %v", err)
+	}
+	e := runtime.Event{GoID: 1, Kind: runtime.KindWrite}
+	tee.OnEvent(e)
+	tee.OnFinalize()
+
+	h, err := runtime.ReadTraceHeader(path)
+	if err != nil {
+		t.Fatalf("ReadTraceHeader failed: %v", err)
+	}
+	if h.Mode != "pct" || h.Seed != 5 || h.PCT == nil {
+		t.Fatalf("Expected a pct header with seed 5, got %+v", h)
+	}
+	if h.PCT.Depth != 3 || h.PCT.Steps != 50 || !slices.Equal(h.PCT.ChangePoints, s.ChangePoints()) {
+		t.Errorf("Expected depth 3, 50 steps and change points %v, got %+v", s.ChangePoints(), h.PCT)
+	}
+	if got, _ := runtime.LoadTrace(path); !slices.Equal(got, []runtime.Event{e}) {
+		t.Errorf("Expected the recorded events %v, got %v", []runtime.Event{e}, got)
+	}
+}
@@ -1,7 +1,9 @@
 package runtime
 
 import (
+	"cmp"
 	"math/rand"
+	"slices"
 	"sort"
 	"sync"
 )
@@ -13,20 +15,25 @@ type RandomStrategy struct {
 	// Events grouped by goroutine ID
 	pending map[uint64][]Event
 	mu      sync.Mutex
-	cond    *sync.Cond
 
 	// Random source
 	rng *rand.Rand
 
-	// Track which goroutines are currently blocked in Yield
-	waiting map[uint64]bool
+	div      *diverger
+	released []Event // events let through in order, kept under DivergenceRecord
 
 	traceFile string
 }
 
 // NewRandomStrategy creates a strategy that randomly orders goroutine execution.
 // seed controls the random permutation (use same seed for reproducibility).
+// A trace recorded from another program is used anyway, with a warning.
 func NewRandomStrategy(traceFile string, seed int64) (*RandomStrategy, error) {
+	header, err := ReadTraceHeader(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	checkTraceHeader(traceFile, header, false)
 	trace, err := LoadTrace(traceFile)
 	if err != nil {
 		return nil, err
@@ -35,84 +42,111 @@ func NewRandomStrategy(traceFile string, seed int64) (*RandomStrategy, error) {
 	s := &RandomStrategy{
 		pending:   groupByGoID(trace),
 		rng:       rand.New(rand.NewSource(seed)),
-		waiting:   make(map[uint64]bool),
+		div:       newDiverger(DivergenceWarn, traceFile+".diverged"),
 		traceFile: traceFile,
 	}
-	s.cond = sync.NewCond(&s.mu)
 	return s, nil
 }
 
-// Yield blocks until this goroutine is randomly selected to proceed.
-// OnEvent blocks until this goroutine is randomly selected to proceed.
-func (s *RandomStrategy) OnEvent(e Event) {
+// SetDivergencePolicy sets what happens when the program diverges from the
+// trace. Under DivergenceRecord the run is recorded to traceFile. The default
+// policy is DivergenceWarn, since reordering goroutines often changes what
+// they do.
+func (s *RandomStrategy) SetDivergencePolicy(policy DivergencePolicy, traceFile string) {
+	s.div = newDiverger(policy, traceFile)
+}
+
+// Divergence returns the divergence of the program from the trace, or nil if
+// it did not diverge.
+func (s *RandomStrategy) Divergence() *Divergence {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.div.divergence
+}
 
-	// Check if this goroutine has pending events
-	events, hasPending := s.pending[e.GoID]
-	if !hasPending || len(events) == 0 {
-		// No more events for this goroutine - allow it to proceed
-		return
-	}
+// Choose randomly picks one of the enabled goroutines whose event is the
+// next one they produced in the trace. Goroutines without events left in the
+// trace proceed first. After a divergence from the trace, goroutines run
+// freely.
+func (s *RandomStrategy) Choose(enabled []GoroutineState) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Verify the event matches what we expect
-	expected := events[0]
-	if expected.Kind != e.Kind {
-		// Event mismatch - allow to proceed (trace diverged)
-		return
+	switch {
+	case s.div.aborting():
+		// The program is exiting; keep goroutines from running on.
+		return 0
+	case s.div.diverged.Load():
+		return enabled[0].ID
 	}
 
-	// Mark this goroutine as waiting
-	s.waiting[e.GoID] = true
-	s.cond.Broadcast()
-
-	// Wait until we're selected
-	for {
-		// Get all waiting goroutines (sorted for determinism)
-		var waitingIDs []uint64
-		for id, isWaiting := range s.waiting {
-			if isWaiting {
-				// Only include if they have pending events
-				if evts, ok := s.pending[id]; ok && len(evts) > 0 {
-					waitingIDs = append(waitingIDs, id)
-				}
+	var candidates []GoroutineState
+	for _, g := range enabled {
+		events := s.pending[g.ID]
+		if len(events) == 0 {
+			// No more events for this goroutine - allow it to proceed
+			return g.ID
+		}
+		// Verify the event matches what we expect
+		if expected := events[0]; !matches(expected, g.Event) {
+			s.div.diverge(expected, g.Event, s.writeReleased)
+			if s.div.aborting() {
+				return 0
 			}
+			return g.ID
 		}
-		// Sort for deterministic ordering with same seed
-		sortUint64(waitingIDs)
+		candidates = append(candidates, g)
+	}
 
-		if len(waitingIDs) == 0 {
-			// No one waiting, proceed
-			break
-		}
+	// Sort for deterministic ordering with same seed
+	slices.SortFunc(candidates, func(a, b GoroutineState) int { return cmp.Compare(a.ID, b.ID) })
+	selected := candidates[s.rng.Intn(len(candidates))]
+	s.consume(selected.Event)
+	return selected.ID
+}
 
-		// Randomly pick one
-		selectedIdx := s.rng.Intn(len(waitingIDs))
-		selectedID := waitingIDs[selectedIdx]
+// OnEvent records the events performed after a divergence, if the run is
+// recorded.
+func (s *RandomStrategy) OnEvent(e Event) {
+	if s.div.diverged.Load() {
+		s.div.free(e)
+	}
+}
 
-		if selectedID == e.GoID {
-			// We're selected! Consume the event and proceed
-			s.pending[e.GoID] = s.pending[e.GoID][1:]
-			s.waiting[e.GoID] = false
-			s.cond.Broadcast()
-			return
-		}
+// consume lets e through as recorded.
+func (s *RandomStrategy) consume(e Event) {
+	s.pending[e.GoID] = s.pending[e.GoID][1:]
+	s.div.replay(e)
+	if s.div.policy == DivergenceRecord {
+		s.released = append(s.released, e)
+	}
+}
 
-		// Not selected, wait for next round
-		s.cond.Wait()
+// writeReleased writes the events let through so far to w.
+func (s *RandomStrategy) writeReleased(w *TraceWriter) error {
+	for _, e := range s.released {
+		if err := w.Write(e); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Consume our event
-	s.pending[e.GoID] = s.pending[e.GoID][1:]
-	s.waiting[e.GoID] = false
+// OnFinalize closes the trace of a diverged run.
+func (s *RandomStrategy) OnFinalize() {
+	s.div.close()
 }
-func (s *RandomStrategy) RegisterGoroutine(goID uint64) {}
-func (s *RandomStrategy) UnregisterGoroutine(goID uint64) {}
 
-// OnFinalize does nothing.
-func (s *RandomStrategy) OnFinalize() {}
+// ChooseCase picks one of the ready cases at random.
+func (s *RandomStrategy) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if len(ready) == 0 {
+		return -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ready[s.rng.Intn(len(ready))]
+}
 
-func (s *RandomStrategy) Wait(e Event) {}
 // ReplayTrace reloads and re-randomizes.
 func (s *RandomStrategy) ReplayTrace() error {
 	trace, err := LoadTrace(s.traceFile)
@@ -124,7 +158,8 @@ func (s *RandomStrategy) ReplayTrace() error {
 	defer s.mu.Unlock()
 
 	s.pending = groupByGoID(trace)
-	s.waiting = make(map[uint64]bool)
+	s.div = newDiverger(s.div.policy, s.div.traceFile)
+	s.released = nil
 	return nil
 }
 
@@ -4,42 +4,98 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
+// traceFlushInterval is how often RecordStrategy flushes buffered events.
+const traceFlushInterval = time.Second
+
 // RecordStrategy records all events to a trace file.
 // It doesn't enforce any particular ordering - just observes.
+// Events are streamed to the file through a buffer, which is flushed
+// periodically and when the strategy is finalized, so memory use does not
+// grow with the length of the trace.
 type RecordStrategy struct {
-	trace     []Event
 	mu        sync.Mutex
+	w         *TraceWriter // nil when not recording or after finalization
+	err       error        // first write error, reported at finalization
+	stop      chan struct{}
 	traceFile string
 }
 
-// NewRecordStrategy creates a new recording strategy.
-func NewRecordStrategy(traceFile string) *RecordStrategy {
-	return &RecordStrategy{traceFile: traceFile}
+// NewRecordStrategy creates a recording strategy that streams events to
+// traceFile, written as configured by opts. If traceFile is empty, nothing is
+// recorded.
+func NewRecordStrategy(traceFile string, opts TraceOptions) (*RecordStrategy, error) {
+	s := &RecordStrategy{traceFile: traceFile, stop: make(chan struct{})}
+	if traceFile == "" {
+		return s, nil
+	}
+	w, err := CreateTrace(traceFile, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.w = w
+	go s.flushPeriodically()
+	return s, nil
+}
+
+// Choose lets the goroutine that stopped first proceed, so that the program
+// runs in its natural order.
+func (s *RecordStrategy) Choose(enabled []GoroutineState) uint64 {
+	return enabled[0].ID
 }
 
-func (s *RecordStrategy) RegisterGoroutine(goID uint64) {}
-func (s *RecordStrategy) UnregisterGoroutine(goID uint64) {}
 // OnEvent records the event without blocking.
 func (s *RecordStrategy) OnEvent(e Event) {
 	s.mu.Lock()
-	s.trace = append(s.trace, e)
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	if s.w == nil || s.err != nil {
+		return
+	}
+	s.err = s.w.Write(e)
 }
 
-func (s *RecordStrategy) Wait(e Event) {}
-// OnFinalize saves the recorded trace to file.
+// OnFinalize flushes the remaining events and closes the trace file.
 func (s *RecordStrategy) OnFinalize() {
-	if s.traceFile == "" {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
 		return
 	}
-	if err := SaveTrace(s.traceFile, s.trace); err != nil {
-		fmt.Fprintf(os.Stderr, "moriarty: %v\n", err)
+	close(s.stop)
+	if err := s.w.Close(); s.err == nil {
+		s.err = err
+	}
+	s.w = nil
+	if s.err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: %v\n", s.err)
 	}
 }
 
-// RecordTrace saves the current trace to file.
+// RecordTrace writes the events recorded so far to the trace file.
 func (s *RecordStrategy) RecordTrace() error {
-	return SaveTrace(s.traceFile, s.trace)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || s.w == nil {
+		return s.err
+	}
+	return s.w.Flush()
+}
+
+func (s *RecordStrategy) flushPeriodically() {
+	t := time.NewTicker(traceFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			if s.w != nil && s.err == nil {
+				s.err = s.w.Flush()
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
 }
@@ -1,39 +1,136 @@
 package runtime
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
 	"sync"
+	"time"
 )
 
+// maxSelectLookahead bounds how far ChooseCase reads ahead in the trace for
+// the recorded decision of a select statement.
+const maxSelectLookahead = 1 << 20
+
 // ReplayStrategy replays events in the exact recorded order.
-// Goroutines are blocked until it's their turn according to the trace.
+// Goroutines wait until it's their turn according to the trace.
+// The trace is read incrementally: only the events that were read ahead but
+// not replayed yet are kept in memory.
+//
+// When the trace reaches the turn of a goroutine that waits with another
+// event than the recorded one, the replay diverged, and the strategy applies
+// its DivergencePolicy. Since every goroutine produces its events in the
+// recorded order until then, the divergence is found at the same event on
+// every replay.
 type ReplayStrategy struct {
-	trace     []Event
-	idx       int
-	traceFile string
-	registered   map[uint64]chan struct{}
+	traceFile    string
+	registered   map[uint64]bool
 	registeredMu sync.Mutex
-	backLog map[uint64]Event
-	i uint64
+	waitingFor   []GoroutineState // goroutines not chosen by the last decision
+	waitingMu    sync.Mutex
+	div          *diverger
+	wd           *watchdog // nil if disabled
+
+	// window holds the events read from the trace but not replayed yet.
+	reader   *TraceReader
+	window   []Event
+	eof      bool
+	windowMu sync.Mutex
 }
 
-// NewReplayStrategy creates a replay strategy from a trace file.
+// NewReplayStrategy creates a replay strategy from a trace file. It refuses
+// traces whose header shows they were recorded from another program, as
+// replaying them would silently diverge.
 func NewReplayStrategy(traceFile string) (*ReplayStrategy, error) {
-	trace, err := LoadTrace(traceFile)
+	r, err := OpenTrace(traceFile)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkTraceHeader(traceFile, r.Header(), true); err != nil {
+		r.Close()
+		return nil, err
+	}
 	s := &ReplayStrategy{
-		trace: trace,
-		traceFile: traceFile,
-		registered: make(map[uint64]chan struct{}),
-		backLog: make(map[uint64]Event),
+		traceFile:  traceFile,
+		registered: make(map[uint64]bool),
+		div:        newDiverger(DivergenceAbort, traceFile+".diverged"),
+		reader:     r,
 	}
 	return s, nil
 }
 
+// SetDivergencePolicy sets what happens when the program diverges from the
+// trace. Under DivergenceRecord the run is recorded to traceFile. The default
+// policy is DivergenceAbort.
+func (s *ReplayStrategy) SetDivergencePolicy(policy DivergencePolicy, traceFile string) {
+	s.div = newDiverger(policy, traceFile)
+}
+
+// Divergence returns the divergence of the program from the trace, or nil if
+// it did not diverge.
+func (s *ReplayStrategy) Divergence() *Divergence {
+	return s.div.divergence
+}
+
+// SetWatchdog starts a watchdog that ends the program with WatchdogExitCode
+// if goroutines wait for their turn while the replay makes no progress for
+// timeout, e.g. because the goroutine whose event is next is blocked outside
+// of the instrumented code. The watchdog prints the state of the replay, see
+// DumpState, and, if stacks is set, the stacks of all goroutines.
+func (s *ReplayStrategy) SetWatchdog(timeout time.Duration, stacks bool) {
+	s.wd.close()
+	s.wd = startWatchdog(timeout, stacks, s.waiting, s.DumpState)
+}
+
+// waiting reports whether goroutines wait for their turn.
+func (s *ReplayStrategy) waiting() bool {
+	s.waitingMu.Lock()
+	defer s.waitingMu.Unlock()
+	return len(s.waitingFor) > 0
+}
+
+// DumpState writes the next event of the trace and the state of the
+// goroutines to w: the event each waits to perform, or that it runs.
+func (s *ReplayStrategy) DumpState(w io.Writer) {
+	if e, ok := s.next(); ok {
+		fmt.Fprintf(w, "  next in trace: %s\n", describeEvent(e))
+	} else {
+		fmt.Fprintln(w, "  next in trace: end of trace")
+	}
+
+	s.waitingMu.Lock()
+	waiting := make(map[uint64]Event, len(s.waitingFor))
+	for _, g := range s.waitingFor {
+		waiting[g.ID] = g.Event
+	}
+	s.waitingMu.Unlock()
+
+	s.registeredMu.Lock()
+	ids := make([]uint64, 0, len(s.registered))
+	for id := range s.registered {
+		ids = append(ids, id)
+	}
+	s.registeredMu.Unlock()
+	for id := range waiting {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	sortUint64(ids)
+
+	for _, id := range ids {
+		if e, ok := waiting[id]; ok {
+			fmt.Fprintf(w, "  waiting: %s\n", describeEvent(e))
+		} else {
+			fmt.Fprintf(w, "  running: goroutine %d\n", id)
+		}
+	}
+}
+
 func (s *ReplayStrategy) RegisterGoroutine(goID uint64) {
 	s.registeredMu.Lock()
-	s.registered[goID] = make(chan struct{})
+	s.registered[goID] = true
 	s.registeredMu.Unlock()
 }
 func (s *ReplayStrategy) UnregisterGoroutine(goID uint64) {
@@ -41,60 +138,152 @@ func (s *ReplayStrategy) UnregisterGoroutine(goID uint64) {
 	delete(s.registered, goID)
 	s.registeredMu.Unlock()
 }
-// Wait blocks until this goroutine's event matches the next expected event.
-func (s *ReplayStrategy) Wait(e Event) {
-	s.registeredMu.Lock()
-	var blockChan = s.registered[e.GoID]
-	s.registeredMu.Unlock()
-	<-blockChan
+
+// Choose returns the goroutine whose event is next in the trace, or 0 if it
+// has not stopped at it yet. After a divergence, and past the end of the
+// trace, goroutines proceed in the order they stopped.
+func (s *ReplayStrategy) Choose(enabled []GoroutineState) uint64 {
+	s.wd.begin()
+	id := s.choose(enabled)
+	s.wd.end(id != 0)
+
+	s.waitingMu.Lock()
+	s.waitingFor = slices.DeleteFunc(slices.Clone(enabled), func(g GoroutineState) bool { return g.ID == id })
+	s.waitingMu.Unlock()
+	return id
 }
-func (s *ReplayStrategy) unblock(e Event) {
-	s.registeredMu.Lock()
-	var blockChan = s.registered[e.GoID]
-	s.registeredMu.Unlock()
-	blockChan <- struct{}{}
+
+func (s *ReplayStrategy) choose(enabled []GoroutineState) uint64 {
+	switch {
+	case s.div.aborting():
+		// The program is exiting; keep goroutines from running on.
+		return 0
+	case s.div.diverged.Load():
+		return enabled[0].ID
+	}
+	expected, ok := s.next()
+	if !ok {
+		// The program runs past the end of the trace.
+		return enabled[0].ID
+	}
+	i := slices.IndexFunc(enabled, func(g GoroutineState) bool { return g.ID == expected.GoID })
+	if i < 0 {
+		// Wait for the goroutine to yield its event
+		return 0
+	}
+	actual := enabled[i].Event
+	if !matches(expected, actual) {
+		s.div.diverge(expected, actual, s.copyReplayed)
+		if s.div.aborting() {
+			return 0
+		}
+		return actual.GoID
+	}
+	s.advance()
+	s.div.replay(actual)
+	return actual.GoID
 }
-// OnEvent processes the event
+
+// OnEvent records the events performed after a divergence, if the run is
+// recorded.
 func (s *ReplayStrategy) OnEvent(e Event) {
-	if s.idx >= len(s.trace) {
-		s.unblock(e)
-		return
-	}
-
-	s.backLog[s.i] = e
-	s.i++
-	
-	// Process as many events from backlog as possible in trace order
-	for s.idx < len(s.trace) {
-		expected := s.trace[s.idx]
-		found := false
-		for k, v := range s.backLog {
-			if expected.GoID == v.GoID && expected.Kind == v.Kind {
-				// It's this goroutine's turn!
-				s.idx++
-				s.unblock(v)
-				delete(s.backLog, k)
-				found = true
-				break
-			}
+	if s.div.diverged.Load() {
+		s.div.free(e)
+	}
+}
+
+// ChooseCase returns the case the goroutine's next select took in the trace.
+func (s *ReplayStrategy) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if s.div.diverged.Load() {
+		return -1
+	}
+	s.windowMu.Lock()
+	defer s.windowMu.Unlock()
+	// The goroutine's earlier selects were replayed already, so its first
+	// select event ahead is the one of this statement.
+	for i := 0; i < maxSelectLookahead && s.fill(i); i++ {
+		if e := s.window[i]; e.GoID == goID && e.Kind == KindSelect {
+			return int(e.Arg)
 		}
-		if !found {
-			// No matching event in backlog yet, wait for more events
+	}
+	return -1
+}
+
+// copyReplayed writes the events replayed so far to w.
+func (s *ReplayStrategy) copyReplayed(w *TraceWriter) error {
+	r, err := OpenTrace(s.traceFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for range s.div.replayed {
+		e, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if err := w.Write(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the next event to replay, or false at the end of the trace.
+func (s *ReplayStrategy) next() (Event, bool) {
+	s.windowMu.Lock()
+	defer s.windowMu.Unlock()
+	if !s.fill(0) {
+		return Event{}, false
+	}
+	return s.window[0], true
+}
+
+// advance marks the next event as replayed.
+func (s *ReplayStrategy) advance() {
+	s.windowMu.Lock()
+	s.window = s.window[1:]
+	s.windowMu.Unlock()
+}
+
+// fill reads ahead until the window holds event i, and reports whether the
+// trace has that many events. It must be called with windowMu held.
+func (s *ReplayStrategy) fill(i int) bool {
+	for len(s.window) <= i && !s.eof {
+		e, err := s.reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "moriarty: %v\n", err)
+			}
+			s.eof = true
 			break
 		}
+		s.window = append(s.window, e)
 	}
+	return i < len(s.window)
 }
 
-// OnFinalize does nothing for replay.
-func (s *ReplayStrategy) OnFinalize() {}
+// OnFinalize stops the watchdog and closes the trace file and the trace of a
+// diverged run.
+func (s *ReplayStrategy) OnFinalize() {
+	s.wd.close()
+	s.div.close()
+	s.windowMu.Lock()
+	defer s.windowMu.Unlock()
+	s.reader.Close()
+}
 
-// ReplayTrace reloads the trace file.
+// ReplayTrace restarts the replay from the beginning of the trace file.
 func (s *ReplayStrategy) ReplayTrace() error {
-	trace, err := LoadTrace(s.traceFile)
+	r, err := OpenTrace(s.traceFile)
 	if err != nil {
 		return err
 	}
-	s.trace = trace
-	s.idx = 0
+	s.windowMu.Lock()
+	defer s.windowMu.Unlock()
+	s.reader.Close()
+	s.reader = r
+	s.window = nil
+	s.eof = false
+	s.div = newDiverger(s.div.policy, s.div.traceFile)
 	return nil
 }
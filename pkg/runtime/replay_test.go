@@ -0,0 +1,143 @@
+package runtime_test
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// choose asks s which of the goroutines stopped at events proceeds, as the
+// scheduler does, and hands it the chosen goroutine's event.
+func choose(s *runtime.ReplayStrategy, events ...runtime.Event) uint64 {
+	enabled := make([]runtime.GoroutineState, len(events))
+	for i, e := range events {
+		enabled[i] = runtime.GoroutineState{ID: e.GoID, Event: e}
+	}
+	id := s.Choose(enabled)
+	for _, e := range events {
+		if e.GoID == id {
+			s.OnEvent(e)
+		}
+	}
+	return id
+}
+
+func newReplay(t *testing.T, trace []runtime.Event, policy runtime.DivergencePolicy) (*runtime.ReplayStrategy, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "trace")
+	if err := runtime.SaveTrace(path, trace); err != nil {
+		t.Fatalf("SaveTrace failed: %v", err)
+	}
+	s, err := runtime.NewReplayStrategy(path)
+	if err != nil {
+		t.Fatalf("NewReplayStrategy failed: %v", err)
+	}
+	diverged := filepath.Join(dir, "diverged")
+	s.SetDivergencePolicy(policy, diverged)
+	for _, e := range trace {
+		s.RegisterGoroutine(e.GoID)
+	}
+	return s, diverged
+}
+
+var divergingTrace = []runtime.Event{
+	{GoID: 1, Kind: runtime.KindWrite, Addr: 0x10, Size: 8, Site: 1},
+	{GoID: 2, Kind: runtime.KindRead, Addr: 0x10, Size: 8, Site: 2},
+	{GoID: 1, Kind: runtime.KindRead, Addr: 0x10, Size: 8, Site: 3},
+}
+
+func TestReplayDivergence(t *testing.T) {
+	s, _ := newReplay(t, divergingTrace, runtime.DivergenceWarn)
+
+	// Goroutine 2 yields another event than recorded, but it is not its
+	// turn yet, so the divergence is not known.
+	actual := runtime.Event{GoID: 2, Kind: runtime.KindWrite, Addr: 0x20, Size: 8, Site: 4}
+	if id := choose(s, actual); id != 0 || s.Divergence() != nil {
+		t.Fatalf("Expected goroutine 2 to wait for goroutine 1, got %d", id)
+	}
+
+	if id := choose(s, actual, divergingTrace[0]); id != 1 {
+		t.Fatalf("Expected goroutine 1 to proceed, got %d", id)
+	}
+	if id := choose(s, actual); id != 2 {
+		t.Fatalf("Expected goroutine 2 to proceed after the divergence, got %d", id)
+	}
+	d := s.Divergence()
+	if d == nil {
+		t.Fatal("Expected a divergence")
+	}
+	if d.Index != 1 || d.Expected != divergingTrace[1] || d.Actual != actual {
+		t.Errorf("Expected divergence at 1 from %v to %v, got %d from %v to %v",
+			divergingTrace[1], actual, d.Index, d.Expected, d.Actual)
+	}
+	if !slices.Equal(d.Recent, divergingTrace[:1]) {
+		t.Errorf("Expected recent events %v, got %v", divergingTrace[:1], d.Recent)
+	}
+
+	// The program continues freely.
+	if id := choose(s, runtime.Event{GoID: 1, Kind: runtime.KindGoExit}); id != 1 {
+		t.Errorf("Expected goroutine 1 to proceed, got %d", id)
+	}
+}
+
+func TestReplayDivergenceRecord(t *testing.T) {
+	s, diverged := newReplay(t, divergingTrace, runtime.DivergenceRecord)
+
+	actual := runtime.Event{GoID: 2, Kind: runtime.KindWrite, Addr: 0x20, Size: 8, Site: 4}
+	exit := runtime.Event{GoID: 2, Kind: runtime.KindGoExit}
+	choose(s, divergingTrace[0])
+	choose(s, actual)
+	choose(s, exit)
+	s.OnFinalize()
+
+	got, err := runtime.LoadTrace(diverged)
+	if err != nil {
+		t.Fatalf("LoadTrace failed: %v", err)
+	}
+	if want := []runtime.Event{divergingTrace[0], actual, exit}; !slices.Equal(got, want) {
+		t.Errorf("Expected the diverged run %v, got %v", want, got)
+	}
+	if h, _ := runtime.ReadTraceHeader(diverged); h == nil {
+		t.Error("Expected the diverged run to have a header")
+	}
+}
+
+func TestReplayPastEndOfTrace(t *testing.T) {
+	s, _ := newReplay(t, divergingTrace[:1], runtime.DivergenceAbort)
+
+	// Goroutine 2 waits for its turn, which comes when the trace ends.
+	extra := runtime.Event{GoID: 2, Kind: runtime.KindRead}
+	if id := choose(s, extra); id != 0 {
+		t.Fatalf("Expected goroutine 2 to wait for goroutine 1, got %d", id)
+	}
+	if id := choose(s, extra, divergingTrace[0]); id != 1 {
+		t.Fatalf("Expected goroutine 1 to proceed, got %d", id)
+	}
+	if id := choose(s, extra); id != 2 {
+		t.Fatalf("Expected goroutine 2 to proceed, got %d", id)
+	}
+	if d := s.Divergence(); d != nil {
+		t.Errorf("Expected no divergence, got %+v", d)
+	}
+}
+
+func TestReplayDumpState(t *testing.T) {
+	s, _ := newReplay(t, divergingTrace, runtime.DivergenceAbort)
+	choose(s, divergingTrace[1])
+
+	var b strings.Builder
+	s.DumpState(&b)
+	for _, want := range []string{
+		"next in trace: goroutine 1 write",
+		"running: goroutine 1\n",
+		"waiting: goroutine 2 read",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected the state to contain %q, got:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	goruntime "runtime"
+	"strings"
+	"sync"
+)
+
+// maxCreationDepth bounds the number of frames kept for goroutine creation stacks.
+const maxCreationDepth = 32
+
+// creationStacks maps goroutine IDs to the creation of the goroutine.
+var creationStacks sync.Map
+
+// creation is where a goroutine was spawned.
+type creation struct {
+	site SiteID
+	pcs  []uintptr
+}
+
+// Position is a resolved source location.
+type Position struct {
+	Func string
+	File string
+	Line int
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return "<unknown>"
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// recordCreationStack remembers where goroutine goID was spawned.
+func recordCreationStack(goID uint64, site SiteID) {
+	pcs := make([]uintptr, maxCreationDepth)
+	// Skip runtime.Callers, recordCreationStack and Spawn.
+	n := goruntime.Callers(3, pcs)
+	creationStacks.Store(goID, creation{site: site, pcs: pcs[:n]})
+}
+
+// creationStack returns the resolved Spawn call stack of goroutine goID.
+// The innermost frame is taken from the go statement's site when known,
+// since the call stack refers to the instrumented source.
+func creationStack(goID uint64) []Position {
+	v, ok := creationStacks.Load(goID)
+	if !ok {
+		return nil
+	}
+	c := v.(creation)
+	stack := resolveStack(c.pcs)
+	if pos := sitePosition(c.site); pos.File != "" && len(stack) > 0 {
+		stack[0] = pos
+	}
+	return stack
+}
+
+// sitePosition resolves a site ID into a report position.
+func sitePosition(id SiteID) Position {
+	s, ok := LookupSite(id)
+	if !ok {
+		return Position{}
+	}
+	return s.position()
+}
+
+func resolveStack(pcs []uintptr) []Position {
+	var stack []Position
+	frames := goruntime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		// Stop at the Go runtime's goroutine entry points.
+		if strings.HasPrefix(f.Function, "runtime.") {
+			break
+		}
+		stack = append(stack, Position{Func: f.Function, File: f.File, Line: f.Line})
+		if !more {
+			break
+		}
+	}
+	return stack
+}
+
+// WriteReport writes r in the style of the Go race detector.
+func WriteReport(w io.Writer, r Race) {
+	fmt.Fprintln(w, "==================")
+	fmt.Fprintln(w, "WARNING: DATA RACE")
+	writeAccess(w, "", r.Current)
+	fmt.Fprintln(w)
+	writeAccess(w, "Previous ", r.Previous)
+	writeCreation(w, r.Current)
+	writeCreation(w, r.Previous)
+	fmt.Fprintln(w, "==================")
+}
+
+func writeAccess(w io.Writer, prefix string, a Access) {
+	kind := a.Kind.String()
+	if prefix == "" {
+		kind = strings.ToUpper(kind[:1]) + kind[1:]
+	}
+	fmt.Fprintf(w, "%s%s at %#x by goroutine %d:\n", prefix, kind, a.Addr, a.GoID)
+	writeFrame(w, a.Pos)
+}
+
+func writeCreation(w io.Writer, a Access) {
+	if len(a.Created) == 0 {
+		return
+	}
+	state := "running"
+	if a.Exited {
+		state = "finished"
+	}
+	fmt.Fprintf(w, "\nGoroutine %d (%s) created at:\n", a.GoID, state)
+	for _, p := range a.Created {
+		writeFrame(w, p)
+	}
+}
+
+func writeFrame(w io.Writer, p Position) {
+	fn := p.Func
+	if fn == "" {
+		fn = "??"
+	}
+	fmt.Fprintf(w, "  %s()\n      %s\n", fn, p)
+}
@@ -5,7 +5,10 @@ package runtime
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/amirkhaki/moriarty/pkg/goid"
@@ -17,6 +20,10 @@ var (
 	schedMu sync.Mutex
 )
 
+// panicking is set once an instrumented goroutine ends the program with a
+// panic, so that the deferred Finalize of main lets the panic continue.
+var panicking atomic.Bool
+
 // SetStrategy sets the scheduling strategy. Must be called before Initialize.
 func SetStrategy(s Strategy) {
 	schedMu.Lock()
@@ -36,15 +43,54 @@ func GetStrategy() Strategy {
 
 // Initialize sets up the runtime. Must be called at the start of main.
 // Environment variables:
-//   - MORIARTY_MODE: "record" (default), "replay", or "random"
+//   - MORIARTY_MODE: "record" (default), "replay", "random", "online",
+//     which schedules goroutines at random without a trace, "pct", which
+//     schedules them with PCTStrategy, or "explore", used by exploration
+//     drivers, see ExploreStrategy
 //   - MORIARTY_TRACE: path to trace file (default: "moriarty.trace")
-//   - MORIARTY_SEED: random seed for "random" mode (default: 0)
+//   - MORIARTY_RECORD: trace "random", "online", "pct" and "explore" modes
+//     record the run to as it was scheduled, so that "replay" mode repeats
+//     it; empty to record nothing (default: MORIARTY_TRACE + ".random" for
+//     "random", MORIARTY_TRACE for "online" and "pct", none for "explore")
+//   - MORIARTY_SEED: random seed for "random", "online" and "pct" modes
+//     (default: 0)
+//   - MORIARTY_PCT_DEPTH: bug depth "pct" mode targets (default:
+//     DefaultPCTDepth)
+//   - MORIARTY_PCT_STEPS: estimated number of scheduling steps of the
+//     program, over which "pct" mode places its change points (default:
+//     DefaultPCTSteps)
+//   - MORIARTY_SCHEDULE: file with the schedule "explore" mode follows, see
+//     SaveSchedule (default: none)
+//   - MORIARTY_SCHEDULE_LOG: file "explore" mode logs its decisions to
+//     (default: "moriarty.schedule")
+//   - MORIARTY_TRACE_BUFFER: size in bytes of the buffer through which
+//     traces are recorded (default: DefaultTraceBufferSize)
+//   - MORIARTY_TRACE_FORMAT: "json" (default) or "binary", the format in
+//     which traces are recorded; replayed traces are detected
+//   - MORIARTY_TRACE_COMPRESS: set to "1" to gzip the recorded trace
+//   - MORIARTY_ON_DIVERGENCE: "abort", "warn" or "record", what "replay"
+//     and "random" modes do when the program diverges from the trace
+//     (default: "abort" for "replay", "warn" for "random")
+//   - MORIARTY_DIVERGENCE_TRACE: trace the run is recorded to after a
+//     divergence under "record" (default: MORIARTY_TRACE + ".diverged")
+//   - MORIARTY_WATCHDOG: how long "replay" mode may make no progress while
+//     goroutines wait for their turn before it ends the program, as a
+//     duration such as "30s"; "0" disables the watchdog
+//     (default: DefaultWatchdogTimeout)
+//   - MORIARTY_WATCHDOG_STACKS: set to "1" to print the stacks of all
+//     goroutines when the watchdog ends the program
+//   - MORIARTY_DETECT: set to "0" to disable race detection (default: enabled)
 func Initialize() {
 	traceFile := os.Getenv("MORIARTY_TRACE")
 	if traceFile == "" {
 		traceFile = "moriarty.trace"
 	}
 
+	divergenceTrace := os.Getenv("MORIARTY_DIVERGENCE_TRACE")
+	if divergenceTrace == "" {
+		divergenceTrace = traceFile + ".diverged"
+	}
+
 	schedMu.Lock()
 	if sched == nil {
 		var strategy Strategy
@@ -57,27 +103,78 @@ func Initialize() {
 				fmt.Fprintf(os.Stderr, "moriarty: failed to load trace: %v\n", err)
 				os.Exit(1)
 			}
-			strategy = s
-		case "random":
-			seed := int64(0)
-			if seedStr := os.Getenv("MORIARTY_SEED"); seedStr != "" {
-				if _, err := fmt.Sscanf(seedStr, "%d", &seed); err != nil {
+			if policy, ok := divergencePolicy(); ok {
+				s.SetDivergencePolicy(policy, divergenceTrace)
+			}
+			timeout := DefaultWatchdogTimeout
+			if timeoutStr := os.Getenv("MORIARTY_WATCHDOG"); timeoutStr != "" {
+				if timeout, err = time.ParseDuration(timeoutStr); err != nil {
 					schedMu.Unlock()
-					fmt.Fprintf(os.Stderr, "moriarty: invalid seed %q: %v\n", seedStr, err)
+					fmt.Fprintf(os.Stderr, "moriarty: invalid watchdog timeout %q: %v\n", timeoutStr, err)
 					os.Exit(1)
 				}
 			}
+			if timeout > 0 {
+				s.SetWatchdog(timeout, os.Getenv("MORIARTY_WATCHDOG_STACKS") == "1")
+			}
+			strategy = s
+		case "random":
+			seed := seed()
 			s, err := NewRandomStrategy(traceFile, seed)
 			if err != nil {
 				schedMu.Unlock()
 				fmt.Fprintf(os.Stderr, "moriarty: failed to load trace: %v\n", err)
 				os.Exit(1)
 			}
-			strategy = s
+			if policy, ok := divergencePolicy(); ok {
+				s.SetDivergencePolicy(policy, divergenceTrace)
+			}
+			strategy = record(s, traceFile+".random", NewTraceHeader("random", seed))
+		case "online":
+			seed := seed()
+			strategy = record(NewOnlineRandomStrategy(seed), traceFile, NewTraceHeader("online", seed))
+		case "pct":
+			s := NewPCTStrategy(seed(), intEnv("MORIARTY_PCT_DEPTH", DefaultPCTDepth),
+				intEnv("MORIARTY_PCT_STEPS", DefaultPCTSteps))
+			strategy = record(s, traceFile, s.Header())
+		case "explore":
+			var schedule []uint64
+			if scheduleFile := os.Getenv("MORIARTY_SCHEDULE"); scheduleFile != "" {
+				var err error
+				if schedule, err = LoadSchedule(scheduleFile); err != nil {
+					schedMu.Unlock()
+					fmt.Fprintf(os.Stderr, "moriarty: failed to load schedule: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			logFile := os.Getenv("MORIARTY_SCHEDULE_LOG")
+			if logFile == "" {
+				logFile = "moriarty.schedule"
+			}
+			header := NewTraceHeader("explore", 0)
+			s, err := NewExploreStrategy(schedule, logFile, header)
+			if err != nil {
+				schedMu.Unlock()
+				fmt.Fprintf(os.Stderr, "moriarty: failed to log schedule: %v\n", err)
+				os.Exit(1)
+			}
+			strategy = record(s, "", header)
 		default:
-			strategy = NewRecordStrategy(traceFile)
+			opts := traceOptions()
+			opts.Header = NewTraceHeader("record", 0)
+			s, err := NewRecordStrategy(traceFile, opts)
+			if err != nil {
+				schedMu.Unlock()
+				fmt.Fprintf(os.Stderr, "moriarty: failed to record trace: %v\n", err)
+				os.Exit(1)
+			}
+			strategy = s
+		}
+		if detectEnabled() {
+			strategy = NewDetector(strategy, os.Stderr)
 		}
 		sched = newScheduler(strategy)
+		handleSignals()
 	}
 	schedMu.Unlock()
 
@@ -86,37 +183,167 @@ func Initialize() {
 	sched.registerGoroutine(id)
 }
 
-// Finalize cleans up the runtime. Must be called at the end of main.
+// traceOptions returns the options for recorded traces set through
+// MORIARTY_TRACE_BUFFER, MORIARTY_TRACE_FORMAT and MORIARTY_TRACE_COMPRESS.
+// Invalid options end the program.
+func traceOptions() TraceOptions {
+	var opts TraceOptions
+	if sizeStr := os.Getenv("MORIARTY_TRACE_BUFFER"); sizeStr != "" {
+		if _, err := fmt.Sscanf(sizeStr, "%d", &opts.BufferSize); err != nil {
+			fmt.Fprintf(os.Stderr, "moriarty: invalid trace buffer size %q: %v\n", sizeStr, err)
+			os.Exit(1)
+		}
+	}
+	if formatStr := os.Getenv("MORIARTY_TRACE_FORMAT"); formatStr != "" {
+		format, err := ParseTraceFormat(formatStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "moriarty: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Format = format
+	}
+	opts.Compress = os.Getenv("MORIARTY_TRACE_COMPRESS") == "1"
+	return opts
+}
+
+// record wraps s with a Tee that records the run to MORIARTY_RECORD, or to
+// def if it is unset, after header. Nothing is recorded if the file is
+// empty. A trace that cannot be created ends the program.
+func record(s Strategy, def string, header *TraceHeader) Strategy {
+	traceFile, ok := os.LookupEnv("MORIARTY_RECORD")
+	if !ok {
+		traceFile = def
+	}
+	if traceFile == "" {
+		return s
+	}
+	opts := traceOptions()
+	opts.Header = header
+	t, err := NewTee(s, traceFile, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: failed to record trace: %v\n", err)
+		os.Exit(1)
+	}
+	return t
+}
+
+// intEnv returns the integer set through the environment variable name, or
+// def if it is unset. An invalid integer ends the program.
+func intEnv(name string, def int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: invalid %s %q: %v\n", name, str, err)
+		os.Exit(1)
+	}
+	return n
+}
+
+// seed returns the random seed set through MORIARTY_SEED, 0 by default. An
+// invalid seed ends the program.
+func seed() int64 {
+	var seed int64
+	if seedStr := os.Getenv("MORIARTY_SEED"); seedStr != "" {
+		if _, err := fmt.Sscanf(seedStr, "%d", &seed); err != nil {
+			fmt.Fprintf(os.Stderr, "moriarty: invalid seed %q: %v\n", seedStr, err)
+			os.Exit(1)
+		}
+	}
+	return seed
+}
+
+// divergencePolicy returns the policy set through MORIARTY_ON_DIVERGENCE, if
+// any. An invalid policy ends the program.
+func divergencePolicy() (DivergencePolicy, bool) {
+	policyStr := os.Getenv("MORIARTY_ON_DIVERGENCE")
+	if policyStr == "" {
+		return 0, false
+	}
+	policy, err := ParseDivergencePolicy(policyStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "moriarty: %v\n", err)
+		os.Exit(1)
+	}
+	return policy, true
+}
+
+// detectEnabled reports whether race detection was requested via MORIARTY_DETECT.
+func detectEnabled() bool {
+	switch os.Getenv("MORIARTY_DETECT") {
+	case "0", "false", "off":
+		return false
+	}
+	return true
+}
+
+// Finalize cleans up the runtime. The instrumenter defers it at the start
+// of main. Calls after the first have no effect. If main returns after data
+// races were found, the program exits with RaceExitCode.
 func Finalize() {
+	finalize()
+	if !panicking.Load() && racesFound() {
+		os.Exit(RaceExitCode)
+	}
+}
+
+// finalize finalizes the scheduler, if any.
+func finalize() {
 	schedMu.Lock()
 	s := sched
 	schedMu.Unlock()
 
 	if s != nil {
-		s.strategy.OnFinalize()
+		s.finalize()
 	}
 }
 
 // --- Instrumentation Hooks ---
 
-// MemRead is called before a memory read operation.
-func MemRead(addr unsafe.Pointer) {
+// MemRead is called before a memory read operation of size bytes.
+func MemRead(addr unsafe.Pointer, size uintptr, site SiteID) {
 	id := goid.Get()
-	sched.yield(Event{GoID: id, Kind: KindRead, Addr: uintptr(addr)})
+	sched.yield(Event{GoID: id, Kind: KindRead, Addr: uintptr(addr), Size: size, Site: site})
 }
 
-// MemWrite is called before a memory write operation.
-func MemWrite(addr unsafe.Pointer) {
+// MemWrite is called before a memory write operation of size bytes.
+func MemWrite(addr unsafe.Pointer, size uintptr, site SiteID) {
 	id := goid.Get()
-	sched.yield(Event{GoID: id, Kind: KindWrite, Addr: uintptr(addr)})
+	sched.yield(Event{GoID: id, Kind: KindWrite, Addr: uintptr(addr), Size: size, Site: site})
 }
 
-// Spawn launches a new goroutine with the given function.
-func Spawn(f func()) {
+// MemReadRange is called before reading a range of memory, such as a whole
+// struct or array copy, the source of copy() or a slice converted to a string.
+// Empty ranges are ignored.
+func MemReadRange(addr unsafe.Pointer, size uintptr, site SiteID) {
+	if size == 0 {
+		return
+	}
 	id := goid.Get()
-	sched.yield(Event{GoID: id, Kind: KindSpawn})
+	sched.yield(Event{GoID: id, Kind: KindRead, Addr: uintptr(addr), Size: size, Site: site})
+}
 
+// MemWriteRange is called before writing a range of memory, such as a whole
+// struct or array assignment, the destination of copy() or the elements
+// added in place by append(). Empty ranges are ignored.
+func MemWriteRange(addr unsafe.Pointer, size uintptr, site SiteID) {
+	if size == 0 {
+		return
+	}
+	id := goid.Get()
+	sched.yield(Event{GoID: id, Kind: KindWrite, Addr: uintptr(addr), Size: size, Site: site})
+}
+
+// Spawn launches a new goroutine with the given function.
+func Spawn(f func(), site SiteID) {
+	id := goid.Get()
+	// The child ID is allocated up front so the spawn event can name it.
 	newID := goid.Gen()
+	recordCreationStack(newID, site)
+	sched.yield(Event{GoID: id, Kind: KindSpawn, Arg: newID, Site: site})
+
 	sched.registerGoroutine(newID)
 
 	go func() {
@@ -131,10 +358,24 @@ func GoroutineEnter() {
 	sched.yield(Event{GoID: id, Kind: KindGoEnter})
 }
 
-// GoroutineExit is called at the end of each instrumented goroutine.
+// GoroutineExit is deferred at the start of each instrumented goroutine, so
+// it also runs when the goroutine returns early, panics or calls
+// runtime.Goexit. A panic is recorded as a KindPanic event carrying the
+// panic value, and since it is about to end the program, the runtime is
+// finalized before the panic continues.
 func GoroutineExit() {
+	r := recover()
 	id := goid.Get()
+	if r != nil {
+		sched.yield(Event{GoID: id, Kind: KindPanic, Value: fmt.Sprint(r)})
+	}
 	sched.yield(Event{GoID: id, Kind: KindGoExit})
 	sched.unregisterGoroutine(id)
+	creationStacks.Delete(id)
 	goid.Delete()
+	if r != nil {
+		panicking.Store(true)
+		sched.finalize()
+		panic(r)
+	}
 }
@@ -0,0 +1,298 @@
+package runtime_test
+
+import (
+	goruntime "runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// finalizeLog records events and counts how often it was finalized.
+type finalizeLog struct {
+	choiceLog
+	finalized int
+}
+
+func (l *finalizeLog) OnFinalize() {
+	l.finalized++
+}
+
+func TestGoroutineExitRecordsPanic(t *testing.T) {
+	log := &finalizeLog{}
+	runtime.SetStrategy(log)
+
+	var recovered any
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer func() { recovered = recover() }()
+		defer runtime.GoroutineExit()
+		panic("boom")
+	}()
+	<-done
+
+	if recovered != "boom" {
+		t.Errorf("Expected the panic to continue with %q, got %v", "boom", recovered)
+	}
+	want := []runtime.Kind{runtime.KindPanic, runtime.KindGoExit}
+	if got := log.kinds(); !slices.Equal(got, want) {
+		t.Fatalf("Expected events %v, got %v", want, got)
+	}
+	if v := log.events[0].Value; v != "boom" {
+		t.Errorf("Expected panic value %q, got %q", "boom", v)
+	}
+	if log.finalized != 1 {
+		t.Errorf("Expected the strategy to be finalized by the panic, got %d calls", log.finalized)
+	}
+
+	// The deferred Finalize of main does not finalize again.
+	runtime.Finalize()
+	if log.finalized != 1 {
+		t.Errorf("Expected a single finalization, got %d", log.finalized)
+	}
+}
+
+func TestGoroutineExitOnGoexit(t *testing.T) {
+	log := &finalizeLog{}
+	runtime.SetStrategy(log)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer runtime.GoroutineExit()
+		goruntime.Goexit()
+	}()
+	<-done
+
+	if want := []runtime.Kind{runtime.KindGoExit}; !slices.Equal(log.kinds(), want) {
+		t.Errorf("Expected events %v, got %v", want, log.kinds())
+	}
+	if log.finalized != 0 {
+		t.Errorf("Expected no finalization, got %d", log.finalized)
+	}
+}
+
+// lastFirst waits until n goroutines stopped, then lets the one that stopped
+// last proceed first.
+type lastFirst struct {
+	n       int
+	stopped []runtime.GoroutineState // goroutines enabled at the first decision
+	choiceLog
+}
+
+func (l *lastFirst) Choose(enabled []runtime.GoroutineState) uint64 {
+	if l.stopped == nil {
+		if len(enabled) < l.n {
+			return 0
+		}
+		l.stopped = slices.Clone(enabled)
+	}
+	return enabled[len(enabled)-1].ID
+}
+
+func TestSchedulerWaitsForChoice(t *testing.T) {
+	log := &lastFirst{n: 2}
+	runtime.SetStrategy(log)
+
+	var wg sync.WaitGroup
+	for _, p := range []*int{new(int), new(int)} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.MemWrite(unsafe.Pointer(p), 8, 0)
+		}()
+	}
+	wg.Wait()
+
+	if len(log.stopped) != 2 {
+		t.Fatalf("Expected a decision between 2 goroutines, got %v", log.stopped)
+	}
+	want := []runtime.Event{log.stopped[1].Event, log.stopped[0].Event}
+	if !slices.Equal(log.events, want) {
+		t.Errorf("Expected events %v, got %v", want, log.events)
+	}
+}
+
+// acquireFirst lets goroutines beginning an acquisition proceed before any
+// release.
+type acquireFirst struct {
+	choiceLog
+	began bool
+}
+
+func (l *acquireFirst) Choose(enabled []runtime.GoroutineState) uint64 {
+	for _, g := range enabled {
+		if g.Event.Kind == runtime.KindBeginAcquire {
+			return g.ID
+		}
+	}
+	for _, g := range enabled {
+		if g.Event.Kind != runtime.KindRelease || l.began {
+			return g.ID
+		}
+	}
+	return 0
+}
+
+func (l *acquireFirst) OnEvent(e runtime.Event) {
+	l.began = l.began || e.Kind == runtime.KindBeginAcquire
+	l.choiceLog.OnEvent(e)
+}
+
+func TestAcquireBlocksInScheduler(t *testing.T) {
+	log := &acquireFirst{}
+	runtime.SetStrategy(log)
+
+	var obj int
+	var free atomic.Bool
+	addr := unsafe.Pointer(&obj)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// The releasing goroutine is spawned by the acquiring one, so that the
+	// scheduler knows about it before the acquisition blocks.
+	runtime.Spawn(func() {
+		defer wg.Done()
+		runtime.GoroutineEnter()
+		defer runtime.GoroutineExit()
+		runtime.Spawn(func() {
+			defer wg.Done()
+			runtime.GoroutineEnter()
+			defer runtime.GoroutineExit()
+			runtime.Release(addr)
+			free.Store(true)
+		}, 0)
+		runtime.BeginAcquire(addr, func() bool { return free.CompareAndSwap(true, false) }, func() {
+			t.Error("Expected the goroutine to wait for the release in the scheduler")
+		})
+		runtime.Acquire(addr)
+	}, 0)
+	wg.Wait()
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	var got []runtime.Kind
+	for _, e := range log.events {
+		if e.Addr == uintptr(addr) {
+			got = append(got, e.Kind)
+		}
+	}
+	want := []runtime.Kind{runtime.KindBeginAcquire, runtime.KindRelease, runtime.KindAcquire}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+}
+
+// gate is a BlockingStrategy that holds goroutines writing to held in Wait
+// until open is closed.
+type gate struct {
+	held uintptr
+	open chan struct{}
+
+	mu     sync.Mutex
+	waited []runtime.Event // events in the order Wait returned
+}
+
+func (g *gate) RegisterGoroutine(goID uint64)   {}
+func (g *gate) UnregisterGoroutine(goID uint64) {}
+func (g *gate) OnEvent(e runtime.Event)         {}
+func (g *gate) OnFinalize()                     {}
+
+func (g *gate) Wait(e runtime.Event) {
+	if e.Addr == g.held {
+		<-g.open
+	}
+	g.mu.Lock()
+	g.waited = append(g.waited, e)
+	g.mu.Unlock()
+}
+
+func TestAdaptBlocking(t *testing.T) {
+	var held, free int
+	g := &gate{held: uintptr(unsafe.Pointer(&held)), open: make(chan struct{})}
+	runtime.SetStrategy(runtime.AdaptBlocking(g))
+
+	heldDone := make(chan bool)
+	go func() {
+		defer close(heldDone)
+		runtime.MemWrite(unsafe.Pointer(&held), 8, 0)
+	}()
+	// The held goroutine does not keep others from proceeding.
+	runtime.MemWrite(unsafe.Pointer(&free), 8, 0)
+	select {
+	case <-heldDone:
+		t.Fatal("Expected the held goroutine to wait")
+	default:
+	}
+
+	close(g.open)
+	<-heldDone
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.waited) != 2 || g.waited[1].Addr != g.held {
+		t.Errorf("Expected the free write before the held one, got %v", g.waited)
+	}
+}
+
+// narrowCheck records the choices of a strategy that were not among the
+// enabled goroutines, and signals woken when the strategy wakes the
+// scheduler.
+type narrowCheck struct {
+	runtime.Strategy
+	woken chan struct{}
+
+	mu      sync.Mutex
+	outside []uint64
+}
+
+func (c *narrowCheck) SetWake(wake func()) {
+	c.Strategy.(runtime.Waker).SetWake(func() {
+		wake()
+		select {
+		case c.woken <- struct{}{}:
+		default:
+		}
+	})
+}
+
+func (c *narrowCheck) Choose(enabled []runtime.GoroutineState) uint64 {
+	id := c.Strategy.Choose(enabled)
+	if id != 0 && !slices.ContainsFunc(enabled, func(g runtime.GoroutineState) bool { return g.ID == id }) {
+		c.mu.Lock()
+		c.outside = append(c.outside, id)
+		c.mu.Unlock()
+	}
+	return id
+}
+
+func TestAdaptBlockingRespectsFirst(t *testing.T) {
+	var held, free int
+	g := &gate{held: uintptr(unsafe.Pointer(&held)), open: make(chan struct{})}
+	c := &narrowCheck{Strategy: runtime.AdaptBlocking(g), woken: make(chan struct{}, 1)}
+	runtime.SetStrategy(c)
+
+	heldDone := make(chan bool)
+	go func() {
+		defer close(heldDone)
+		runtime.MemWrite(unsafe.Pointer(&held), 8, 0)
+	}()
+	runtime.MemWrite(unsafe.Pointer(&free), 8, 0)
+	<-c.woken
+
+	// The held goroutine is released while this one runs. The start of the
+	// select below must still be performed before it.
+	close(g.open)
+	<-c.woken
+	ch := make(chan int, 1)
+	runtime.Select(0, false, runtime.ChanSend(ch, 0).Case(1))
+	<-heldDone
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.outside) != 0 {
+		t.Errorf("Expected only enabled goroutines to be chosen, got %v", c.outside)
+	}
+}
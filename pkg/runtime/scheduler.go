@@ -1,35 +1,359 @@
 package runtime
 
-// scheduler coordinates goroutines and delegates to a strategy.
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// goroutine is the scheduler's state of an instrumented goroutine.
+type goroutine struct {
+	id      uint64
+	event   Event  // event the goroutine stopped at
+	stopped uint64 // sequence number of the stop, orders enabled goroutines
+	first   bool   // the event is to be performed before any other
+	resume  chan struct{}
+	wake    int // why the goroutine was resumed from block
+}
+
+// waiter is a goroutine blocked in the scheduler because its operation
+// cannot proceed.
+type waiter struct {
+	g     *goroutine
+	addrs []uintptr // objects whose release may let the operation proceed
+	// offers are the start events of the channel operations the goroutine
+	// waits to perform, which a goroutine on the other end of an unbuffered
+	// channel can take part in
+	offers []Event
+	// announces is set if the goroutine yields the start event of the offer
+	// taken only once it was taken, as a select statement does
+	announces bool
+	woken     bool // one of addrs was released since the goroutine blocked
+}
+
+// Reasons for which block returns, besides the index of an offer taken.
+const (
+	wakeRetry = -1 // an object the goroutine blocked on was released
+	wakeBlock = -2 // every goroutine is blocked, so it blocks in the operation
+)
+
+// scheduler coordinates goroutines and delegates to a strategy. It stops
+// every goroutine at each event and, once no goroutine is running, lets the
+// one chosen by the strategy proceed. Operations that may block try to
+// proceed without blocking and, if they cannot, block in the scheduler, so
+// that the scheduler knows which goroutines are running rather than
+// guessing it from timing.
 type scheduler struct {
 	strategy Strategy
-	events   chan Event
-}
+	observer Observer // nil if the strategy does not observe events
 
+	mu         sync.Mutex
+	registered map[uint64]bool       // goroutines the scheduler waits for
+	enabled    map[uint64]*goroutine // goroutines stopped at an event
+	running    map[uint64]*goroutine // registered goroutines expected to stop
+	blocked    []*waiter             // goroutines blocked in the order they blocked
+	partners   map[uint64]*goroutine // goroutines waiting for the next event of another
+	stops      uint64
+	wake       chan struct{}
+
+	finalizeOnce sync.Once
+}
 
 func newScheduler(strategy Strategy) *scheduler {
 	s := &scheduler{
 		strategy:   strategy,
-		events:     make(chan Event),
+		registered: make(map[uint64]bool),
+		enabled:    make(map[uint64]*goroutine),
+		running:    make(map[uint64]*goroutine),
+		partners:   make(map[uint64]*goroutine),
+		wake:       make(chan struct{}, 1),
+	}
+	s.observer, _ = strategy.(Observer)
+	if w, ok := strategy.(Waker); ok {
+		w.SetWake(s.poke)
 	}
 	go s.run()
 	return s
 }
 
-func (s *scheduler) registerGoroutine(goID uint64) {
-	s.strategy.RegisterGoroutine(goID)
+// poke makes the scheduler reconsider its decision.
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
 }
 
-func (s *scheduler) run() {
-	for e := range s.events {
-		s.strategy.OnEvent(e)
+// The scheduler methods do nothing on a nil scheduler, so that instrumented
+// code running before Initialize, in init functions, runs unscheduled.
+
+func (s *scheduler) registerGoroutine(goID uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.registered[goID] = true
+	s.running[goID] = &goroutine{id: goID, resume: make(chan struct{}, 1)}
+	s.mu.Unlock()
+	if t, ok := s.strategy.(GoroutineTracker); ok {
+		t.RegisterGoroutine(goID)
 	}
 }
+
 func (s *scheduler) unregisterGoroutine(goID uint64) {
-	s.strategy.UnregisterGoroutine(goID)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.registered, goID)
+	delete(s.running, goID)
+	s.mu.Unlock()
+	if t, ok := s.strategy.(GoroutineTracker); ok {
+		t.UnregisterGoroutine(goID)
+	}
+	s.poke()
 }
 
+// yield stops the calling goroutine at e until the strategy chooses it.
 func (s *scheduler) yield(e Event) {
-	s.events <- e
-	s.strategy.Wait(e)
+	s.stop(e, false)
+}
+
+// yieldFirst stops the calling goroutine at e until the strategy chooses
+// it, which it does before letting any other goroutine proceed. It reports
+// the start of an operation that already took effect, which no event it
+// allowed may precede.
+func (s *scheduler) yieldFirst(e Event) {
+	s.stop(e, true)
+}
+
+func (s *scheduler) stop(e Event, first bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	g, ok := s.running[e.GoID]
+	if ok {
+		delete(s.running, e.GoID)
+	} else {
+		// A goroutine the scheduler was not told about, or one that
+		// blocked outside of the scheduler.
+		g = &goroutine{id: e.GoID, resume: make(chan struct{}, 1)}
+	}
+	g.event = e
+	g.first = first
+	s.stops++
+	g.stopped = s.stops
+	s.enabled[e.GoID] = g
+	s.mu.Unlock()
+	s.poke()
+	<-g.resume
+}
+
+// block blocks the calling goroutine id, whose operation cannot proceed,
+// until an event releasing one of addrs is performed or a goroutine takes
+// one of offers. It returns wakeRetry if the goroutine is to try its
+// operation again, the index of the offer taken, or wakeBlock if it is to
+// perform the operation itself: the scheduler gives up on modeling blocked
+// goroutines when every goroutine is blocked, as they are then waiting for
+// something it does not see, or deadlocked.
+func (s *scheduler) block(id uint64, addrs []uintptr, offers []Event, announces bool) int {
+	s.mu.Lock()
+	g, ok := s.running[id]
+	if ok {
+		delete(s.running, id)
+	} else {
+		g = &goroutine{id: id, resume: make(chan struct{}, 1)}
+	}
+	s.blocked = append(s.blocked, &waiter{g: g, addrs: addrs, offers: offers, announces: announces})
+	s.mu.Unlock()
+	s.poke()
+	<-g.resume
+	return g.wake
+}
+
+// claim looks for a goroutine blocked on the other end of the unbuffered
+// channel of e, the start event of a send or receive that cannot proceed.
+// It removes the first one from the blocked goroutines and returns it with
+// the index of its offer, or nil if there is none. The caller performs its
+// operation once it passed the goroutine to handoff, and the two meet.
+func (s *scheduler) claim(e Event) (*waiter, int) {
+	if e.Arg != 0 || e.Addr == 0 {
+		return nil, 0
+	}
+	other := KindChanRecv
+	if e.Kind == KindChanRecv {
+		other = KindChanSend
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.blocked {
+		for k, o := range w.offers {
+			if o.Kind == other && o.Addr == e.Addr && o.Arg == 0 {
+				s.blocked = slices.Delete(s.blocked, i, i+1)
+				return w, k
+			}
+		}
+	}
+	return nil, 0
+}
+
+// handoff lets the goroutine of w, returned by claim, perform its offer k
+// with the calling goroutine id. If w announces the offer, the calling
+// goroutine blocks until the start event is performed, so that its own
+// operation is not seen to complete before the other one started.
+func (s *scheduler) handoff(id uint64, w *waiter, k int) {
+	s.mu.Lock()
+	s.resume(w.g, k)
+	if !w.announces {
+		s.mu.Unlock()
+		return
+	}
+	g, ok := s.running[id]
+	if ok {
+		delete(s.running, id)
+	} else {
+		g = &goroutine{id: id, resume: make(chan struct{}, 1)}
+	}
+	s.partners[w.g.id] = g
+	s.mu.Unlock()
+	s.poke()
+	<-g.resume
+}
+
+// resume resumes the blocked goroutine g for reason wake, and waits for it
+// to stop again if it is registered. It must be called with mu held.
+func (s *scheduler) resume(g *goroutine, wake int) {
+	g.wake = wake
+	if s.registered[g.id] {
+		s.running[g.id] = g
+	}
+	g.resume <- struct{}{}
+}
+
+// releases reports whether performing e may let operations blocked on
+// e.Addr proceed.
+func releases(e Event) bool {
+	switch e.Kind {
+	case KindRelease, KindSignal, KindChanSendDone, KindChanRecvDone, KindChanClose:
+		return true
+	}
+	return false
+}
+
+// wakeWaiters marks the goroutines blocked on the object e releases, if
+// any, as woken. It must be called with mu held.
+func (s *scheduler) wakeWaiters(e Event) {
+	if !releases(e) {
+		return
+	}
+	for _, w := range s.blocked {
+		if slices.Contains(w.addrs, e.Addr) {
+			w.woken = true
+		}
+	}
+}
+
+// retryWoken lets the first woken goroutine try its operation again, and
+// reports whether there was one. Woken goroutines retry one at a time, in
+// the order they blocked, so that which of them proceeds does not depend on
+// timing. It must be called with mu held.
+func (s *scheduler) retryWoken() bool {
+	i := slices.IndexFunc(s.blocked, func(w *waiter) bool { return w.woken })
+	if i < 0 {
+		return false
+	}
+	g := s.blocked[i].g
+	s.blocked = slices.Delete(s.blocked, i, i+1)
+	s.resume(g, wakeRetry)
+	return true
+}
+
+// releaseBlocked lets every blocked goroutine perform its operation itself.
+// It must be called with mu held.
+func (s *scheduler) releaseBlocked() {
+	for _, w := range s.blocked {
+		w.g.wake = wakeBlock
+		w.g.resume <- struct{}{}
+	}
+	s.blocked = nil
+}
+
+func (s *scheduler) run() {
+	for range s.wake {
+		s.schedule()
+	}
+}
+
+// schedule lets goroutines proceed as long as none is running and the
+// strategy chooses one. Goroutines woken from blocking retry first.
+func (s *scheduler) schedule() {
+	for {
+		s.mu.Lock()
+		if len(s.running) > 0 {
+			s.mu.Unlock()
+			return
+		}
+		if s.retryWoken() {
+			s.mu.Unlock()
+			continue
+		}
+		if len(s.enabled) == 0 {
+			s.releaseBlocked()
+			s.mu.Unlock()
+			return
+		}
+		stopped := make([]*goroutine, 0, len(s.enabled))
+		for _, g := range s.enabled {
+			stopped = append(stopped, g)
+		}
+		s.mu.Unlock()
+
+		slices.SortFunc(stopped, func(a, b *goroutine) int { return cmp.Compare(a.stopped, b.stopped) })
+		if i := slices.IndexFunc(stopped, func(g *goroutine) bool { return g.first }); i >= 0 {
+			stopped = stopped[i : i+1]
+		}
+		enabled := make([]GoroutineState, len(stopped))
+		for i, g := range stopped {
+			enabled[i] = GoroutineState{ID: g.id, Event: g.event}
+		}
+		id := s.strategy.Choose(enabled)
+		if id == 0 {
+			return
+		}
+
+		s.mu.Lock()
+		g, ok := s.enabled[id]
+		if !ok {
+			s.mu.Unlock()
+			panic(fmt.Sprintf("moriarty: strategy chose goroutine %d, which is not enabled", id))
+		}
+		delete(s.enabled, id)
+		if s.registered[id] {
+			s.running[id] = g
+		}
+		s.wakeWaiters(g.event)
+		if p, ok := s.partners[id]; ok {
+			delete(s.partners, id)
+			s.resume(p, 0)
+		}
+		s.mu.Unlock()
+
+		if s.observer != nil {
+			s.observer.OnEvent(g.event)
+		}
+		g.resume <- struct{}{}
+	}
+}
+
+// finalize finalizes the strategy. Only the first call has an effect, so
+// that a goroutine ending the program with a panic and the deferred
+// Finalize of main do not both finalize.
+func (s *scheduler) finalize() {
+	s.finalizeOnce.Do(func() {
+		if f, ok := s.strategy.(Finalizer); ok {
+			f.OnFinalize()
+		}
+	})
 }
@@ -0,0 +1,319 @@
+package runtime
+
+import (
+	"reflect"
+	"slices"
+
+	"github.com/amirkhaki/moriarty/pkg/goid"
+)
+
+// Chooser is implemented by strategies that decide which case an
+// instrumented select statement takes.
+type Chooser interface {
+	// ChooseCase returns the index of the case the select statement at site
+	// in goroutine goID should take. ready holds the cases that were not
+	// found blocked yet; if the returned case is in ready but turns out to
+	// be blocked, ChooseCase is asked again without it. Returning a case that
+	// is not in ready blocks until that case can proceed, and returning the
+	// number of cases takes the default clause. Returning -1 leaves the
+	// choice to the Go runtime.
+	ChooseCase(goID uint64, site SiteID, ready []int) int
+}
+
+// SelectCase is a communication clause of an instrumented select statement,
+// created by ChanRecvCase or Sender.Case.
+type SelectCase interface {
+	// try performs the operation if it can proceed without blocking.
+	try() bool
+	// do performs the operation, blocking until it can proceed.
+	do()
+	// selectCase returns the case for reflect.Select, and complete stores
+	// the received value if reflect.Select chose it.
+	selectCase() reflect.SelectCase
+	complete(v reflect.Value, ok bool)
+	// events returns the start and completion events of the operation.
+	events(goID uint64) []Event
+}
+
+// RecvCase is a receive clause of an instrumented select statement.
+// Value and OK hold the result of the receive once the case was taken.
+type RecvCase[T any] struct {
+	ch    <-chan T
+	site  SiteID
+	Value T
+	OK    bool
+}
+
+// ChanRecvCase creates the clause for a receive from ch.
+func ChanRecvCase[T any](ch <-chan T, site SiteID) *RecvCase[T] {
+	return &RecvCase[T]{ch: ch, site: site}
+}
+
+func (c *RecvCase[T]) try() bool {
+	select {
+	case c.Value, c.OK = <-c.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *RecvCase[T]) do() {
+	c.Value, c.OK = <-c.ch
+}
+
+func (c *RecvCase[T]) selectCase() reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.ch)}
+}
+
+func (c *RecvCase[T]) complete(v reflect.Value, ok bool) {
+	if ok {
+		reflect.ValueOf(&c.Value).Elem().Set(v)
+	}
+	c.OK = ok
+}
+
+func (c *RecvCase[T]) events(goID uint64) []Event {
+	e := Event{GoID: goID, Kind: KindChanRecv, Addr: chanAddr(c.ch), Arg: uint64(cap(c.ch)), Site: c.site}
+	done := e
+	done.Kind = KindChanRecvDone
+	return []Event{e, done}
+}
+
+// SendCase is a send clause of an instrumented select statement.
+type SendCase[T any] struct {
+	ch   chan<- T
+	site SiteID
+	v    T
+}
+
+// Case creates the clause for sending v, like Send does for a plain send.
+func (s Sender[T]) Case(v T) *SendCase[T] {
+	return &SendCase[T]{ch: s.ch, site: s.site, v: v}
+}
+
+func (c *SendCase[T]) try() bool {
+	select {
+	case c.ch <- c.v:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *SendCase[T]) do() {
+	c.ch <- c.v
+}
+
+func (c *SendCase[T]) selectCase() reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(c.ch), Send: reflect.ValueOf(&c.v).Elem()}
+}
+
+func (c *SendCase[T]) complete(v reflect.Value, ok bool) {}
+
+func (c *SendCase[T]) events(goID uint64) []Event {
+	e := Event{GoID: goID, Kind: KindChanSend, Addr: chanAddr(c.ch), Arg: uint64(cap(c.ch)), Site: c.site}
+	done := e
+	done.Kind = KindChanSendDone
+	return []Event{e, done}
+}
+
+// Select runs an instrumented select statement and returns the index of the
+// case it took, or len(cases) for the default clause. The instrumenter
+// rewrites
+//
+//	select {
+//	case v := <-ch1:
+//		...
+//	case ch2 <- x:
+//		...
+//	default:
+//		...
+//	}
+//
+// into
+//
+//	switch c0, c1 := ChanRecvCase(ch1, site), ChanSend(ch2, site).Case(x); Select(site, true, c0, c1) {
+//	case 0:
+//		v := c0.Value
+//		...
+//	case 1:
+//		...
+//	default:
+//		...
+//	}
+//
+// If the strategy implements Chooser it picks the case, otherwise the Go
+// runtime does. While no case can proceed, the goroutine blocks in the
+// scheduler like a plain channel operation would. The case taken is only
+// known once its operation can proceed, so its start event is yielded then,
+// and performed before any other goroutine proceeds, in particular the one
+// on the other end of the channel. Its completion event and a KindSelect
+// event whose Arg is the returned index follow.
+func Select(site SiteID, hasDefault bool, cases ...SelectCase) int {
+	id := goid.Get()
+	var chooser Chooser
+	if sched != nil {
+		chooser, _ = sched.strategy.(Chooser)
+	}
+
+	chosen := -1
+	for chosen < 0 {
+		var waitFor []int
+		chosen, waitFor = selectNow(chooser, id, site, hasDefault, cases)
+		if chosen < 0 {
+			chosen = selectWait(id, cases, waitFor)
+		}
+	}
+
+	if chosen < len(cases) {
+		yieldEvent(cases[chosen].events(id)[1])
+	}
+	yieldEvent(Event{GoID: id, Kind: KindSelect, Arg: uint64(chosen), Site: site})
+	return chosen
+}
+
+// selectNow performs a case that can proceed, or the default clause, and
+// returns its index. The start event of a case is yielded as it is taken. If it has to wait, it returns -1 and the cases to wait
+// for.
+func selectNow(chooser Chooser, goID uint64, site SiteID, hasDefault bool, cases []SelectCase) (int, []int) {
+	if chooser != nil {
+		if i, waitFor := choose(chooser, goID, site, hasDefault, cases); i >= 0 || waitFor != nil {
+			return i, waitFor
+		}
+	}
+	if i := selectReady(cases); i >= 0 {
+		announce(cases[i], goID)
+		return i, nil
+	}
+	waitFor := make([]int, len(cases))
+	for i, c := range cases {
+		if meet(c, goID) {
+			return i, nil
+		}
+		waitFor[i] = i
+	}
+	if hasDefault {
+		return len(cases), nil
+	}
+	return -1, waitFor
+}
+
+// choose lets chooser pick the case, and performs it. It returns -1 and the
+// case to wait for if the chosen case cannot proceed yet, and -1 and nil if
+// the choice is left to the Go runtime.
+func choose(chooser Chooser, goID uint64, site SiteID, hasDefault bool, cases []SelectCase) (int, []int) {
+	ready := make([]int, len(cases))
+	for i := range ready {
+		ready[i] = i
+	}
+	for {
+		i := chooser.ChooseCase(goID, site, ready)
+		switch {
+		case i < 0:
+			return -1, nil
+		case i == len(cases) && hasDefault:
+			return i, nil
+		case i >= len(cases):
+			// Not a valid case: leave it to the Go runtime.
+			return -1, nil
+		case !slices.Contains(ready, i):
+			if proceed(cases[i], goID) {
+				return i, nil
+			}
+			return -1, []int{i}
+		case proceed(cases[i], goID):
+			return i, nil
+		}
+		ready = slices.DeleteFunc(ready, func(j int) bool { return j == i })
+		if len(ready) == 0 && hasDefault {
+			return len(cases), nil
+		}
+	}
+}
+
+// proceed performs c if it can proceed without blocking.
+func proceed(c SelectCase, goID uint64) bool {
+	if c.try() {
+		announce(c, goID)
+		return true
+	}
+	return meet(c, goID)
+}
+
+// meet performs c with a goroutine blocked in the scheduler on the other end
+// of its unbuffered channel, if there is one.
+func meet(c SelectCase, goID uint64) bool {
+	if sched == nil {
+		return false
+	}
+	w, k := sched.claim(c.events(goID)[0])
+	if w == nil {
+		return false
+	}
+	announce(c, goID)
+	sched.handoff(goID, w, k)
+	c.do()
+	return true
+}
+
+// announce yields the start event of c, which was taken, so that it is
+// performed before any other goroutine proceeds.
+func announce(c SelectCase, goID uint64) {
+	sched.yieldFirst(c.events(goID)[0])
+}
+
+// selectWait blocks until one of the cases at waitFor can proceed. It
+// returns the case it performed, or -1 if the cases are to be tried again.
+func selectWait(goID uint64, cases []SelectCase, waitFor []int) int {
+	if sched == nil {
+		return selectBlocking(cases, waitFor)
+	}
+	addrs := make([]uintptr, len(waitFor))
+	offers := make([]Event, len(waitFor))
+	for k, i := range waitFor {
+		offers[k] = cases[i].events(goID)[0]
+		addrs[k] = offers[k].Addr
+	}
+	switch k := sched.block(goID, addrs, offers, true); k {
+	case wakeRetry:
+		return -1
+	case wakeBlock:
+		i := selectBlocking(cases, waitFor)
+		announce(cases[i], goID)
+		return i
+	default:
+		c := cases[waitFor[k]]
+		announce(c, goID)
+		c.do()
+		return waitFor[k]
+	}
+}
+
+// selectReady performs a case that can proceed without blocking, chosen as
+// the Go runtime would. It returns -1 if there is none.
+func selectReady(cases []SelectCase) int {
+	rcs := make([]reflect.SelectCase, len(cases)+1)
+	for i, c := range cases {
+		rcs[i] = c.selectCase()
+	}
+	rcs[len(cases)] = reflect.SelectCase{Dir: reflect.SelectDefault}
+	i, v, ok := reflect.Select(rcs)
+	if i == len(cases) {
+		return -1
+	}
+	cases[i].complete(v, ok)
+	return i
+}
+
+// selectBlocking performs one of the cases at indices as the Go runtime
+// would, blocking until one can proceed.
+func selectBlocking(cases []SelectCase, indices []int) int {
+	rcs := make([]reflect.SelectCase, len(indices))
+	for k, i := range indices {
+		rcs[k] = cases[i].selectCase()
+	}
+	k, v, ok := reflect.Select(rcs)
+	cases[indices[k]].complete(v, ok)
+	return indices[k]
+}
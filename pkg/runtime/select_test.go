@@ -0,0 +1,199 @@
+package runtime_test
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// choiceLog picks select cases with choose and records the events it sees.
+type choiceLog struct {
+	nopStrategy
+	choose func(ready []int) int
+
+	mu     sync.Mutex
+	events []runtime.Event
+	asked  [][]int
+}
+
+func (l *choiceLog) OnEvent(e runtime.Event) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+func (l *choiceLog) ChooseCase(goID uint64, site runtime.SiteID, ready []int) int {
+	l.asked = append(l.asked, slices.Clone(ready))
+	return l.choose(ready)
+}
+
+func (l *choiceLog) kinds() []runtime.Kind {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var kinds []runtime.Kind
+	for _, e := range l.events {
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+func TestSelectSkipsBlockedChoice(t *testing.T) {
+	a := make(chan int)
+	b := make(chan int, 1)
+	b <- 42
+
+	log := &choiceLog{choose: func(ready []int) int { return ready[0] }}
+	runtime.SetStrategy(log)
+
+	ca, cb := runtime.ChanRecvCase(a, 0), runtime.ChanRecvCase(b, 0)
+	if got := runtime.Select(0, false, ca, cb); got != 1 {
+		t.Fatalf("Expected case 1, got %d", got)
+	}
+	if cb.Value != 42 || !cb.OK {
+		t.Errorf("Expected to receive 42, got %d, %v", cb.Value, cb.OK)
+	}
+	if want := [][]int{{0, 1}, {1}}; !slices.EqualFunc(log.asked, want, slices.Equal) {
+		t.Errorf("Expected to be asked %v, got %v", want, log.asked)
+	}
+	want := []runtime.Kind{runtime.KindChanRecv, runtime.KindChanRecvDone, runtime.KindSelect}
+	if got := log.kinds(); !slices.Equal(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+}
+
+func TestSelectFallsBackToDefault(t *testing.T) {
+	a := make(chan int)
+	b := make(chan int)
+
+	log := &choiceLog{choose: func(ready []int) int { return ready[0] }}
+	runtime.SetStrategy(log)
+
+	if got := runtime.Select(0, true, runtime.ChanRecvCase(a, 0), runtime.ChanSend(b, 0).Case(1)); got != 2 {
+		t.Fatalf("Expected the default case, got %d", got)
+	}
+	if want := []runtime.Kind{runtime.KindSelect}; !slices.Equal(log.kinds(), want) {
+		t.Errorf("Expected events %v, got %v", want, log.kinds())
+	}
+}
+
+func TestSelectWaitsForChosenCase(t *testing.T) {
+	a := make(chan int)
+	b := make(chan int, 1)
+	b <- 1
+
+	// Insist on a although b is ready, as a replay of a trace would.
+	log := &choiceLog{choose: func(ready []int) int { return 0 }}
+	runtime.SetStrategy(log)
+
+	go func() { a <- 7 }()
+	ca := runtime.ChanRecvCase(a, 0)
+	if got := runtime.Select(0, false, ca, runtime.ChanRecvCase(b, 0)); got != 0 {
+		t.Fatalf("Expected case 0, got %d", got)
+	}
+	if ca.Value != 7 {
+		t.Errorf("Expected to receive 7, got %d", ca.Value)
+	}
+}
+
+func TestSelectMeetsBlockedSender(t *testing.T) {
+	a := make(chan int)
+
+	log := &choiceLog{choose: func(ready []int) int { return 0 }}
+	runtime.SetStrategy(log)
+
+	// Whichever of the select and the send blocks first in the scheduler,
+	// the other one meets it on the unbuffered channel.
+	var got int
+	var wg sync.WaitGroup
+	wg.Add(2)
+	runtime.Spawn(func() {
+		defer wg.Done()
+		runtime.GoroutineEnter()
+		defer runtime.GoroutineExit()
+		runtime.Spawn(func() {
+			defer wg.Done()
+			runtime.GoroutineEnter()
+			defer runtime.GoroutineExit()
+			runtime.ChanSend(a, 0).Send(7)
+		}, 0)
+		ca := runtime.ChanRecvCase(a, 0)
+		runtime.Select(0, false, ca)
+		got = ca.Value
+	}, 0)
+	wg.Wait()
+
+	if got != 7 {
+		t.Errorf("Expected to receive 7, got %d", got)
+	}
+	kinds := log.kinds()
+	for _, k := range []runtime.Kind{runtime.KindChanSend, runtime.KindChanSendDone, runtime.KindChanRecv, runtime.KindChanRecvDone, runtime.KindSelect} {
+		if !slices.Contains(kinds, k) {
+			t.Errorf("Expected a %v event, got %v", k, kinds)
+		}
+	}
+}
+
+// receiverFirst lets receives proceed as early as it can: a receive starts
+// once a send started, and completes before anything else.
+type receiverFirst struct {
+	choiceLog
+}
+
+func (r *receiverFirst) Choose(enabled []runtime.GoroutineState) uint64 {
+	pick := func(kind runtime.Kind) uint64 {
+		for _, g := range enabled {
+			if g.Event.Kind == kind {
+				return g.ID
+			}
+		}
+		return 0
+	}
+	if id := pick(runtime.KindChanRecvDone); id != 0 {
+		return id
+	}
+	if id := pick(runtime.KindChanRecv); id != 0 && pick(runtime.KindChanSend) != 0 {
+		return id
+	}
+	for _, g := range enabled {
+		if g.Event.Kind != runtime.KindChanRecv {
+			return g.ID
+		}
+	}
+	return enabled[0].ID
+}
+
+func TestSelectSendStartsBeforeReceive(t *testing.T) {
+	ch := make(chan int, 1)
+	var x int
+
+	r := &receiverFirst{choiceLog{choose: func(ready []int) int { return ready[0] }}}
+	d := runtime.NewDetector(r, nil)
+	runtime.SetStrategy(d)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	runtime.Spawn(func() {
+		defer wg.Done()
+		runtime.GoroutineEnter()
+		defer runtime.GoroutineExit()
+		runtime.Spawn(func() {
+			defer wg.Done()
+			runtime.GoroutineEnter()
+			defer runtime.GoroutineExit()
+			runtime.ChanRecv(ch, 0)
+			runtime.MemRead(unsafe.Pointer(&x), 8, 0)
+		}, 0)
+		runtime.MemWrite(unsafe.Pointer(&x), 8, 0)
+		runtime.Select(0, false, runtime.ChanSend(ch, 0).Case(1))
+	}, 0)
+	wg.Wait()
+
+	// The select's send took effect before it was reported, but the receive
+	// that got its value must not be seen to complete before it.
+	if races := d.Races(); len(races) != 0 {
+		t.Errorf("Expected no races, got %v", races)
+	}
+}
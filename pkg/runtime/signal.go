@@ -0,0 +1,191 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Signal Hooks ---
+//
+// The runtime finalizes when the program receives SIGINT or SIGTERM, unless
+// the program handles the signal itself. The instrumenter rewrites the
+// functions of os/signal into these hooks, so that the runtime learns which
+// signals the program handles:
+//
+//	signal.Notify(c, sig...)             SignalNotify(c, sig...)
+//	signal.NotifyContext(ctx, sig...)    SignalNotifyContext(ctx, sig...)
+//	signal.Ignore(sig...)                SignalIgnore(sig...)
+//	signal.Reset(sig...)                 SignalReset(sig...)
+//	signal.Stop(c)                       SignalStop(c)
+
+// trapped are the signals the runtime finalizes on.
+var trapped = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+var (
+	signalsMu sync.Mutex
+	// handled maps each channel or context the program is notified through
+	// to the trapped signals it receives.
+	handled = make(map[any]map[os.Signal]bool)
+	// ignored are the trapped signals the program ignores.
+	ignored = make(map[os.Signal]bool)
+	// trap is the channel of the runtime, nil until handleSignals is called.
+	trap chan os.Signal
+)
+
+// SignalNotify is the instrumented form of signal.Notify.
+func SignalNotify(c chan<- os.Signal, sig ...os.Signal) {
+	signal.Notify(c, sig...)
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	handle(c, sig)
+	updateTrap()
+}
+
+// SignalNotifyContext is the instrumented form of signal.NotifyContext. The
+// signals are handled by the program until stop is called.
+func SignalNotifyContext(parent context.Context, sig ...os.Signal) (ctx context.Context, stop context.CancelFunc) {
+	ctx, stopNotify := signal.NotifyContext(parent, sig...)
+	key := new(byte)
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	handle(key, sig)
+	updateTrap()
+	return ctx, func() {
+		stopNotify()
+		signalsMu.Lock()
+		defer signalsMu.Unlock()
+		delete(handled, key)
+		updateTrap()
+	}
+}
+
+// SignalIgnore is the instrumented form of signal.Ignore.
+func SignalIgnore(sig ...os.Signal) {
+	signal.Ignore(sig...)
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	for _, s := range trappedIn(sig) {
+		ignored[s] = true
+	}
+	updateTrap()
+}
+
+// SignalReset is the instrumented form of signal.Reset.
+func SignalReset(sig ...os.Signal) {
+	signal.Reset(sig...)
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	for _, s := range trappedIn(sig) {
+		delete(ignored, s)
+		for _, sigs := range handled {
+			delete(sigs, s)
+		}
+	}
+	updateTrap()
+}
+
+// SignalStop is the instrumented form of signal.Stop.
+func SignalStop(c chan<- os.Signal) {
+	signal.Stop(c)
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	delete(handled, c)
+	updateTrap()
+}
+
+// handle records that the program is notified of sig through key, where no
+// signals means all signals. signalsMu must be held.
+func handle(key any, sig []os.Signal) {
+	sigs := handled[key]
+	if sigs == nil {
+		sigs = make(map[os.Signal]bool)
+		handled[key] = sigs
+	}
+	for _, s := range trappedIn(sig) {
+		sigs[s] = true
+	}
+}
+
+// trappedIn returns the trapped signals among sig, where no signals means
+// all signals.
+func trappedIn(sig []os.Signal) []os.Signal {
+	if len(sig) == 0 {
+		return trapped
+	}
+	var sigs []os.Signal
+	for _, s := range trapped {
+		if slices.Contains(sig, s) {
+			sigs = append(sigs, s)
+		}
+	}
+	return sigs
+}
+
+// updateTrap notifies trap of the trapped signals the program neither
+// handles nor ignores. signalsMu must be held.
+func updateTrap() {
+	if trap == nil {
+		return
+	}
+	signal.Stop(trap)
+	var sigs []os.Signal
+	for _, s := range trapped {
+		if !ignored[s] && !isHandled(s) {
+			sigs = append(sigs, s)
+		}
+	}
+	if len(sigs) > 0 {
+		signal.Notify(trap, sigs...)
+	}
+}
+
+// isHandled reports whether the program is notified of s. signalsMu must be
+// held.
+func isHandled(s os.Signal) bool {
+	for _, sigs := range handled {
+		if sigs[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSignals finalizes the runtime when the program receives SIGINT or
+// SIGTERM without handling it, then lets the signal terminate the program as
+// it would have without instrumentation. A second signal skips
+// finalization, in case it hangs.
+func handleSignals() {
+	signalsMu.Lock()
+	if trap != nil {
+		signal.Stop(trap)
+	}
+	sigs := make(chan os.Signal, 2)
+	trap = sigs
+	updateTrap()
+	signalsMu.Unlock()
+
+	go func() {
+		sig := <-sigs
+		done := make(chan struct{})
+		go func() {
+			finalize()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-sigs:
+		}
+
+		signal.Reset(sig)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			// Give the signal time to end the program.
+			time.Sleep(time.Second)
+		}
+		os.Exit(2)
+	}()
+}
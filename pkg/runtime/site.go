@@ -0,0 +1,49 @@
+package runtime
+
+import "sync"
+
+// SiteID identifies an instrumented source location.
+// The zero SiteID means the location is unknown.
+type SiteID uint32
+
+// Site describes an instrumented source location. The instrumenter emits a
+// table of sites for every package and registers it at package initialization.
+type Site struct {
+	File   string
+	Path   string // File relative to the root of its module
+	Line   int
+	Column int
+	Func   string // Enclosing function, qualified by package name
+	Expr   string // Source text of the accessed expression
+	Kind   Kind
+}
+
+var (
+	sites   = []Site{{}} // Index 0 is reserved for unknown sites
+	sitesMu sync.RWMutex
+)
+
+// RegisterSites adds a package's site table and returns the ID of its first
+// entry. Entry i of the table is identified by the returned base plus i.
+func RegisterSites(table []Site) SiteID {
+	sitesMu.Lock()
+	defer sitesMu.Unlock()
+	base := SiteID(len(sites))
+	sites = append(sites, table...)
+	return base
+}
+
+// LookupSite returns the site registered under id.
+func LookupSite(id SiteID) (Site, bool) {
+	sitesMu.RLock()
+	defer sitesMu.RUnlock()
+	if id == 0 || int(id) >= len(sites) {
+		return Site{}, false
+	}
+	return sites[id], true
+}
+
+// position converts a site into a report position.
+func (s Site) position() Position {
+	return Position{Func: s.Func, File: s.File, Line: s.Line}
+}
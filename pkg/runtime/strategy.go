@@ -1,20 +1,60 @@
 package runtime
 
-// Strategy defines the interface for scheduling strategies.
-// Implementations control how goroutines are scheduled during execution.
+import (
+	"slices"
+	"sync"
+)
+
+// GoroutineState describes a goroutine stopped at a scheduling point.
+type GoroutineState struct {
+	ID uint64 `json:"id"`
+	// Event is the event the goroutine yielded. It is performed once the
+	// goroutine is chosen to proceed.
+	Event Event `json:"event"`
+}
+
+// Strategy decides the order in which goroutines proceed.
+//
+// The scheduler stops every instrumented goroutine at each event it yields.
+// Once the goroutines that are running have stopped as well, or blocked in
+// an operation that cannot proceed, it asks the strategy which of the
+// stopped goroutines proceeds next. Choose is only called by the scheduler,
+// one call at a time.
 type Strategy interface {
-	RegisterGoroutine(goID uint64)
-	UnregisterGoroutine(goID uint64)
-	// OnEvent is called when a goroutine wants to perform an operation.
-	// The strategy records or processes the event.
+	// Choose returns the ID of the goroutine in enabled that proceeds next,
+	// or 0 to wait until another goroutine stops. enabled is never empty
+	// and ordered by the time the goroutines stopped, earliest first.
+	Choose(enabled []GoroutineState) uint64
+}
+
+// Observer is implemented by strategies that are told about every event,
+// in the order the scheduler lets the goroutines perform them. OnEvent is
+// called before the chosen goroutine proceeds.
+type Observer interface {
 	OnEvent(e Event)
-	// Wait blocks the caller until it's appropriate to proceed.
-	Wait(e Event)
+}
 
-	// OnFinalize is called at the end of main to perform cleanup (e.g., save trace).
+// Finalizer is implemented by strategies that clean up at the end of the
+// program, e.g. to save a trace.
+type Finalizer interface {
 	OnFinalize()
 }
 
+// GoroutineTracker is implemented by strategies that are told when
+// instrumented goroutines are created and when they end.
+type GoroutineTracker interface {
+	RegisterGoroutine(goID uint64)
+	UnregisterGoroutine(goID uint64)
+}
+
+// Waker is implemented by strategies whose decision can change while no
+// goroutine stops, e.g. because it waits for something outside of the
+// scheduler. The scheduler passes a function to SetWake that makes it call
+// Choose again.
+type Waker interface {
+	SetWake(wake func())
+}
+
 // Recorder is a strategy that can save its execution trace.
 type Recorder interface {
 	Strategy
@@ -26,3 +66,98 @@ type Replayer interface {
 	Strategy
 	ReplayTrace() error
 }
+
+// BlockingStrategy is the former strategy interface, in which strategies
+// block goroutines themselves: OnEvent is called from the scheduler when a
+// goroutine wants to perform an operation, and Wait from the goroutine,
+// which proceeds when Wait returns. Use AdaptBlocking to schedule with a
+// BlockingStrategy.
+type BlockingStrategy interface {
+	RegisterGoroutine(goID uint64)
+	UnregisterGoroutine(goID uint64)
+	// OnEvent is called when a goroutine wants to perform an operation.
+	// The strategy records or processes the event.
+	OnEvent(e Event)
+	// Wait blocks the caller until it's appropriate to proceed.
+	Wait(e Event)
+
+	// OnFinalize is called at the end of main to perform cleanup (e.g., save trace).
+	OnFinalize()
+}
+
+// AdaptBlocking returns a Strategy that lets goroutines proceed in the order
+// s releases them from Wait.
+func AdaptBlocking(s BlockingStrategy) Strategy {
+	return &blockingAdapter{s: s, submitted: make(map[uint64]bool), wake: func() {}}
+}
+
+// blockingAdapter hands every stopped goroutine's event to a
+// BlockingStrategy and waits for it in a separate goroutine, so that Choose
+// does not block. Enabled goroutines are chosen once their Wait returned.
+type blockingAdapter struct {
+	s    BlockingStrategy
+	wake func()
+
+	mu        sync.Mutex
+	submitted map[uint64]bool // goroutines whose event was handed to s
+	ready     []uint64        // goroutines released by s, in order
+}
+
+func (a *blockingAdapter) SetWake(wake func()) {
+	a.wake = wake
+}
+
+func (a *blockingAdapter) Choose(enabled []GoroutineState) uint64 {
+	for _, g := range enabled {
+		a.mu.Lock()
+		submitted := a.submitted[g.ID]
+		a.submitted[g.ID] = true
+		a.mu.Unlock()
+		if submitted {
+			continue
+		}
+		a.s.OnEvent(g.Event)
+		go func() {
+			a.s.Wait(g.Event)
+			a.mu.Lock()
+			a.ready = append(a.ready, g.ID)
+			a.mu.Unlock()
+			a.wake()
+		}()
+	}
+
+	// Goroutines released by s that are not enabled now, e.g. because
+	// another one is to proceed first, stay ready for a later choice.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := slices.IndexFunc(a.ready, func(id uint64) bool {
+		return slices.ContainsFunc(enabled, func(g GoroutineState) bool { return g.ID == id })
+	})
+	if i < 0 {
+		return 0
+	}
+	id := a.ready[i]
+	a.ready = slices.Delete(a.ready, i, i+1)
+	delete(a.submitted, id)
+	return id
+}
+
+func (a *blockingAdapter) RegisterGoroutine(goID uint64) {
+	a.s.RegisterGoroutine(goID)
+}
+
+func (a *blockingAdapter) UnregisterGoroutine(goID uint64) {
+	a.s.UnregisterGoroutine(goID)
+}
+
+func (a *blockingAdapter) OnFinalize() {
+	a.s.OnFinalize()
+}
+
+// ChooseCase forwards select decisions to the adapted strategy.
+func (a *blockingAdapter) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if c, ok := a.s.(Chooser); ok {
+		return c.ChooseCase(goID, site, ready)
+	}
+	return -1
+}
@@ -0,0 +1,110 @@
+package runtime
+
+import (
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/goid"
+)
+
+// --- Synchronization Hooks ---
+//
+// These hooks are called by the shim packages under pkg/shim, which replace
+// standard library synchronization primitives in instrumented programs.
+// Every object is identified by its address. Anything released or signaled
+// on an address happens before a later acquire or wait on the same address.
+
+// BeginAcquire is called when the calling goroutine is about to acquire the
+// object at addr, e.g. to lock a mutex, and acquires it: try acquires it if
+// that does not block, lock acquires it, blocking until it can. While the
+// object is not available, the goroutine blocks in the scheduler until the
+// object at addr or one at wakers is released, and then tries again. Acquire
+// is called once the object is held.
+func BeginAcquire(addr unsafe.Pointer, try func() bool, lock func(), wakers ...unsafe.Pointer) {
+	e := Event{GoID: goid.Get(), Kind: KindBeginAcquire, Addr: uintptr(addr)}
+	yieldEvent(e)
+	perform(e.GoID, try, lock, syncAddrs(addr, wakers), nil)
+}
+
+// Acquire is called after the calling goroutine acquired the object at addr,
+// e.g. after locking a mutex.
+func Acquire(addr unsafe.Pointer) {
+	syncEvent(KindAcquire, addr)
+}
+
+// Release is called before the calling goroutine releases the object at addr,
+// e.g. before unlocking a mutex.
+func Release(addr unsafe.Pointer) {
+	syncEvent(KindRelease, addr)
+}
+
+// BeginWait is called when the calling goroutine is about to wait on the
+// object at addr, e.g. in sync.WaitGroup.Wait, and waits: try reports
+// whether the wait is over, wait blocks until it is. Until the wait is
+// over, the goroutine blocks in the scheduler, and tries again whenever
+// addr is signaled. Wait is called once the wait returned.
+func BeginWait(addr unsafe.Pointer, try func() bool, wait func()) {
+	e := Event{GoID: goid.Get(), Kind: KindBeginWait, Addr: uintptr(addr)}
+	yieldEvent(e)
+	perform(e.GoID, try, wait, syncAddrs(addr, nil), nil)
+}
+
+// Wait is called after the calling goroutine returned from waiting on addr,
+// e.g. after sync.WaitGroup.Wait or a wake-up on a sync.Cond.
+func Wait(addr unsafe.Pointer) {
+	syncEvent(KindWait, addr)
+}
+
+// Signal is called before the calling goroutine wakes waiters of addr,
+// e.g. before sync.WaitGroup.Done or sync.Cond.Signal.
+func Signal(addr unsafe.Pointer) {
+	syncEvent(KindSignal, addr)
+}
+
+func syncEvent(kind Kind, addr unsafe.Pointer) {
+	id := goid.Get()
+	yieldEvent(Event{GoID: id, Kind: kind, Addr: uintptr(addr)})
+}
+
+// perform performs an operation of goroutine id that may block: try performs
+// it if it can proceed without blocking, block performs it, blocking until
+// it can. The goroutine blocks in the scheduler, rather than in block, until
+// an event releasing one of addrs lets it try again. offers are the start
+// events of channel operations, on the operation's unbuffered channels,
+// that a goroutine blocked on the other end can meet: block is then called
+// once the two are let run.
+func perform(id uint64, try func() bool, block func(), addrs []uintptr, offers []Event) {
+	if sched == nil {
+		block()
+		return
+	}
+	for !try() {
+		for _, e := range offers {
+			if w, k := sched.claim(e); w != nil {
+				sched.handoff(id, w, k)
+				block()
+				return
+			}
+		}
+		if sched.block(id, addrs, offers, false) != wakeRetry {
+			block()
+			return
+		}
+	}
+}
+
+func syncAddrs(addr unsafe.Pointer, more []unsafe.Pointer) []uintptr {
+	addrs := []uintptr{uintptr(addr)}
+	for _, p := range more {
+		addrs = append(addrs, uintptr(p))
+	}
+	return addrs
+}
+
+// yieldEvent hands e to the scheduler. Synchronization used before
+// Initialize, such as in package initializers, is not scheduled.
+func yieldEvent(e Event) {
+	if sched == nil {
+		return
+	}
+	sched.yield(e)
+}
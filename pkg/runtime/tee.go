@@ -0,0 +1,77 @@
+package runtime
+
+// Tee decorates a strategy by recording the events of the run to a trace in
+// the order the scheduler released them, which is the order ReplayStrategy
+// enforces, so that a run under any strategy can be replayed exactly.
+// Scheduling decisions are left to the wrapped strategy.
+type Tee struct {
+	inner Strategy
+	rec   *RecordStrategy
+}
+
+// NewTee wraps inner, recording its run to traceFile as configured by opts.
+// opts.Header should describe the wrapped strategy, e.g. its mode and seed.
+func NewTee(inner Strategy, traceFile string, opts TraceOptions) (*Tee, error) {
+	rec, err := NewRecordStrategy(traceFile, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tee{inner: inner, rec: rec}, nil
+}
+
+// Unwrap returns the decorated strategy.
+func (t *Tee) Unwrap() Strategy {
+	return t.inner
+}
+
+// Choose leaves scheduling decisions to the wrapped strategy.
+func (t *Tee) Choose(enabled []GoroutineState) uint64 {
+	return t.inner.Choose(enabled)
+}
+
+func (t *Tee) RegisterGoroutine(goID uint64) {
+	if g, ok := t.inner.(GoroutineTracker); ok {
+		g.RegisterGoroutine(goID)
+	}
+}
+
+func (t *Tee) UnregisterGoroutine(goID uint64) {
+	if g, ok := t.inner.(GoroutineTracker); ok {
+		g.UnregisterGoroutine(goID)
+	}
+}
+
+func (t *Tee) SetWake(wake func()) {
+	if w, ok := t.inner.(Waker); ok {
+		w.SetWake(wake)
+	}
+}
+
+// OnEvent records the event and forwards it.
+func (t *Tee) OnEvent(e Event) {
+	t.rec.OnEvent(e)
+	if o, ok := t.inner.(Observer); ok {
+		o.OnEvent(e)
+	}
+}
+
+// ChooseCase forwards select decisions to the wrapped strategy.
+func (t *Tee) ChooseCase(goID uint64, site SiteID, ready []int) int {
+	if c, ok := t.inner.(Chooser); ok {
+		return c.ChooseCase(goID, site, ready)
+	}
+	return -1
+}
+
+// OnFinalize finalizes the wrapped strategy and closes the trace.
+func (t *Tee) OnFinalize() {
+	if f, ok := t.inner.(Finalizer); ok {
+		f.OnFinalize()
+	}
+	t.rec.OnFinalize()
+}
+
+// RecordTrace writes the events recorded so far to the trace file.
+func (t *Tee) RecordTrace() error {
+	return t.rec.RecordTrace()
+}
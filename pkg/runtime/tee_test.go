@@ -0,0 +1,47 @@
+package runtime_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+func TestTeeRecordsReleasedEvents(t *testing.T) {
+	inner := &finalizeLog{choiceLog: choiceLog{choose: func(ready []int) int { return ready[len(ready)-1] }}}
+	path := filepath.Join(t.TempDir(), "trace")
+	tee, err := runtime.NewTee(inner, path, runtime.TraceOptions{Header: runtime.NewTraceHeader("online", 7)})
+	if err != nil {
+		t.Fatalf("NewTee failed: %v", err)
+	}
+
+	if id := tee.Choose(enabledGoroutines(2, 1)); id != 2 {
+		t.Errorf("Expected the wrapped strategy's choice 2, got %d", id)
+	}
+	if c := tee.ChooseCase(1, 0, []int{0, 2}); c != 2 {
+		t.Errorf("Expected the wrapped strategy's case 2, got %d", c)
+	}
+	events := []runtime.Event{
+		{GoID: 2, Kind: runtime.KindWrite, Addr: 0x10, Size: 8},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0x10, Size: 8},
+	}
+	for _, e := range events {
+		tee.OnEvent(e)
+	}
+	tee.OnFinalize()
+
+	if !slices.Equal(inner.events, events) || inner.finalized != 1 {
+		t.Errorf("Expected the events and finalization forwarded, got %v and %d finalizations", inner.events, inner.finalized)
+	}
+	h, err := runtime.ReadTraceHeader(path)
+	if err != nil {
+		t.Fatalf("ReadTraceHeader failed: %v", err)
+	}
+	if h.Mode != "online" || h.Seed != 7 {
+		t.Errorf("Expected the header of the wrapped strategy, got %+v", h)
+	}
+	if got, err := runtime.LoadTrace(path); err != nil || !slices.Equal(got, events) {
+		t.Errorf("Expected the events in release order %v, got %v (%v)", events, got, err)
+	}
+}
@@ -2,47 +2,361 @@ package runtime
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
-// LoadTrace reads a trace from a JSON-lines file.
-func LoadTrace(filename string) ([]Event, error) {
+// DefaultTraceBufferSize is the default size in bytes of the buffer through
+// which a TraceWriter writes events.
+const DefaultTraceBufferSize = 64 << 10
+
+// gzipMagic starts every gzip-compressed trace.
+const gzipMagic = "\x1f\x8b"
+
+// TraceFormat is the encoding of the events in a trace file.
+type TraceFormat uint8
+
+const (
+	// FormatJSON writes one JSON object per line.
+	FormatJSON TraceFormat = iota
+	// FormatBinary writes the compact, versioned binary encoding described
+	// in trace_binary.go.
+	FormatBinary
+)
+
+func (f TraceFormat) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("TraceFormat(%d)", f)
+	}
+}
+
+// ParseTraceFormat returns the trace format named s, "json" or "binary".
+func ParseTraceFormat(s string) (TraceFormat, error) {
+	switch s {
+	case "json":
+		return FormatJSON, nil
+	case "binary":
+		return FormatBinary, nil
+	}
+	return 0, fmt.Errorf("unknown trace format %q", s)
+}
+
+// TraceOptions configures how CreateTrace writes a trace. The zero value
+// writes uncompressed JSON lines through a buffer of DefaultTraceBufferSize
+// bytes.
+type TraceOptions struct {
+	Format   TraceFormat
+	Compress bool // gzip the encoded events
+	// BufferSize is the size in bytes of the write buffer. A BufferSize of
+	// 0 or less selects DefaultTraceBufferSize.
+	BufferSize int
+	// Header is written before the first event, unless it is nil.
+	Header *TraceHeader
+}
+
+// eventEncoder writes events in one trace format.
+type eventEncoder interface {
+	encode(e Event) error
+}
+
+// eventDecoder reads events in one trace format. decode returns io.EOF at
+// the end of the trace and io.ErrUnexpectedEOF if it ends within an event.
+type eventDecoder interface {
+	decode() (Event, error)
+}
+
+type jsonEncoder struct{ enc *json.Encoder }
+
+func (enc jsonEncoder) encode(e Event) error { return enc.enc.Encode(e) }
+
+// jsonHeader is the first line of a JSON trace with a header.
+type jsonHeader struct {
+	Header *TraceHeader `json:"header"`
+}
+
+type jsonDecoder struct {
+	dec   *json.Decoder
+	first *Event // the first event, read while looking for the header
+	err   error  // error reading the first line
+}
+
+// newJSONDecoder reads the header line of a JSON trace from r, if it has one.
+func newJSONDecoder(r io.Reader) (*jsonDecoder, *TraceHeader) {
+	dec := &jsonDecoder{dec: json.NewDecoder(r)}
+	var line struct {
+		jsonHeader
+		Event
+	}
+	if err := dec.dec.Decode(&line); err != nil {
+		dec.err = err
+		return dec, nil
+	}
+	if line.Header != nil {
+		return dec, line.Header
+	}
+	dec.first = &line.Event
+	return dec, nil
+}
+
+func (dec *jsonDecoder) decode() (Event, error) {
+	if dec.err != nil {
+		return Event{}, dec.err
+	}
+	if e := dec.first; e != nil {
+		dec.first = nil
+		return *e, nil
+	}
+	var e Event
+	err := dec.dec.Decode(&e)
+	return e, err
+}
+
+// TraceWriter writes a trace file one event at a time.
+// Events are buffered, so the file is complete only after Flush or Close.
+type TraceWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	zw  *gzip.Writer // nil if the trace is not compressed
+	enc eventEncoder
+}
+
+// CreateTrace creates the trace file filename, written as configured by
+// opts.
+func CreateTrace(filename string, opts TraceOptions) (*TraceWriter, error) {
+	bufSize := opts.BufferSize
+	if bufSize <= 0 {
+		bufSize = DefaultTraceBufferSize
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace file: %w", err)
+	}
+	tw := &TraceWriter{f: f, w: bufio.NewWriterSize(f, bufSize)}
+	var w io.Writer = tw.w
+	if opts.Compress {
+		tw.zw = gzip.NewWriter(tw.w)
+		w = tw.zw
+	}
+	switch opts.Format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		if opts.Header != nil {
+			if err := enc.Encode(jsonHeader{opts.Header}); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to write trace header: %w", err)
+			}
+		}
+		tw.enc = jsonEncoder{enc}
+	case FormatBinary:
+		if tw.enc, err = newBinaryEncoder(w, opts.Header); err != nil {
+			f.Close()
+			return nil, err
+		}
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown trace format %v", opts.Format)
+	}
+	return tw, nil
+}
+
+// Write appends e to the trace.
+func (w *TraceWriter) Write(e Event) error {
+	if err := w.enc.encode(e); err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	return nil
+}
+
+// Flush writes the buffered events to the file.
+func (w *TraceWriter) Flush() error {
+	if w.zw != nil {
+		if err := w.zw.Flush(); err != nil {
+			return fmt.Errorf("failed to compress trace: %w", err)
+		}
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write trace file: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the buffered events and closes the file.
+func (w *TraceWriter) Close() error {
+	var err error
+	if w.zw != nil {
+		if zerr := w.zw.Close(); zerr != nil {
+			err = fmt.Errorf("failed to compress trace: %w", zerr)
+		}
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := w.f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed to close trace file: %w", cerr)
+	}
+	return err
+}
+
+// TraceReader reads a trace file one event at a time, so that a trace need
+// not be held in memory as a whole.
+type TraceReader struct {
+	f      *os.File
+	format TraceFormat
+	header *TraceHeader
+	dec    eventDecoder
+}
+
+// OpenTrace opens the trace file filename for reading. The format of the
+// trace and whether it is compressed are detected from its content.
+func OpenTrace(filename string) (*TraceReader, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open trace file: %w", err)
 	}
-	defer f.Close()
+	r := bufio.NewReader(f)
+	if hasPrefix(r, gzipMagic) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to decompress trace file: %w", err)
+		}
+		r = bufio.NewReader(zr)
+	}
+	tr := &TraceReader{f: f}
+	if hasPrefix(r, binaryTraceMagic) {
+		tr.format = FormatBinary
+		dec, header, err := newBinaryDecoder(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		tr.dec, tr.header = dec, header
+	} else {
+		tr.format = FormatJSON
+		tr.dec, tr.header = newJSONDecoder(r)
+	}
+	return tr, nil
+}
+
+// hasPrefix reports whether the unread input of r starts with prefix.
+func hasPrefix(r *bufio.Reader, prefix string) bool {
+	b, _ := r.Peek(len(prefix))
+	return string(b) == prefix
+}
+
+// Format returns the detected format of the trace.
+func (r *TraceReader) Format() TraceFormat {
+	return r.format
+}
+
+// Header returns the header of the trace, or nil if it has none.
+func (r *TraceReader) Header() *TraceHeader {
+	return r.header
+}
+
+// Next returns the next event of the trace, or io.EOF at its end. An event
+// cut short by the end of the file, as left by a program that was killed
+// while recording, also ends the trace.
+func (r *TraceReader) Next() (Event, error) {
+	e, err := r.dec.decode()
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return Event{}, io.EOF
+		}
+		return Event{}, fmt.Errorf("failed to decode event: %w", err)
+	}
+	return e, nil
+}
+
+// Close closes the trace file.
+func (r *TraceReader) Close() error {
+	return r.f.Close()
+}
+
+// LoadTrace reads a whole trace file in any format.
+func LoadTrace(filename string) ([]Event, error) {
+	r, err := OpenTrace(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
 
 	var trace []Event
-	dec := json.NewDecoder(bufio.NewReader(f))
-	for dec.More() {
-		var e Event
-		if err := dec.Decode(&e); err != nil {
-			return nil, fmt.Errorf("failed to decode event: %w", err)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return trace, nil
+		}
+		if err != nil {
+			return nil, err
 		}
 		trace = append(trace, e)
 	}
-	return trace, nil
 }
 
-// SaveTrace writes a trace to a JSON-lines file.
+// SaveTrace writes a whole trace to a JSON-lines file.
 func SaveTrace(filename string, trace []Event) error {
-	f, err := os.Create(filename)
+	return SaveTraceWith(filename, trace, TraceOptions{})
+}
+
+// SaveTraceWith writes a whole trace to a file as configured by opts.
+func SaveTraceWith(filename string, trace []Event, opts TraceOptions) error {
+	w, err := CreateTrace(filename, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create trace file: %w", err)
+		return err
 	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	enc := json.NewEncoder(w)
 	for _, e := range trace {
-		if err := enc.Encode(e); err != nil {
-			return fmt.Errorf("failed to encode event: %w", err)
+		if err := w.Write(e); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// ConvertTrace rewrites the trace file src, in any format, to dst as
+// configured by opts. Events are streamed, so traces of any length can be
+// converted. The header of src is kept unless opts has one.
+func ConvertTrace(src, dst string, opts TraceOptions) error {
+	r, err := OpenTrace(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if fi, err := os.Stat(dst); err == nil {
+		if si, err := r.f.Stat(); err == nil && os.SameFile(fi, si) {
+			return fmt.Errorf("cannot convert trace %s onto itself", src)
+		}
+	}
+	if opts.Header == nil {
+		opts.Header = r.Header()
+	}
+	w, err := CreateTrace(dst, opts)
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return w.Close()
+		}
+		if err == nil {
+			err = w.Write(e)
+		}
+		if err != nil {
+			w.Close()
+			return err
 		}
 	}
-	return w.Flush()
 }
 
 // groupByGoID groups events by their goroutine ID, preserving order within each group.
@@ -0,0 +1,233 @@
+package runtime
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The binary trace format starts with binaryTraceMagic followed by a version
+// byte and the TraceHeader, encoded as JSON and prefixed by its length as an
+// uvarint; a length of 0 means the trace has no header. Version 1 traces have
+// no header field. Every event is then encoded as
+//
+//	kind   byte
+//	fields byte    bit set of the fields present below
+//	goid   varint  difference to the GoID of the previous event
+//	addr   varint  difference to the last Addr present, if fields&fieldAddr
+//	size   uvarint if fields&fieldSize
+//	arg    uvarint if fields&fieldArg
+//	site   uvarint if fields&fieldSite
+//	value  uvarint length followed by the bytes, if fields&fieldValue
+//
+// Consecutive events mostly come from the same goroutine and touch nearby
+// addresses, so the differences are small and most events fit in a few
+// bytes.
+const (
+	binaryTraceMagic   = "\x00MRT"
+	binaryTraceVersion = 2
+)
+
+// maxEventValue bounds the length of event values accepted by the decoder,
+// so that a corrupt trace does not exhaust memory.
+const maxEventValue = 1 << 24
+
+const (
+	fieldAddr = 1 << iota
+	fieldSize
+	fieldArg
+	fieldSite
+	fieldValue
+)
+
+// binaryEncoder writes events in the binary trace format.
+type binaryEncoder struct {
+	w        io.Writer
+	buf      []byte
+	lastGoID uint64
+	lastAddr uintptr
+}
+
+func newBinaryEncoder(w io.Writer, header *TraceHeader) (*binaryEncoder, error) {
+	b := append([]byte(binaryTraceMagic), binaryTraceVersion)
+	if header != nil {
+		data, err := json.Marshal(header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode trace header: %w", err)
+		}
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		b = append(b, data...)
+	} else {
+		b = binary.AppendUvarint(b, 0)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("failed to write trace header: %w", err)
+	}
+	return &binaryEncoder{w: w, buf: make([]byte, 0, 64)}, nil
+}
+
+func (enc *binaryEncoder) encode(e Event) error {
+	var fields byte
+	if e.Addr != 0 {
+		fields |= fieldAddr
+	}
+	if e.Size != 0 {
+		fields |= fieldSize
+	}
+	if e.Arg != 0 {
+		fields |= fieldArg
+	}
+	if e.Site != 0 {
+		fields |= fieldSite
+	}
+	if e.Value != "" {
+		fields |= fieldValue
+	}
+
+	b := append(enc.buf[:0], byte(e.Kind), fields)
+	b = binary.AppendVarint(b, int64(e.GoID-enc.lastGoID))
+	enc.lastGoID = e.GoID
+	if fields&fieldAddr != 0 {
+		b = binary.AppendVarint(b, int64(e.Addr-enc.lastAddr))
+		enc.lastAddr = e.Addr
+	}
+	if fields&fieldSize != 0 {
+		b = binary.AppendUvarint(b, uint64(e.Size))
+	}
+	if fields&fieldArg != 0 {
+		b = binary.AppendUvarint(b, e.Arg)
+	}
+	if fields&fieldSite != 0 {
+		b = binary.AppendUvarint(b, uint64(e.Site))
+	}
+	if fields&fieldValue != 0 {
+		b = binary.AppendUvarint(b, uint64(len(e.Value)))
+		b = append(b, e.Value...)
+	}
+	enc.buf = b
+	_, err := enc.w.Write(b)
+	return err
+}
+
+// byteReader is the input of binaryDecoder.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// binaryDecoder reads events in the binary trace format.
+type binaryDecoder struct {
+	r        byteReader
+	lastGoID uint64
+	lastAddr uintptr
+}
+
+// newBinaryDecoder reads the start of a binary trace from r, returning the
+// trace header or nil if the trace has none.
+func newBinaryDecoder(r byteReader) (*binaryDecoder, *TraceHeader, error) {
+	start := make([]byte, len(binaryTraceMagic)+1)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, nil, fmt.Errorf("failed to read trace header: %w", err)
+	}
+	if string(start[:len(binaryTraceMagic)]) != binaryTraceMagic {
+		return nil, nil, errors.New("not a binary trace")
+	}
+	dec := &binaryDecoder{r: r}
+	switch v := start[len(binaryTraceMagic)]; v {
+	case 1:
+		return dec, nil, nil
+	case binaryTraceVersion:
+	default:
+		return nil, nil, fmt.Errorf("unsupported binary trace version %d", v)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read trace header: %w", err)
+	}
+	if n == 0 {
+		return dec, nil, nil
+	}
+	if n > maxEventValue {
+		return nil, nil, fmt.Errorf("invalid trace header length %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, fmt.Errorf("failed to read trace header: %w", err)
+	}
+	var header TraceHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode trace header: %w", err)
+	}
+	return dec, &header, nil
+}
+
+// decode returns the next event, io.EOF at the end of the trace, or
+// io.ErrUnexpectedEOF if the trace ends within an event.
+func (dec *binaryDecoder) decode() (Event, error) {
+	kind, err := dec.r.ReadByte()
+	if err != nil {
+		return Event{}, err
+	}
+	fields, err := dec.r.ReadByte()
+	if err != nil {
+		return Event{}, unexpectedEOF(err)
+	}
+	e := Event{Kind: Kind(kind)}
+	d, err := binary.ReadVarint(dec.r)
+	if err != nil {
+		return Event{}, unexpectedEOF(err)
+	}
+	dec.lastGoID += uint64(d)
+	e.GoID = dec.lastGoID
+	if fields&fieldAddr != 0 {
+		d, err := binary.ReadVarint(dec.r)
+		if err != nil {
+			return Event{}, unexpectedEOF(err)
+		}
+		dec.lastAddr += uintptr(d)
+		e.Addr = dec.lastAddr
+	}
+	var u uint64
+	if fields&fieldSize != 0 {
+		if u, err = binary.ReadUvarint(dec.r); err != nil {
+			return Event{}, unexpectedEOF(err)
+		}
+		e.Size = uintptr(u)
+	}
+	if fields&fieldArg != 0 {
+		if e.Arg, err = binary.ReadUvarint(dec.r); err != nil {
+			return Event{}, unexpectedEOF(err)
+		}
+	}
+	if fields&fieldSite != 0 {
+		if u, err = binary.ReadUvarint(dec.r); err != nil {
+			return Event{}, unexpectedEOF(err)
+		}
+		e.Site = SiteID(u)
+	}
+	if fields&fieldValue != 0 {
+		if u, err = binary.ReadUvarint(dec.r); err != nil {
+			return Event{}, unexpectedEOF(err)
+		}
+		if u > maxEventValue {
+			return Event{}, fmt.Errorf("invalid value length %d", u)
+		}
+		value := make([]byte, u)
+		if _, err := io.ReadFull(dec.r, value); err != nil {
+			return Event{}, unexpectedEOF(err)
+		}
+		e.Value = string(value)
+	}
+	return e, nil
+}
+
+// unexpectedEOF turns an io.EOF within an event into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+package runtime_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+var testTrace = []runtime.Event{
+	{GoID: 1, Kind: runtime.KindSpawn, Arg: 2, Site: 3},
+	{GoID: 2, Kind: runtime.KindGoEnter},
+	{GoID: 2, Kind: runtime.KindWrite, Addr: 0x100, Size: 8, Site: 4},
+	{GoID: 1, Kind: runtime.KindPanic, Value: "boom"},
+}
+
+var traceOptions = map[string]runtime.TraceOptions{
+	"json":        {Format: runtime.FormatJSON},
+	"json-gzip":   {Format: runtime.FormatJSON, Compress: true},
+	"binary":      {Format: runtime.FormatBinary},
+	"binary-gzip": {Format: runtime.FormatBinary, Compress: true},
+}
+
+// readTrace reads path with a TraceReader, returning its events and format.
+func readTrace(t *testing.T, path string) ([]runtime.Event, runtime.TraceFormat) {
+	t.Helper()
+	r, err := runtime.OpenTrace(path)
+	if err != nil {
+		t.Fatalf("OpenTrace failed: %v", err)
+	}
+	defer r.Close()
+	var got []runtime.Event
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return got, r.Format()
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, e)
+	}
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	for name, opts := range traceOptions {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace")
+			if err := runtime.SaveTraceWith(path, testTrace, opts); err != nil {
+				t.Fatalf("SaveTraceWith failed: %v", err)
+			}
+			got, format := readTrace(t, path)
+			if !slices.Equal(got, testTrace) {
+				t.Errorf("Expected %v, got %v", testTrace, got)
+			}
+			if format != opts.Format {
+				t.Errorf("Expected format %v to be detected, got %v", opts.Format, format)
+			}
+		})
+	}
+}
+
+func TestBinaryTraceDeltas(t *testing.T) {
+	// Goroutine IDs and addresses move back and forth.
+	trace := []runtime.Event{
+		{GoID: 7, Kind: runtime.KindWrite, Addr: 0xc000100000, Size: 8, Site: 1},
+		{GoID: 1, Kind: runtime.KindRead, Addr: 0xc000000010, Size: 4, Site: 2},
+		{GoID: 1 << 40, Kind: runtime.KindAcquire, Addr: ^uintptr(0)},
+		{GoID: 2, Kind: runtime.KindRead, Addr: 1, Size: 1},
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "trace")
+	if err := runtime.SaveTraceWith(path, trace, runtime.TraceOptions{Format: runtime.FormatBinary}); err != nil {
+		t.Fatalf("SaveTraceWith failed: %v", err)
+	}
+	if got, _ := readTrace(t, path); !slices.Equal(got, trace) {
+		t.Errorf("Expected %v, got %v", trace, got)
+	}
+
+	json := filepath.Join(dir, "json")
+	if err := runtime.SaveTrace(json, trace); err != nil {
+		t.Fatalf("SaveTrace failed: %v", err)
+	}
+	bin, _ := os.Stat(path)
+	js, _ := os.Stat(json)
+	if bin.Size() >= js.Size()/3 {
+		t.Errorf("Expected the binary trace to be much smaller than %d bytes of JSON, got %d bytes", js.Size(), bin.Size())
+	}
+}
+
+func TestConvertTrace(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := runtime.SaveTrace(src, testTrace); err != nil {
+		t.Fatalf("SaveTrace failed: %v", err)
+	}
+	bin := filepath.Join(dir, "bin")
+	if err := runtime.ConvertTrace(src, bin, runtime.TraceOptions{Format: runtime.FormatBinary, Compress: true}); err != nil {
+		t.Fatalf("ConvertTrace to binary failed: %v", err)
+	}
+	back := filepath.Join(dir, "back")
+	if err := runtime.ConvertTrace(bin, back, runtime.TraceOptions{}); err != nil {
+		t.Fatalf("ConvertTrace to JSON failed: %v", err)
+	}
+	orig, _ := os.ReadFile(src)
+	if got, _ := os.ReadFile(back); string(got) != string(orig) {
+		t.Errorf("Expected the converted trace to equal the original:\n%s\ngot:\n%s", orig, got)
+	}
+
+	if err := runtime.ConvertTrace(src, src, runtime.TraceOptions{}); err == nil {
+		t.Error("Expected converting a trace onto itself to fail")
+	}
+	if got, _ := readTrace(t, src); !slices.Equal(got, testTrace) {
+		t.Errorf("Expected the source trace to be left intact, got %v", got)
+	}
+}
+
+func TestBinaryTraceVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace")
+	if err := os.WriteFile(path, []byte("\x00MRT\x63"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.OpenTrace(path); err == nil {
+		t.Error("Expected an unsupported version to be rejected")
+	}
+}
+
+func TestTraceTruncatedEvent(t *testing.T) {
+	for name, cut := range map[string]struct {
+		format runtime.TraceFormat
+		n      int
+	}{
+		"json":   {runtime.FormatJSON, 10},
+		"binary": {runtime.FormatBinary, 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace")
+			if err := runtime.SaveTraceWith(path, testTrace, runtime.TraceOptions{Format: cut.format}); err != nil {
+				t.Fatalf("SaveTraceWith failed: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Cut the last event in half, as a killed recorder may leave it.
+			if err := os.WriteFile(path, data[:len(data)-cut.n], 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := runtime.LoadTrace(path)
+			if err != nil {
+				t.Fatalf("LoadTrace failed: %v", err)
+			}
+			if want := testTrace[:len(testTrace)-1]; !slices.Equal(got, want) {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestRecordStrategyStreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace")
+	s, err := runtime.NewRecordStrategy(path, runtime.TraceOptions{BufferSize: 16})
+	if err != nil {
+		t.Fatalf("NewRecordStrategy failed: %v", err)
+	}
+
+	s.OnEvent(testTrace[0])
+	s.OnEvent(testTrace[1])
+	if err := s.RecordTrace(); err != nil {
+		t.Fatalf("RecordTrace failed: %v", err)
+	}
+	got, err := runtime.LoadTrace(path)
+	if err != nil {
+		t.Fatalf("LoadTrace failed: %v", err)
+	}
+	if want := testTrace[:2]; !slices.Equal(got, want) {
+		t.Errorf("Expected the flushed events %v, got %v", want, got)
+	}
+
+	for _, e := range testTrace[2:] {
+		s.OnEvent(e)
+	}
+	s.OnFinalize()
+	if got, _ = runtime.LoadTrace(path); !slices.Equal(got, testTrace) {
+		t.Errorf("Expected %v after finalization, got %v", testTrace, got)
+	}
+}
+
+func TestTraceHeader(t *testing.T) {
+	header := runtime.NewTraceHeader("record", 0)
+	for name, opts := range traceOptions {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "trace")
+			opts.Header = header
+			if err := runtime.SaveTraceWith(path, testTrace, opts); err != nil {
+				t.Fatalf("SaveTraceWith failed: %v", err)
+			}
+			if got, _ := readTrace(t, path); !slices.Equal(got, testTrace) {
+				t.Errorf("Expected %v, got %v", testTrace, got)
+			}
+
+			// Converting keeps the header.
+			converted := filepath.Join(dir, "converted")
+			if err := runtime.ConvertTrace(path, converted, runtime.TraceOptions{Format: runtime.FormatBinary}); err != nil {
+				t.Fatalf("ConvertTrace failed: %v", err)
+			}
+			for _, p := range []string{path, converted} {
+				got, err := runtime.ReadTraceHeader(p)
+				if err != nil {
+					t.Fatalf("ReadTraceHeader failed: %v", err)
+				}
+				if got == nil || got.Program != header.Program || !got.Time.Equal(header.Time) ||
+					!slices.Equal(got.Args, header.Args) || got.Mode != "record" {
+					t.Errorf("Expected header %v, got %v", header, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBinaryTraceVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace")
+	// A version 1 trace has no header field.
+	if err := os.WriteFile(path, []byte("\x00MRT\x01\x04\x00\x02"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := runtime.OpenTrace(path)
+	if err != nil {
+		t.Fatalf("OpenTrace failed: %v", err)
+	}
+	defer r.Close()
+	if r.Header() != nil {
+		t.Errorf("Expected no header, got %v", r.Header())
+	}
+	if e, err := r.Next(); err != nil || e != (runtime.Event{GoID: 1, Kind: runtime.KindGoEnter}) {
+		t.Errorf("Expected the enter event of goroutine 1, got %v, %v", e, err)
+	}
+}
+
+func TestTraceHeaderCheck(t *testing.T) {
+	header := runtime.NewTraceHeader("record", 0)
+	if warnings, err := header.Check(); err != nil || len(warnings) != 0 {
+		t.Errorf("Expected the header of this program to match, got %v, %v", warnings, err)
+	}
+	if warnings, err := (*runtime.TraceHeader)(nil).Check(); err != nil || len(warnings) != 1 {
+		t.Errorf("Expected a warning for a missing header, got %v, %v", warnings, err)
+	}
+
+	other := *header
+	other.Program = "0123456789abcdef"
+	if _, err := other.Check(); !errors.Is(err, runtime.ErrTraceMismatch) {
+		t.Errorf("Expected a program mismatch, got %v", err)
+	}
+	newer := *header
+	newer.Version = runtime.TraceVersion + 1
+	if _, err := newer.Check(); !errors.Is(err, runtime.ErrTraceMismatch) {
+		t.Errorf("Expected a version mismatch, got %v", err)
+	}
+	rebuilt := *header
+	rebuilt.Moriarty = "v0.0.1"
+	if warnings, err := rebuilt.Check(); err != nil || len(warnings) != 1 {
+		t.Errorf("Expected a warning for another moriarty version, got %v, %v", warnings, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "trace")
+	if err := runtime.SaveTraceWith(path, testTrace, runtime.TraceOptions{Header: &other}); err != nil {
+		t.Fatalf("SaveTraceWith failed: %v", err)
+	}
+	if _, err := runtime.NewReplayStrategy(path); !errors.Is(err, runtime.ErrTraceMismatch) {
+		t.Errorf("Expected replay of another program's trace to be refused, got %v", err)
+	}
+	if _, err := runtime.NewRandomStrategy(path, 1); err != nil {
+		t.Errorf("Expected random mode to accept another program's trace, got %v", err)
+	}
+}
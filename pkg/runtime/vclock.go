@@ -0,0 +1,49 @@
+package runtime
+
+// vectorClock maps goroutine IDs to logical clocks.
+// A missing entry is equivalent to a zero clock.
+type vectorClock map[uint64]uint64
+
+// epoch is a single (goroutine, clock) pair. It is the compact form
+// FastTrack uses for the accesses kept in shadow cells.
+type epoch struct {
+	goID  uint64
+	clock uint64
+}
+
+func (vc vectorClock) copy() vectorClock {
+	c := make(vectorClock, len(vc))
+	for id, t := range vc {
+		c[id] = t
+	}
+	return c
+}
+
+// join sets vc to the pointwise maximum of vc and other.
+func (vc vectorClock) join(other vectorClock) {
+	for id, t := range other {
+		if t > vc[id] {
+			vc[id] = t
+		}
+	}
+}
+
+// leq reports whether vc happens before or equals other.
+func (vc vectorClock) leq(other vectorClock) bool {
+	for id, t := range vc {
+		if t > other[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// epochOf returns the current epoch of goroutine goID according to vc.
+func (vc vectorClock) epochOf(goID uint64) epoch {
+	return epoch{goID: goID, clock: vc[goID]}
+}
+
+// happensBefore reports whether e is ordered before the state described by vc.
+func (e epoch) happensBefore(vc vectorClock) bool {
+	return e.clock <= vc[e.goID]
+}
@@ -0,0 +1,131 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"os"
+	goruntime "runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWatchdogTimeout is how long a replay may make no progress before
+// the watchdog ends it.
+const DefaultWatchdogTimeout = 10 * time.Second
+
+// WatchdogExitCode is the exit status of a program ended by the watchdog.
+const WatchdogExitCode = 4
+
+// finalizeTimeout bounds how long the watchdog waits for the runtime to
+// finalize before exiting anyway, as finalization may itself be stuck.
+const finalizeTimeout = time.Second
+
+// watchdog ends a program whose scheduling strategy made no progress for a
+// while although goroutines wait for it. The strategy calls begin and end
+// around each decision it makes.
+type watchdog struct {
+	timeout time.Duration
+	stacks  bool // dump the stacks of all goroutines
+	out     io.Writer
+
+	// stalled reports whether goroutines wait for the strategy, and dump
+	// describes what they wait for.
+	stalled func() bool
+	dump    func(w io.Writer)
+
+	progress atomic.Uint64 // number of goroutines let proceed
+	handling atomic.Bool   // a decision is being made
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func startWatchdog(timeout time.Duration, stacks bool, stalled func() bool, dump func(w io.Writer)) *watchdog {
+	w := &watchdog{
+		timeout: timeout,
+		stacks:  stacks,
+		out:     os.Stderr,
+		stalled: stalled,
+		dump:    dump,
+		stop:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *watchdog) begin() {
+	if w != nil {
+		w.handling.Store(true)
+	}
+}
+
+// end notes the end of a decision, which let a goroutine proceed if
+// progressed is set.
+func (w *watchdog) end(progressed bool) {
+	if w != nil {
+		if progressed {
+			w.progress.Add(1)
+		}
+		w.handling.Store(false)
+	}
+}
+
+// close stops the watchdog.
+func (w *watchdog) close() {
+	if w != nil {
+		w.stopOnce.Do(func() { close(w.stop) })
+	}
+}
+
+func (w *watchdog) run() {
+	t := time.NewTicker(max(w.timeout/4, time.Millisecond))
+	defer t.Stop()
+	last, since := w.progress.Load(), time.Now()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-t.C:
+			if p := w.progress.Load(); p != last || !(w.handling.Load() || w.stalled()) {
+				last, since = p, now
+				continue
+			}
+			if now.Sub(since) >= w.timeout {
+				w.fire(now.Sub(since))
+				return
+			}
+		}
+	}
+}
+
+// fire reports the stall and ends the program.
+func (w *watchdog) fire(stalled time.Duration) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "moriarty: replay made no progress for %v\n", stalled.Round(time.Millisecond))
+	w.dump(&b)
+	if w.stacks {
+		buf := make([]byte, 1<<20)
+		for {
+			n := goruntime.Stack(buf, true)
+			if n < len(buf) {
+				buf = buf[:n]
+				break
+			}
+			buf = make([]byte, 2*len(buf))
+		}
+		fmt.Fprintf(&b, "\n%s\n", buf)
+	}
+	io.WriteString(w.out, b.String())
+
+	done := make(chan struct{})
+	go func() {
+		finalize()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(finalizeTimeout):
+	}
+	os.Exit(WatchdogExitCode)
+}
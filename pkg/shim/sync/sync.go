@@ -0,0 +1,349 @@
+// Package sync is a drop-in replacement for the standard library sync package.
+// Its primitives report acquire, release, wait and signal events to the
+// moriarty runtime, so that the scheduler sees lock ordering and the race
+// detector sees the happens-before edges they create.
+//
+// The toolexec build rewrites imports of "sync" in instrumented packages to
+// this package. Locker is an alias of the standard library interface, every
+// other type wraps its standard library counterpart.
+package sync
+
+import (
+	gosync "sync"
+	"sync/atomic"
+	"unsafe"
+
+	rt "github.com/amirkhaki/moriarty/pkg/runtime"
+)
+
+// A Locker represents an object that can be locked and unlocked.
+type Locker = gosync.Locker
+
+// Mutex is a mutual exclusion lock. The zero value is an unlocked mutex.
+type Mutex struct {
+	mu gosync.Mutex
+}
+
+// Lock locks m.
+func (m *Mutex) Lock() {
+	rt.BeginAcquire(unsafe.Pointer(m), m.mu.TryLock, m.mu.Lock)
+	rt.Acquire(unsafe.Pointer(m))
+}
+
+// TryLock tries to lock m and reports whether it succeeded.
+func (m *Mutex) TryLock() bool {
+	if !m.mu.TryLock() {
+		return false
+	}
+	rt.Acquire(unsafe.Pointer(m))
+	return true
+}
+
+// Unlock unlocks m.
+func (m *Mutex) Unlock() {
+	rt.Release(unsafe.Pointer(m))
+	m.mu.Unlock()
+}
+
+// RWMutex is a reader/writer mutual exclusion lock.
+// The zero value is an unlocked mutex.
+type RWMutex struct {
+	rw gosync.RWMutex
+	// readers is only used for its address: read unlocks are released on it,
+	// so that readers are ordered before the next writer but not each other.
+	readers byte
+}
+
+// Lock locks rw for writing.
+func (rw *RWMutex) Lock() {
+	// Writers wait for the readers to unlock as well
+	rt.BeginAcquire(unsafe.Pointer(rw), rw.rw.TryLock, rw.rw.Lock, unsafe.Pointer(&rw.readers))
+	rt.Acquire(unsafe.Pointer(rw))
+	rt.Acquire(unsafe.Pointer(&rw.readers))
+}
+
+// TryLock tries to lock rw for writing and reports whether it succeeded.
+func (rw *RWMutex) TryLock() bool {
+	if !rw.rw.TryLock() {
+		return false
+	}
+	rt.Acquire(unsafe.Pointer(rw))
+	rt.Acquire(unsafe.Pointer(&rw.readers))
+	return true
+}
+
+// Unlock unlocks rw for writing.
+func (rw *RWMutex) Unlock() {
+	rt.Release(unsafe.Pointer(rw))
+	rw.rw.Unlock()
+}
+
+// RLock locks rw for reading.
+func (rw *RWMutex) RLock() {
+	rt.BeginAcquire(unsafe.Pointer(rw), rw.rw.TryRLock, rw.rw.RLock)
+	rt.Acquire(unsafe.Pointer(rw))
+}
+
+// TryRLock tries to lock rw for reading and reports whether it succeeded.
+func (rw *RWMutex) TryRLock() bool {
+	if !rw.rw.TryRLock() {
+		return false
+	}
+	rt.Acquire(unsafe.Pointer(rw))
+	return true
+}
+
+// RUnlock undoes a single RLock call.
+func (rw *RWMutex) RUnlock() {
+	rt.Release(unsafe.Pointer(&rw.readers))
+	rw.rw.RUnlock()
+}
+
+// RLocker returns a Locker that implements Lock and Unlock by calling
+// rw.RLock and rw.RUnlock.
+func (rw *RWMutex) RLocker() Locker {
+	return (*rlocker)(rw)
+}
+
+type rlocker RWMutex
+
+func (r *rlocker) Lock()   { (*RWMutex)(r).RLock() }
+func (r *rlocker) Unlock() { (*RWMutex)(r).RUnlock() }
+
+// WaitGroup waits for a collection of goroutines to finish.
+type WaitGroup struct {
+	wg gosync.WaitGroup
+	// n mirrors the counter of wg, so that Wait can tell whether it would
+	// block
+	n atomic.Int64
+}
+
+// Add adds delta, which may be negative, to the WaitGroup counter.
+func (wg *WaitGroup) Add(delta int) {
+	if delta < 0 {
+		rt.Signal(unsafe.Pointer(wg))
+	}
+	wg.n.Add(int64(delta))
+	wg.wg.Add(delta)
+}
+
+// Done decrements the WaitGroup counter by one.
+func (wg *WaitGroup) Done() {
+	wg.Add(-1)
+}
+
+// Go calls f in a new goroutine and adds that task to the WaitGroup.
+func (wg *WaitGroup) Go(f func()) {
+	wg.Add(1)
+	rt.Spawn(func() {
+		rt.GoroutineEnter()
+		defer rt.GoroutineExit()
+		defer wg.Done()
+		f()
+	}, 0)
+}
+
+// Wait blocks until the WaitGroup counter is zero.
+func (wg *WaitGroup) Wait() {
+	rt.BeginWait(unsafe.Pointer(wg), func() bool { return wg.n.Load() == 0 }, wg.wg.Wait)
+	rt.Wait(unsafe.Pointer(wg))
+}
+
+// Once is an object that will perform exactly one action.
+type Once struct {
+	done atomic.Bool
+	// m is the shim's Mutex, so that a caller waiting for f to return
+	// blocks where the scheduler sees it
+	m Mutex
+}
+
+// Do calls f if and only if Do is being called for the first time for this
+// instance of Once. Every call returns after f has returned.
+func (o *Once) Do(f func()) {
+	if !o.done.Load() {
+		o.doSlow(f)
+	}
+	rt.Wait(unsafe.Pointer(o))
+}
+
+func (o *Once) doSlow(f func()) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if !o.done.Load() {
+		defer o.done.Store(true)
+		defer rt.Signal(unsafe.Pointer(o))
+		f()
+	}
+}
+
+// Cond implements a condition variable, a rendezvous point for goroutines
+// waiting for or announcing the occurrence of an event.
+type Cond struct {
+	// L is held while observing or changing the condition
+	L Locker
+
+	mu      gosync.Mutex
+	waiters []chan struct{}
+}
+
+// NewCond returns a new Cond with Locker l.
+func NewCond(l Locker) *Cond {
+	return &Cond{L: l}
+}
+
+// Wait atomically unlocks c.L and suspends the calling goroutine until it is
+// woken by Signal or Broadcast. It locks c.L again before returning.
+func (c *Cond) Wait() {
+	ready := make(chan struct{})
+	c.mu.Lock()
+	c.waiters = append(c.waiters, ready)
+	c.mu.Unlock()
+
+	c.L.Unlock()
+	rt.BeginWait(unsafe.Pointer(c), func() bool {
+		select {
+		case <-ready:
+			return true
+		default:
+			return false
+		}
+	}, func() { <-ready })
+	rt.Wait(unsafe.Pointer(c))
+	c.L.Lock()
+}
+
+// Signal wakes one goroutine waiting on c, if there is any.
+func (c *Cond) Signal() {
+	rt.Signal(unsafe.Pointer(c))
+	c.mu.Lock()
+	if len(c.waiters) > 0 {
+		close(c.waiters[0])
+		c.waiters = c.waiters[1:]
+	}
+	c.mu.Unlock()
+}
+
+// Broadcast wakes all goroutines waiting on c.
+func (c *Cond) Broadcast() {
+	rt.Signal(unsafe.Pointer(c))
+	c.mu.Lock()
+	for _, ready := range c.waiters {
+		close(ready)
+	}
+	c.waiters = nil
+	c.mu.Unlock()
+}
+
+// Map is a map safe for concurrent use by multiple goroutines. Every write
+// is released on the map and every read acquires it, so that a store
+// happens before the loads that observe it.
+type Map struct {
+	m gosync.Map
+}
+
+// Load returns the value stored in the map for a key, or nil if no value is
+// present. The ok result indicates whether value was found in the map.
+func (m *Map) Load(key any) (value any, ok bool) {
+	value, ok = m.m.Load(key)
+	rt.Acquire(unsafe.Pointer(m))
+	return value, ok
+}
+
+// Store sets the value for a key.
+func (m *Map) Store(key, value any) {
+	rt.Release(unsafe.Pointer(m))
+	m.m.Store(key, value)
+}
+
+// Clear deletes all the entries.
+func (m *Map) Clear() {
+	rt.Release(unsafe.Pointer(m))
+	m.m.Clear()
+}
+
+// LoadOrStore returns the existing value for the key if present. Otherwise,
+// it stores and returns the given value. The loaded result is true if the
+// value was loaded, false if stored.
+func (m *Map) LoadOrStore(key, value any) (actual any, loaded bool) {
+	rt.Release(unsafe.Pointer(m))
+	actual, loaded = m.m.LoadOrStore(key, value)
+	rt.Acquire(unsafe.Pointer(m))
+	return actual, loaded
+}
+
+// LoadAndDelete deletes the value for a key, returning the previous value if
+// any. The loaded result reports whether the key was present.
+func (m *Map) LoadAndDelete(key any) (value any, loaded bool) {
+	rt.Release(unsafe.Pointer(m))
+	value, loaded = m.m.LoadAndDelete(key)
+	rt.Acquire(unsafe.Pointer(m))
+	return value, loaded
+}
+
+// Delete deletes the value for a key.
+func (m *Map) Delete(key any) {
+	rt.Release(unsafe.Pointer(m))
+	m.m.Delete(key)
+}
+
+// Swap swaps the value for a key and returns the previous value if any. The
+// loaded result reports whether the key was present.
+func (m *Map) Swap(key, value any) (previous any, loaded bool) {
+	rt.Release(unsafe.Pointer(m))
+	previous, loaded = m.m.Swap(key, value)
+	rt.Acquire(unsafe.Pointer(m))
+	return previous, loaded
+}
+
+// CompareAndSwap swaps the old and new values for key if the value stored in
+// the map is equal to old.
+func (m *Map) CompareAndSwap(key, old, new any) (swapped bool) {
+	rt.Release(unsafe.Pointer(m))
+	swapped = m.m.CompareAndSwap(key, old, new)
+	rt.Acquire(unsafe.Pointer(m))
+	return swapped
+}
+
+// CompareAndDelete deletes the entry for key if its value is equal to old.
+func (m *Map) CompareAndDelete(key, old any) (deleted bool) {
+	rt.Release(unsafe.Pointer(m))
+	deleted = m.m.CompareAndDelete(key, old)
+	rt.Acquire(unsafe.Pointer(m))
+	return deleted
+}
+
+// Range calls f sequentially for each key and value present in the map. If
+// f returns false, range stops the iteration.
+func (m *Map) Range(f func(key, value any) bool) {
+	rt.Acquire(unsafe.Pointer(m))
+	m.m.Range(f)
+}
+
+// A Pool is a set of temporary objects that may be individually saved and
+// retrieved. A Put is released on the pool and a Get acquires it, so that
+// an object is handed over with the writes made to it before it was put.
+type Pool struct {
+	pool gosync.Pool
+
+	// New optionally specifies a function to generate a value when Get
+	// would otherwise return nil.
+	New func() any
+}
+
+// Put adds x to the pool.
+func (p *Pool) Put(x any) {
+	rt.Release(unsafe.Pointer(p))
+	p.pool.Put(x)
+}
+
+// Get selects an arbitrary item from the Pool, removes it from the Pool, and
+// returns it to the caller. If Get would otherwise return nil and p.New is
+// non-nil, Get returns the result of calling p.New.
+func (p *Pool) Get() any {
+	x := p.pool.Get()
+	rt.Acquire(unsafe.Pointer(p))
+	if x == nil && p.New != nil {
+		x = p.New()
+	}
+	return x
+}
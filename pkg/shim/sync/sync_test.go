@@ -0,0 +1,204 @@
+package sync_test
+
+import (
+	gosync "sync"
+	"testing"
+	"unsafe"
+
+	"github.com/amirkhaki/moriarty/pkg/runtime"
+	"github.com/amirkhaki/moriarty/pkg/shim/sync"
+)
+
+// eventLog records events in the order the calling goroutines yield them.
+type eventLog struct {
+	mu     gosync.Mutex
+	events []runtime.Event
+}
+
+func (l *eventLog) Choose(enabled []runtime.GoroutineState) uint64 {
+	return enabled[0].ID
+}
+
+func (l *eventLog) OnEvent(e runtime.Event) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+// take returns and clears the recorded events.
+func (l *eventLog) take() []runtime.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+var log = &eventLog{}
+
+func init() {
+	runtime.SetStrategy(log)
+}
+
+func expect(t *testing.T, got []runtime.Event, kinds []runtime.Kind, addrs []unsafe.Pointer) {
+	t.Helper()
+	if len(got) != len(kinds) {
+		t.Fatalf("Expected %d events, got %d: %v", len(kinds), len(got), got)
+	}
+	for i, e := range got {
+		if e.Kind != kinds[i] || e.Addr != uintptr(addrs[i]) {
+			t.Errorf("Event %d: expected %v at %p, got %v at %#x", i, kinds[i], addrs[i], e.Kind, e.Addr)
+		}
+	}
+}
+
+func TestMutex(t *testing.T) {
+	var m sync.Mutex
+	m.Lock()
+	m.Unlock()
+	if !m.TryLock() {
+		t.Fatal("TryLock failed on an unlocked mutex")
+	}
+	if m.TryLock() {
+		t.Fatal("TryLock succeeded on a locked mutex")
+	}
+	m.Unlock()
+
+	p := unsafe.Pointer(&m)
+	expect(t, log.take(),
+		[]runtime.Kind{runtime.KindBeginAcquire, runtime.KindAcquire, runtime.KindRelease, runtime.KindAcquire, runtime.KindRelease},
+		[]unsafe.Pointer{p, p, p, p, p})
+}
+
+func TestRWMutexReadersReleaseSeparately(t *testing.T) {
+	var rw sync.RWMutex
+	rw.RLock()
+	rw.RUnlock()
+	rw.Lock()
+	rw.Unlock()
+
+	events := log.take()
+	if len(events) != 7 {
+		t.Fatalf("Expected 7 events, got %d: %v", len(events), events)
+	}
+	// The read unlock must be released where the writer acquires it,
+	// but not where other readers acquire.
+	readers := events[2].Addr
+	if readers == events[1].Addr {
+		t.Errorf("Expected RUnlock to release a separate address, got %v", events)
+	}
+	if events[4].Addr != events[1].Addr || events[5].Addr != readers {
+		t.Errorf("Expected Lock to acquire both addresses, got %v", events)
+	}
+}
+
+func TestWaitGroup(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	done := make(chan struct{})
+	go func() {
+		wg.Done()
+		wg.Done()
+		close(done)
+	}()
+	<-done
+	wg.Wait()
+
+	p := unsafe.Pointer(&wg)
+	expect(t, log.take(),
+		[]runtime.Kind{runtime.KindSignal, runtime.KindSignal, runtime.KindBeginWait, runtime.KindWait},
+		[]unsafe.Pointer{p, p, p, p})
+}
+
+func TestOnce(t *testing.T) {
+	var once sync.Once
+	calls := 0
+	once.Do(func() { calls++ })
+	once.Do(func() { calls++ })
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+
+	// The first call runs f under a lock, the second one only waits
+	p := unsafe.Pointer(&once)
+	events := log.take()
+	if len(events) != 6 {
+		t.Fatalf("Expected 6 events, got %v", events)
+	}
+	expect(t, []runtime.Event{events[2], events[4], events[5]},
+		[]runtime.Kind{runtime.KindSignal, runtime.KindWait, runtime.KindWait},
+		[]unsafe.Pointer{p, p, p})
+	lock := []runtime.Event{events[0], events[1], events[3]}
+	for i, kind := range []runtime.Kind{runtime.KindBeginAcquire, runtime.KindAcquire, runtime.KindRelease} {
+		if lock[i].Kind != kind || lock[i].Addr != lock[0].Addr || lock[i].Addr == uintptr(p) {
+			t.Errorf("Expected f to run under a separate lock, got %v", events)
+		}
+	}
+}
+
+func TestCond(t *testing.T) {
+	var m sync.Mutex
+	c := sync.NewCond(&m)
+	ready := false
+	done := make(chan struct{})
+	go func() {
+		m.Lock()
+		for !ready {
+			c.Wait()
+		}
+		m.Unlock()
+		close(done)
+	}()
+
+	m.Lock()
+	ready = true
+	c.Broadcast()
+	m.Unlock()
+	<-done
+
+	var waits, signals int
+	for _, e := range log.take() {
+		switch e.Kind {
+		case runtime.KindWait:
+			waits++
+		case runtime.KindSignal:
+			signals++
+		}
+	}
+	if signals != 1 || waits > 1 {
+		t.Errorf("Expected 1 signal and at most 1 wait, got %d and %d", signals, waits)
+	}
+}
+
+func TestMapAndPool(t *testing.T) {
+	var m sync.Map
+	m.Store("k", 1)
+	if v, ok := m.Load("k"); !ok || v != 1 {
+		t.Fatalf("Expected to load 1, got %v, %v", v, ok)
+	}
+	p := sync.Pool{New: func() any { return 0 }}
+	if v := p.Get(); v != 0 {
+		t.Fatalf("Expected New's value, got %v", v)
+	}
+	p.Put(1)
+
+	mp, pp := unsafe.Pointer(&m), unsafe.Pointer(&p)
+	expect(t, log.take(),
+		[]runtime.Kind{runtime.KindRelease, runtime.KindAcquire, runtime.KindAcquire, runtime.KindRelease},
+		[]unsafe.Pointer{mp, mp, pp, pp})
+}
+
+func TestOnceValuePanics(t *testing.T) {
+	f := sync.OnceValue(func() int { panic("boom") })
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if r := recover(); r != "boom" {
+					t.Errorf("Call %d: expected panic %q, got %v", i, "boom", r)
+				}
+			}()
+			f()
+		}()
+	}
+	log.take()
+}